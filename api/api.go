@@ -0,0 +1,133 @@
+// Package api serves the health, status and control endpoints of the daemon.
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/metrics"
+	"github.com/fvoci/hyper-backup/scheduler"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Serve listens on addr until ctx is cancelled. Triggered runs use ctx, so
+// they stop with the daemon. POST endpoints require API_TOKEN as a bearer
+// token and are disabled when it is unset.
+func Serve(ctx context.Context, addr string) error {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           Handler(ctx, utilities.Getenv("API_TOKEN")),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	utilities.Logger.Infof("[API] 🌐 Listening on %s", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler returns the API routes. Runs it triggers are bound to ctx.
+func Handler(ctx context.Context, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", healthz)
+	mux.HandleFunc("GET /status", status)
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.Handle("POST /run", authorized(token, func(w http.ResponseWriter, r *http.Request) {
+		respondRun(w, scheduler.RunNow(ctx), "cycle")
+	}))
+	mux.Handle("POST /run/{service}", authorized(token, func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("service")
+		respondRun(w, scheduler.RunService(ctx, name), name)
+	}))
+	return mux
+}
+
+// healthz answers 200 while the scheduler is alive. A failed last cycle is
+// reported but does not fail the check, since restarting would not fix it.
+func healthz(w http.ResponseWriter, r *http.Request) {
+	st := scheduler.CurrentStatus()
+	body := map[string]any{"status": "ok", "scheduler": "running"}
+	if st.Last != nil {
+		body["last_cycle"] = st.Last.Status()
+		body["last_cycle_finished_at"] = st.Last.FinishedAt
+	}
+
+	code := http.StatusOK
+	if !st.Alive {
+		code = http.StatusServiceUnavailable
+		body["status"] = "unavailable"
+		body["scheduler"] = "stopped"
+	}
+	writeJSON(w, code, body)
+}
+
+func status(w http.ResponseWriter, r *http.Request) {
+	st := scheduler.CurrentStatus()
+
+	type activeService struct {
+		Name      string    `json:"name"`
+		StartedAt time.Time `json:"started_at"`
+	}
+	started := backup.Active()
+	active := []activeService{}
+	for _, name := range st.Active {
+		active = append(active, activeService{Name: name, StartedAt: started[name]})
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Running   bool                `json:"running"`
+		Active    []activeService     `json:"active"`
+		NextRun   time.Time           `json:"next_run,omitzero"`
+		LastCycle *backup.CycleReport `json:"last_cycle"`
+	}{st.Running, active, st.NextRun, st.Last})
+}
+
+func respondRun(w http.ResponseWriter, err error, what string) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": "started", "run": what})
+	case errors.Is(err, scheduler.ErrBusy):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+}
+
+// authorized requires "Authorization: Bearer <token>".
+func authorized(token string, next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeJSON(w, http.StatusForbidden, map[string]string{"error": "control endpoints are disabled; set API_TOKEN"})
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		utilities.Logger.Warnf("[API] ⚠️ Failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/scheduler"
+)
+
+// blockingService runs until release is closed.
+type blockingService struct {
+	name       string
+	configured bool
+	release    chan struct{}
+}
+
+func (s *blockingService) Name() string     { return s.name }
+func (s *blockingService) Configured() bool { return s.configured }
+func (s *blockingService) Validate() error  { return nil }
+
+func (s *blockingService) Run(ctx context.Context) (backup.Result, error) {
+	<-s.release
+	return backup.Result{}, nil
+}
+
+var slow = &blockingService{name: "api-test", configured: true}
+
+func init() {
+	backup.Register(backup.StageCore, slow)
+	backup.Register(backup.StageCore, &blockingService{name: "api-test-unset"})
+}
+
+// do sends a request to h and decodes the JSON response.
+func do(t *testing.T, h http.Handler, method, path, auth string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, nil)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var body map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatalf("%s %s: decode response: %v", method, path, err)
+	}
+	if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("%s %s: 401 without a bearer challenge", method, path)
+	}
+	return rec.Code, body
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestControlAuth(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		auth    string
+		path    string
+		code    int
+		wantErr string
+	}{
+		{"disabled without a token", "", "Bearer ", "/run", http.StatusForbidden, "set API_TOKEN"},
+		{"no credentials", "secret", "", "/run", http.StatusUnauthorized, "unauthorized"},
+		{"wrong token", "secret", "Bearer guess", "/run/api-test", http.StatusUnauthorized, "unauthorized"},
+		{"token without scheme", "secret", "secret", "/run", http.StatusUnauthorized, "unauthorized"},
+		{"unknown service", "secret", "Bearer secret", "/run/nope", http.StatusNotFound, `unknown service "nope"`},
+		{"unconfigured service", "secret", "Bearer secret", "/run/api-test-unset", http.StatusNotFound, "not configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body := do(t, Handler(t.Context(), tt.token), http.MethodPost, tt.path, tt.auth)
+			if code != tt.code {
+				t.Errorf("status %d, want %d", code, tt.code)
+			}
+			if msg, _ := body["error"].(string); !strings.Contains(msg, tt.wantErr) {
+				t.Errorf("error %q, want %q", msg, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunService(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	slow.release = make(chan struct{})
+	h := Handler(t.Context(), "secret")
+
+	code, body := do(t, h, http.MethodPost, "/run/API-TEST", "Bearer secret")
+	if code != http.StatusAccepted || body["status"] != "started" || body["run"] != "API-TEST" {
+		t.Fatalf("run = %d %v, want it started", code, body)
+	}
+	waitFor(t, "the service runs", func() bool { return len(backup.Active()) == 1 })
+
+	code, body = do(t, h, http.MethodGet, "/status", "")
+	active, _ := body["active"].([]any)
+	if code != http.StatusOK || body["running"] != true || len(active) != 1 || active[0].(map[string]any)["name"] != "api-test" {
+		t.Errorf("status = %d %v, want api-test running", code, body)
+	}
+	for _, path := range []string{"/run", "/run/api-test"} {
+		if code, body := do(t, h, http.MethodPost, path, "Bearer secret"); code != http.StatusConflict {
+			t.Errorf("%s while running = %d %v, want 409", path, code, body)
+		}
+	}
+
+	close(slow.release)
+	waitFor(t, "the run ends", func() bool { return !scheduler.CurrentStatus().Running })
+	code, body = do(t, h, http.MethodGet, "/status", "")
+	if code != http.StatusOK || body["running"] != false || len(body["active"].([]any)) != 0 {
+		t.Errorf("status = %d %v, want nothing running", code, body)
+	}
+}
+
+func TestHealthz(t *testing.T) {
+	code, body := do(t, Handler(t.Context(), ""), http.MethodGet, "/healthz", "")
+	if code != http.StatusServiceUnavailable || body["status"] != "unavailable" || body["scheduler"] != "stopped" {
+		t.Errorf("healthz without a scheduler = %d %v, want 503", code, body)
+	}
+}
@@ -0,0 +1,101 @@
+package catalog
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Artifact status values.
+const (
+	StatusSuccess = "success"
+	StatusFailed  = "failed"
+	StatusSkipped = "skipped"
+)
+
+// Artifact describes a single file produced by a backup service in one cycle.
+type Artifact struct {
+	Service     string    `json:"service"`
+	Source      string    `json:"source,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256,omitempty"`
+	Compression string    `json:"compression,omitempty"`
+	Encryption  string    `json:"encryption,omitempty"`
+	StartedAt   time.Time `json:"started_at"`
+	FinishedAt  time.Time `json:"finished_at"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	// Uploads records when each destination, by target, received the
+	// artifact and the copy was verified.
+	Uploads map[string]time.Time `json:"uploads,omitempty"`
+	// UploadedAt is set once every upload destination has a verified copy.
+	UploadedAt time.Time `json:"uploaded_at,omitzero"`
+	// RemovedAt is set when local retention deleted the file.
+	RemovedAt time.Time `json:"removed_at,omitzero"`
+}
+
+// Encryption values, named after the file extension they add.
+const (
+	EncryptionAge     = "age"
+	EncryptionOpenPGP = "openpgp"
+)
+
+// Describe fills in size, checksum, compression and encryption of the file at a.Path.
+func (a *Artifact) Describe() error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+
+	a.Size = n
+	a.SHA256 = hex.EncodeToString(h.Sum(nil))
+	a.Compression = CompressionOf(a.Path)
+	a.Encryption = EncryptionOf(a.Path)
+	return nil
+}
+
+// EncryptionOf tells from its file name how an artifact is encrypted, or ""
+// when it is not.
+func EncryptionOf(path string) string {
+	switch {
+	case strings.HasSuffix(path, ".age"):
+		return EncryptionAge
+	case strings.HasSuffix(path, ".gpg"):
+		return EncryptionOpenPGP
+	default:
+		return ""
+	}
+}
+
+// PlainName is path without its encryption extension.
+func PlainName(path string) string {
+	if EncryptionOf(path) == "" {
+		return path
+	}
+	return strings.TrimSuffix(path, filepath.Ext(path))
+}
+
+// CompressionOf guesses the compression of an artifact from its file name.
+func CompressionOf(path string) string {
+	path = PlainName(path)
+	switch {
+	case strings.HasSuffix(path, ".gz"):
+		return "gzip"
+	case strings.HasSuffix(path, ".zst"):
+		return "zstd"
+	default:
+		return "none"
+	}
+}
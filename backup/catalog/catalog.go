@@ -0,0 +1,378 @@
+// Package catalog records the artifacts produced by each backup cycle.
+//
+// Every cycle gets a manifest under <CATALOG_DIR>/cycles/<cycle>.json and a
+// summary line in <CATALOG_DIR>/index.json. The catalog lives inside the
+// backup root by default, so storage runners upload it alongside the data.
+package catalog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultDir = "/home/hyper-backup/catalog"
+
+// Manifest lists every artifact recorded during one backup cycle.
+type Manifest struct {
+	Cycle      string     `json:"cycle"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt time.Time  `json:"finished_at,omitzero"`
+	Artifacts  []Artifact `json:"artifacts"`
+}
+
+// IndexEntry summarizes one cycle in the catalog index.
+type IndexEntry struct {
+	Cycle      string    `json:"cycle"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitzero"`
+	Manifest   string    `json:"manifest"`
+	Artifacts  int       `json:"artifacts"`
+	Failed     int       `json:"failed"`
+	Bytes      int64     `json:"bytes"`
+	// Settled is set once no artifact of the cycle is both successful and
+	// still on disk, so there is nothing left to upload or prune.
+	Settled bool `json:"settled,omitempty"`
+}
+
+// Index lists all cycles known to the catalog, oldest first.
+type Index struct {
+	Cycles []IndexEntry `json:"cycles"`
+}
+
+var (
+	mu      sync.Mutex
+	current *Manifest
+	// cycles maps artifact paths to the cycle that recorded them, so that
+	// recording an upload only rewrites that manifest.
+	cycles = map[string]string{}
+)
+
+// Dir returns the catalog directory (CATALOG_DIR, default /home/hyper-backup/catalog).
+func Dir() string {
+	if dir := os.Getenv("CATALOG_DIR"); dir != "" {
+		return dir
+	}
+	return defaultDir
+}
+
+// Begin starts recording a new cycle.
+func Begin(start time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = &Manifest{
+		Cycle:     start.Format("20060102_150405"),
+		StartedAt: start,
+	}
+}
+
+// Add records an artifact in the current cycle.
+func Add(a Artifact) {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		now := time.Now()
+		current = &Manifest{Cycle: now.Format("20060102_150405"), StartedAt: now}
+	}
+	current.Artifacts = append(current.Artifacts, a)
+	if a.Path != "" {
+		cycles[a.Path] = current.Cycle
+	}
+}
+
+// Failed reports whether service failed or was skipped in the current cycle.
+func Failed(service string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return false
+	}
+	for _, a := range current.Artifacts {
+		if a.Service == service && (a.Status == StatusFailed || a.Status == StatusSkipped) {
+			return true
+		}
+	}
+	return false
+}
+
+// Save writes the current manifest and refreshes its index entry.
+func Save() error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	return save(current)
+}
+
+// End marks the current cycle finished and saves it.
+func End(finish time.Time) error {
+	mu.Lock()
+	defer mu.Unlock()
+	if current == nil {
+		return nil
+	}
+	current.FinishedAt = finish
+	err := save(current)
+	current = nil
+	return err
+}
+
+// Update calls fn for every manifest in the local catalog that is not
+// settled, the current cycle included, and saves the manifests for which it
+// returns true. fn must not call other catalog functions.
+func Update(fn func(m *Manifest) bool) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return update("", fn)
+}
+
+// update is Update limited to the manifest of cycle, when set and known to
+// the index. The caller must hold mu.
+func update(cycle string, fn func(m *Manifest) bool) error {
+	if current != nil && cycle == current.Cycle {
+		if fn(current) {
+			return save(current)
+		}
+		return nil
+	}
+
+	read := LocalReader(Dir())
+	idx, err := LoadIndex(read)
+	if err != nil {
+		return err
+	}
+	entries, all := idx.Cycles, true
+	if i := slices.IndexFunc(entries, func(e IndexEntry) bool { return e.Cycle == cycle }); i >= 0 {
+		entries, all = entries[i:i+1], false
+	}
+
+	var errs []error
+	seenCurrent := false
+	for _, e := range entries {
+		var m *Manifest
+		if current != nil && e.Cycle == current.Cycle {
+			m, seenCurrent = current, true
+		} else if e.Settled {
+			continue
+		} else if m, err = LoadManifest(read, e); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, a := range m.Artifacts {
+			if a.Path != "" {
+				cycles[a.Path] = m.Cycle
+			}
+		}
+		if fn(m) {
+			errs = append(errs, save(m))
+		}
+	}
+	if current != nil && all && !seenCurrent && fn(current) {
+		errs = append(errs, save(current))
+	}
+	return errors.Join(errs...)
+}
+
+// Pending lists the successful artifacts that still exist locally and have
+// neither a verified copy on target nor been marked uploaded, oldest first.
+// Artifacts whose path is in retry are listed even when marked uploaded, since
+// a best-effort destination can miss what the others received.
+func Pending(target string, retry map[string]bool) ([]Artifact, error) {
+	var pending []Artifact
+	err := Update(func(m *Manifest) bool {
+		for _, a := range m.Artifacts {
+			if a.Status != StatusSuccess || a.Path == "" || !a.RemovedAt.IsZero() || (!a.UploadedAt.IsZero() && !retry[a.Path]) {
+				continue
+			}
+			if _, ok := a.Uploads[target]; ok {
+				continue
+			}
+			if _, err := os.Stat(a.Path); err != nil {
+				continue
+			}
+			pending = append(pending, a)
+		}
+		return false
+	})
+	return pending, err
+}
+
+// RecordUpload notes that the copy of the artifact at path on target was
+// verified at at.
+func RecordUpload(path, target string, at time.Time) error {
+	mu.Lock()
+	defer mu.Unlock()
+	return update(cycles[path], func(m *Manifest) bool {
+		changed := false
+		for i := range m.Artifacts {
+			a := &m.Artifacts[i]
+			if a.Path != path || a.Status != StatusSuccess {
+				continue
+			}
+			if a.Uploads == nil {
+				a.Uploads = map[string]time.Time{}
+			}
+			a.Uploads[target] = at
+			changed = true
+		}
+		return changed
+	})
+}
+
+// MarkUploaded records at as the upload time of every successful artifact
+// that finished before t, has a verified copy on each of targets and has not
+// been marked yet.
+func MarkUploaded(targets []string, t, at time.Time) error {
+	return Update(func(m *Manifest) bool {
+		changed := false
+		for i := range m.Artifacts {
+			a := &m.Artifacts[i]
+			if a.Status != StatusSuccess || a.Path == "" || !a.UploadedAt.IsZero() || !a.FinishedAt.Before(t) {
+				continue
+			}
+			if slices.ContainsFunc(targets, func(target string) bool { return a.Uploads[target].IsZero() }) {
+				continue
+			}
+			a.UploadedAt = at
+			changed = true
+		}
+		return changed
+	})
+}
+
+func save(m *Manifest) error {
+	dir := Dir()
+	rel := filepath.Join("cycles", m.Cycle+".json")
+	if err := writeJSON(filepath.Join(dir, rel), m); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+
+	idx, err := LoadIndex(LocalReader(dir))
+	if err != nil {
+		return err
+	}
+	idx.upsert(summarize(m, rel))
+	if err := writeJSON(filepath.Join(dir, "index.json"), idx); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return nil
+}
+
+func summarize(m *Manifest, rel string) IndexEntry {
+	e := IndexEntry{
+		Cycle:      m.Cycle,
+		StartedAt:  m.StartedAt,
+		FinishedAt: m.FinishedAt,
+		Manifest:   filepath.ToSlash(rel),
+		Artifacts:  len(m.Artifacts),
+		Settled:    true,
+	}
+	for _, a := range m.Artifacts {
+		if a.Status == StatusFailed {
+			e.Failed++
+		}
+		if a.Status == StatusSuccess && a.Path != "" && a.RemovedAt.IsZero() {
+			e.Settled = false
+		}
+		e.Bytes += a.Size
+	}
+	return e
+}
+
+func (idx *Index) upsert(e IndexEntry) {
+	for i := range idx.Cycles {
+		if idx.Cycles[i].Cycle == e.Cycle {
+			idx.Cycles[i] = e
+			return
+		}
+	}
+	idx.Cycles = append(idx.Cycles, e)
+	sort.Slice(idx.Cycles, func(i, j int) bool {
+		return idx.Cycles[i].Cycle < idx.Cycles[j].Cycle
+	})
+}
+
+// ReadFunc fetches a catalog file by its slash-separated path relative to
+// the catalog directory, e.g. "index.json" or "cycles/<cycle>.json".
+type ReadFunc func(rel string) ([]byte, error)
+
+// LocalReader reads catalog files below dir.
+func LocalReader(dir string) ReadFunc {
+	return func(rel string) ([]byte, error) {
+		return os.ReadFile(filepath.Join(dir, filepath.FromSlash(rel)))
+	}
+}
+
+// LoadIndex reads index.json. A missing index yields an empty one.
+func LoadIndex(read ReadFunc) (*Index, error) {
+	idx := &Index{}
+	data, err := read("index.json")
+	if errors.Is(err, fs.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read index: %w", err)
+	}
+	if err := json.Unmarshal(data, idx); err != nil {
+		return nil, fmt.Errorf("parse index: %w", err)
+	}
+	return idx, nil
+}
+
+// LoadManifest reads a manifest referenced by an index entry.
+func LoadManifest(read ReadFunc, e IndexEntry) (*Manifest, error) {
+	data, err := read(e.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest %s: %w", e.Cycle, err)
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("parse manifest %s: %w", e.Cycle, err)
+	}
+	return m, nil
+}
+
+// LoadManifests reads every manifest listed in the index, oldest first.
+// Unreadable manifests are skipped and reported in the returned error.
+func LoadManifests(read ReadFunc) ([]*Manifest, error) {
+	idx, err := LoadIndex(read)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifests []*Manifest
+	var errs []error
+	for _, e := range idx.Cycles {
+		m, err := LoadManifest(read, e)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		manifests = append(manifests, m)
+	}
+	return manifests, errors.Join(errs...)
+}
+
+// writeJSON replaces path atomically so readers never see half-written files.
+func writeJSON(path string, v any) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,238 @@
+package catalog
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRecordCycles(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CATALOG_DIR", dir)
+	first := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	second := first.Add(24 * time.Hour)
+
+	// The later cycle is recorded first, the index still lists it last
+	Begin(second)
+	Add(Artifact{Service: "MySQL", Path: "/backups/a.sql.zst", Size: 100, Status: StatusSuccess})
+	if err := End(second.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	Begin(first)
+	Add(Artifact{Service: "MySQL", Path: "/backups/b.sql.zst", Size: 40, Status: StatusSuccess})
+	Add(Artifact{Service: "MongoDB", Status: StatusFailed, Error: "mongodump exited with status 1"})
+	if err := Save(); err != nil {
+		t.Fatal(err)
+	}
+	Add(Artifact{Service: "Files", Path: "/backups/c.tar.gz", Size: 2, Status: StatusSuccess})
+	if err := End(first.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := End(time.Now()); err != nil {
+		t.Errorf("End without a cycle: %v", err)
+	}
+
+	idx, err := LoadIndex(LocalReader(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []IndexEntry{
+		{Cycle: "20260102_030000", StartedAt: first, FinishedAt: first.Add(time.Hour), Manifest: "cycles/20260102_030000.json", Artifacts: 3, Failed: 1, Bytes: 42},
+		{Cycle: "20260103_030000", StartedAt: second, FinishedAt: second.Add(time.Minute), Manifest: "cycles/20260103_030000.json", Artifacts: 1, Bytes: 100},
+	}
+	if len(idx.Cycles) != len(want) {
+		t.Fatalf("index has %d cycles, want %d", len(idx.Cycles), len(want))
+	}
+	for i, e := range idx.Cycles {
+		if !e.StartedAt.Equal(want[i].StartedAt) || !e.FinishedAt.Equal(want[i].FinishedAt) {
+			t.Errorf("cycle %s runs %v to %v, want %v to %v", e.Cycle, e.StartedAt, e.FinishedAt, want[i].StartedAt, want[i].FinishedAt)
+		}
+		e.StartedAt, e.FinishedAt = want[i].StartedAt, want[i].FinishedAt
+		if e != want[i] {
+			t.Errorf("index entry %d = %+v, want %+v", i, e, want[i])
+		}
+	}
+
+	m, err := LoadManifest(LocalReader(dir), idx.Cycles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var services []string
+	for _, a := range m.Artifacts {
+		services = append(services, a.Service)
+	}
+	if len(services) != 3 || services[0] != "MySQL" || services[1] != "MongoDB" || services[2] != "Files" {
+		t.Errorf("manifest lists %v, want MySQL, MongoDB and Files", services)
+	}
+	if m.Artifacts[1].Error != "mongodump exited with status 1" {
+		t.Errorf("failed artifact error = %q", m.Artifacts[1].Error)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "index.json.tmp")); !os.IsNotExist(err) {
+		t.Errorf("temporary index left behind: %v", err)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "cycles", "20260102_030000.json")); err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := LoadManifests(LocalReader(dir))
+	if err == nil || len(manifests) != 1 || manifests[0].Cycle != "20260103_030000" {
+		t.Errorf("LoadManifests = %d manifests, %v, want the readable one and an error", len(manifests), err)
+	}
+}
+
+func TestLoadIndexMissing(t *testing.T) {
+	idx, err := LoadIndex(LocalReader(t.TempDir()))
+	if err != nil || len(idx.Cycles) != 0 {
+		t.Fatalf("LoadIndex = %v, %v, want an empty index", idx, err)
+	}
+}
+
+func TestDescribe(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		sha256      string
+		compression string
+	}{
+		{"db.sql.gz", "", "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", "gzip"},
+		{"db.archive.zst", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", "zstd"},
+		{"acme.json", "abc", "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad", "none"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Artifact{Path: filepath.Join(dir, tt.name)}
+			if err := os.WriteFile(a.Path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Describe(); err != nil {
+				t.Fatal(err)
+			}
+			if a.Size != int64(len(tt.data)) || a.SHA256 != tt.sha256 || a.Compression != tt.compression {
+				t.Errorf("Describe = %d bytes, %s, %s, want %d bytes, %s, %s", a.Size, a.SHA256, a.Compression, len(tt.data), tt.sha256, tt.compression)
+			}
+		})
+	}
+
+	missing := Artifact{Path: filepath.Join(dir, "missing.sql")}
+	if err := missing.Describe(); err == nil {
+		t.Error("Describe of a missing file succeeded")
+	}
+}
+
+func TestUploads(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CATALOG_DIR", dir)
+	local := func(name string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	cycle := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	done := cycle.Add(time.Minute)
+
+	Begin(cycle)
+	for _, a := range []Artifact{
+		{Service: "MySQL", Path: local("a.sql.zst"), FinishedAt: done, Status: StatusSuccess},
+		{Service: "MySQL", Path: local("b.sql.zst"), FinishedAt: done, Status: StatusSuccess},
+		{Service: "MongoDB", Path: local("c.archive.gz"), FinishedAt: done, Status: StatusFailed},
+		{Service: "Files", Path: filepath.Join(dir, "gone.tar.gz"), FinishedAt: done, Status: StatusSuccess},
+		{Service: "Files", Path: local("d.tar.gz"), FinishedAt: done, Status: StatusSuccess, RemovedAt: done},
+	} {
+		Add(a)
+	}
+	if err := End(done); err != nil {
+		t.Fatal(err)
+	}
+	// The current cycle is seen before it is saved
+	Begin(cycle.Add(time.Hour))
+	defer End(time.Now())
+	Add(Artifact{Service: "MySQL", Path: local("e.sql.zst"), FinishedAt: cycle.Add(time.Hour), Status: StatusSuccess})
+
+	names := func(artifacts []Artifact) []string {
+		var list []string
+		for _, a := range artifacts {
+			list = append(list, filepath.Base(a.Path))
+		}
+		return list
+	}
+	steps := []struct {
+		name   string
+		step   func() error
+		target string
+		retry  map[string]bool
+		want   []string
+	}{
+		{name: "nothing uploaded", target: "s3://bucket", want: []string{"a.sql.zst", "b.sql.zst", "e.sql.zst"}},
+		{
+			name:   "a verified copy",
+			step:   func() error { return RecordUpload(filepath.Join(dir, "a.sql.zst"), "s3://bucket", done) },
+			target: "s3://bucket",
+			want:   []string{"b.sql.zst", "e.sql.zst"},
+		},
+		{name: "other targets", target: "remote:backups", want: []string{"a.sql.zst", "b.sql.zst", "e.sql.zst"}},
+		{
+			name: "marked without a copy on every target",
+			step: func() error {
+				return MarkUploaded([]string{"s3://bucket", "remote:backups"}, cycle.Add(2*time.Hour), done)
+			},
+			target: "remote:backups",
+			want:   []string{"a.sql.zst", "b.sql.zst", "e.sql.zst"},
+		},
+		{
+			name: "marked with a copy on every target",
+			step: func() error {
+				if err := RecordUpload(filepath.Join(dir, "a.sql.zst"), "remote:backups", done); err != nil {
+					return err
+				}
+				return MarkUploaded([]string{"s3://bucket", "remote:backups"}, cycle.Add(2*time.Hour), done)
+			},
+			target: "sftp://host/backups",
+			want:   []string{"b.sql.zst", "e.sql.zst"},
+		},
+		{
+			name:   "marked before the artifact finished",
+			step:   func() error { return MarkUploaded(nil, cycle, done) },
+			target: "sftp://host/backups",
+			want:   []string{"b.sql.zst", "e.sql.zst"},
+		},
+		{
+			name:   "marked after every artifact finished",
+			step:   func() error { return MarkUploaded(nil, cycle.Add(2*time.Hour), done) },
+			target: "sftp://host/backups",
+			want:   nil,
+		},
+		{
+			name:   "retried although marked",
+			target: "sftp://host/backups",
+			retry:  map[string]bool{filepath.Join(dir, "a.sql.zst"): true},
+			want:   []string{"a.sql.zst"},
+		},
+	}
+	for _, s := range steps {
+		if s.step != nil {
+			if err := s.step(); err != nil {
+				t.Fatalf("%s: %v", s.name, err)
+			}
+		}
+		pending, err := Pending(s.target, s.retry)
+		if err != nil {
+			t.Fatalf("%s: %v", s.name, err)
+		}
+		if got := names(pending); !slices.Equal(got, s.want) {
+			t.Errorf("%s: Pending(%s) = %v, want %v", s.name, s.target, got, s.want)
+		}
+	}
+
+	m, err := LoadManifest(LocalReader(dir), IndexEntry{Manifest: "cycles/20260102_030000.json"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a := m.Artifacts[0]; !a.Uploads["s3://bucket"].Equal(done) || !a.UploadedAt.Equal(done) {
+		t.Errorf("saved artifact = %+v, want its uploads recorded", a)
+	}
+}
@@ -0,0 +1,133 @@
+package catalog
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Verify checks a local artifact against its recorded size and checksum and
+// reads it end to end: compressed streams are fully decompressed and tar
+// archives are walked entry by entry, so truncation is detected. Encrypted
+// artifacts are checked by size and checksum only.
+func Verify(a Artifact) error {
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return VerifyReader(a, f)
+}
+
+// VerifyReader is Verify for an artifact streamed from elsewhere, e.g. a remote.
+func VerifyReader(a Artifact, r io.Reader) error {
+	h := sha256.New()
+	counter := &countingReader{r: r}
+	tee := io.TeeReader(counter, h)
+
+	if err := checkContent(a.Path, tee); err != nil {
+		return err
+	}
+	// decompressors may stop before trailing bytes; hash the rest too
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+
+	if a.Size > 0 && counter.n != a.Size {
+		return fmt.Errorf("size mismatch: recorded %d bytes, found %d", a.Size, counter.n)
+	}
+	if a.SHA256 != "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != a.SHA256 {
+			return fmt.Errorf("checksum mismatch: recorded %s, found %s", a.SHA256, sum)
+		}
+	}
+	return nil
+}
+
+func checkContent(name string, r io.Reader) error {
+	if EncryptionOf(name) != "" {
+		// the checksum covers the ciphertext; no key is needed
+		return nil
+	}
+
+	var stream io.Reader
+	switch CompressionOf(name) {
+	case "gzip":
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("gzip: %w", err)
+		}
+		defer gr.Close()
+		stream = gr
+	case "zstd":
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return fmt.Errorf("zstd: %w", err)
+		}
+		defer zr.Close()
+		stream = zr
+	default:
+		stream = r
+	}
+
+	if isTar(name) {
+		return walkTar(stream)
+	}
+	if _, err := io.Copy(io.Discard, stream); err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+	return nil
+}
+
+func isTar(name string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.zst"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+func walkTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	entries := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("tar entry %s: %w", hdr.Name, err)
+		}
+		entries++
+	}
+	if entries == 0 {
+		return fmt.Errorf("tar: archive is empty")
+	}
+	// consume the end-of-archive padding so a compressed trailer is checked too
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("decompress: %w", err)
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
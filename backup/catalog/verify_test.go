@@ -0,0 +1,105 @@
+package catalog
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func zstded(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// tarred returns a tar archive of the named files, each holding its name.
+func tarred(t *testing.T, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range names {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(name))})
+		tw.Write([]byte(name))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	dump := bytes.Repeat([]byte("INSERT INTO t VALUES (1);\n"), 1000)
+	gz := gzipped(t, dump)
+	tgz := gzipped(t, tarred(t, "a.txt", "b.txt"))
+
+	tests := []struct {
+		name    string
+		data    []byte
+		mutate  func(a *Artifact)
+		wantErr string
+	}{
+		{name: "db.sql.gz", data: gz},
+		{name: "db.archive.zst", data: zstded(t, dump)},
+		{name: "files.tar.gz", data: tgz},
+		{name: "files.tar.zst", data: zstded(t, tarred(t, "a.txt"))},
+		{name: "acme.json", data: []byte(`{"acme":{}}`)},
+		{name: "truncated.sql.gz", data: gz[:len(gz)/2], wantErr: "decompress"},
+		{name: "truncated.tar.gz", data: tgz[:len(tgz)-20], wantErr: "unexpected EOF"},
+		{name: "empty.tar.gz", data: gzipped(t, tarred(t)), wantErr: "archive is empty"},
+		{name: "plain.sql.gz", data: dump, wantErr: "gzip"},
+		{name: "size.sql.gz", data: gz, mutate: func(a *Artifact) { a.Size++ }, wantErr: "size mismatch"},
+		{name: "sum.sql.gz", data: gz, mutate: func(a *Artifact) { a.SHA256 = strings.Repeat("0", 64) }, wantErr: "checksum mismatch"},
+		{name: "unrecorded.sql.gz", data: gz, mutate: func(a *Artifact) { a.Size, a.SHA256 = 0, "" }},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := Artifact{Path: filepath.Join(dir, tt.name)}
+			if err := os.WriteFile(a.Path, tt.data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Describe(); err != nil {
+				t.Fatal(err)
+			}
+			if tt.mutate != nil {
+				tt.mutate(&a)
+			}
+
+			err := Verify(a)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Verify error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,33 @@
+package backup
+
+import (
+	"slices"
+
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+const backupRoot = "/home/hyper-backup"
+
+// CleanPartials removes partial artifacts left behind by a run that was killed
+// before it could finish. It covers the backup root and the custom backup
+// directory of every registered service, config file instances included.
+func CleanPartials() {
+	dirs := []string{backupRoot}
+	for _, stage := range []Stage{StageCore, StageFiles} {
+		for _, svc := range Services(stage) {
+			s, ok := svc.(*envService)
+			if !ok || s.dirKey == "" {
+				continue
+			}
+			if dir := s.env.Getenv(s.dirKey); dir != "" && !utilities.IsWithin(dir, backupRoot) && !slices.Contains(dirs, dir) {
+				dirs = append(dirs, dir)
+			}
+		}
+	}
+
+	for _, dir := range dirs {
+		if _, err := utilities.CleanPartials(dir); err != nil {
+			utilities.Logger.Warnf("[HyperBackup] ⚠️ Failed to clean partial files in %s: %v", dir, err)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fvoci/hyper-backup/config"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+func TestCleanPartials(t *testing.T) {
+	saved := Services(StageCore)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		registry[StageCore] = saved
+	})
+
+	envDir, filesDir, instanceDir := t.TempDir(), t.TempDir(), t.TempDir()
+	t.Setenv("MYSQL_BACKUP_DIR", envDir)
+	t.Setenv("FILE_BACKUP_DIR", filesDir)
+	err := RegisterInstances([]config.Instance{{
+		Kind: "mysql",
+		Name: "cleanup-test",
+		Env:  utilities.NewEnv(map[string]string{"MYSQL_BACKUP_DIR": instanceDir}),
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var partials, kept []string
+	for _, dir := range []string{envDir, filesDir, instanceDir} {
+		partial := filepath.Join(dir, "db.sql.gz"+utilities.PartialSuffix)
+		done := filepath.Join(dir, "db.sql.gz")
+		for _, path := range []string{partial, done} {
+			if err := os.WriteFile(path, []byte("rows"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		partials, kept = append(partials, partial), append(kept, done)
+	}
+
+	CleanPartials()
+	for _, path := range partials {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s removed: %v", path, err)
+		}
+	}
+}
@@ -4,16 +4,22 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
 	"github.com/fvoci/hyper-backup/utilities"
+	"gopkg.in/yaml.v3"
 )
 
 type mongoConfig struct {
@@ -24,12 +30,12 @@ type mongoConfig struct {
 	BackupDir string
 }
 
-func loadMongoConfig() (*mongoConfig, error) {
-	uri := os.Getenv("MONGO_URI")
-	host := os.Getenv("MONGO_HOST")
-	port := os.Getenv("MONGO_PORT")
-	database := os.Getenv("MONGO_DB")
-	backupDir := os.Getenv("MONGO_BACKUP_DIR")
+func loadMongoConfig(env utilities.Env) (*mongoConfig, error) {
+	uri := env.Getenv("MONGO_URI")
+	host := env.Getenv("MONGO_HOST")
+	port := env.Getenv("MONGO_PORT")
+	database := env.Getenv("MONGO_DB")
+	backupDir := env.Getenv("MONGO_BACKUP_DIR")
 	if backupDir == "" {
 		backupDir = "/home/hyper-backup/mongo"
 	}
@@ -56,37 +62,70 @@ func loadMongoConfig() (*mongoConfig, error) {
 	}, nil
 }
 
-func RunMongo() error {
-	cfg, err := loadMongoConfig()
+// ValidateMongo reports whether the MongoDB settings are complete, mongodump
+// is installed and the backup directory is writable.
+func ValidateMongo(env utilities.Env) error {
+	cfg, err := loadMongoConfig(env)
 	if err != nil {
-		utilities.Logger.Errorf("[MongoDB] ❌ Configuration error: %v", err)
 		return err
 	}
+	return errors.Join(
+		utilities.RequireBinaries("mongodump"),
+		utilities.CheckWritable(cfg.BackupDir),
+	)
+}
+
+// RunMongo dumps the databases configured by the MONGO_* settings in env.
+// mongodump streams an archive that is compressed (and encrypted, when
+// configured) on its way to disk, so no plaintext dump is staged there.
+func RunMongo(ctx context.Context, env utilities.Env) ([]catalog.Artifact, error) {
+	cfg, err := loadMongoConfig(env)
+	if err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Configuration error: %v", err)
+		return nil, err
+	}
 
 	timestamp := time.Now().Format("20060102_150405")
-	dumpDir := filepath.Join(cfg.BackupDir, fmt.Sprintf("dump_%s", timestamp))
 	name := cfg.Database
 	if name == "" {
 		name = "all"
 	}
-	archive := fmt.Sprintf("%s_%s.tar.gz", name, timestamp)
+	archive := fmt.Sprintf("%s_%s.archive.gz", name, timestamp)
 	archivePath := filepath.Join(cfg.BackupDir, archive)
 
 	if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
 		utilities.Logger.Errorf("[MongoDB] ❌ Failed to create backup directory: %v", err)
-		return err
+		return nil, err
 	}
 
+	artifacts := []catalog.Artifact{{Source: name, Path: archivePath}}
+
 	utilities.Logger.Infof("[MongoDB] 🍃 Backing up database '%s' to: %s", name, archivePath)
 
+	connArgs, cleanup, err := mongoConnArgs(cfg)
+	if err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Failed to write config file: %v", err)
+		return artifacts, err
+	}
+	defer cleanup()
+
+	outFile, err := encrypt.Create(archivePath)
+	if err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Failed to create output file: %v", err)
+		return artifacts, err
+	}
+	defer outFile.Abort()
+	artifacts[0].Path = outFile.Path
+
+	gw := gzip.NewWriter(outFile)
 	var out bytes.Buffer
-	dumpCmd := exec.Command("mongodump", buildMongodumpArgs(cfg, dumpDir)...)
-	dumpCmd.Stdout = &out
+	dumpCmd := utilities.Command(ctx, "mongodump", buildMongodumpArgs(cfg, connArgs)...)
+	dumpCmd.Stdout = gw
 	dumpCmd.Stderr = &out
 
 	if err := dumpCmd.Run(); err != nil {
-		utilities.Logger.Errorf("[MongoDB] ❌ mongodump failed: %v", err)
-		return err
+		utilities.Logger.Errorf("[MongoDB] ❌ mongodump failed: %v\nOutput:\n%s", err, out.String())
+		return artifacts, err
 	}
 
 	for _, line := range strings.Split(out.String(), "\n") {
@@ -99,70 +138,244 @@ func RunMongo() error {
 		}
 	}
 
-	if err := createTarGz(archivePath, dumpDir); err != nil {
+	if err := gw.Close(); err != nil {
 		utilities.Logger.Errorf("[MongoDB] ❌ Compression failed: %v", err)
-		return err
+		return artifacts, err
 	}
-
-	if err := os.RemoveAll(dumpDir); err != nil {
-		utilities.Logger.Warnf("[MongoDB] ⚠️ Failed to remove dump directory: %v", err)
+	if err := outFile.Commit(); err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Failed to finalize output file: %v", err)
+		return artifacts, err
 	}
 
 	utilities.Logger.Infof("[MongoDB] ✅ Backup of '%s' completed successfully", name)
 	utilities.LogDivider()
-	return nil
+	return artifacts, nil
 }
 
-func buildMongodumpArgs(cfg *mongoConfig, dumpDir string) []string {
-	if cfg.URI != "" {
-		return []string{"--uri=" + cfg.URI, "--out=" + dumpDir}
+// mongoConnArgs returns the connection flags for the mongo tools. A URI may
+// carry a password, so it goes through a private --config file instead of
+// the command line; cleanup removes that file.
+func mongoConnArgs(cfg *mongoConfig) (args []string, cleanup func(), err error) {
+	if cfg.URI == "" {
+		return []string{"--host=" + cfg.Host, "--port=" + cfg.Port}, func() {}, nil
+	}
+
+	data, err := yaml.Marshal(map[string]string{"uri": cfg.URI})
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := os.CreateTemp("", "hyper-backup-mongo-*.yaml")
+	if err != nil {
+		return nil, nil, err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
 	}
-	args := []string{"--host=" + cfg.Host, "--port=" + cfg.Port, "--out=" + dumpDir}
-	if cfg.Database != "" {
+	return []string{"--config=" + f.Name()}, func() { os.Remove(f.Name()) }, nil
+}
+
+func buildMongodumpArgs(cfg *mongoConfig, connArgs []string) []string {
+	args := append(slices.Clone(connArgs), "--archive")
+	if cfg.URI == "" && cfg.Database != "" {
 		args = append(args, "--db="+cfg.Database)
 	}
 	return args
 }
 
-func createTarGz(target, sourceDir string) error {
-	file, err := os.Create(target)
+// RestoreMongo feeds an archive created by RunMongo to mongorestore. Archives
+// of older versions, tarballs of a mongodump directory, are unpacked first.
+func RestoreMongo(ctx context.Context, archive string, opts RestoreOptions) error {
+	cfg, err := loadMongoConfig(opts.Env)
 	if err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Configuration error: %v", err)
 		return err
 	}
-	defer file.Close()
-
-	gw := gzip.NewWriter(file)
-	defer gw.Close()
 
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+	connArgs, cleanup, err := mongoConnArgs(cfg)
+	if err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ Failed to write config file: %v", err)
+		return err
+	}
+	defer cleanup()
 
-	return filepath.Walk(sourceDir, func(path string, info os.FileInfo, err error) error {
+	var cmd *exec.Cmd
+	if strings.HasSuffix(catalog.PlainName(archive), ".tar.gz") {
+		var removeDir func()
+		cmd, removeDir, err = mongorestoreDir(ctx, cfg, connArgs, archive, opts)
 		if err != nil {
+			utilities.Logger.Errorf("[MongoDB] ❌ %v", err)
 			return err
 		}
-		header, err := tar.FileInfoHeader(info, "")
+		defer removeDir()
+	} else {
+		dump, err := openDump(archive)
 		if err != nil {
+			utilities.Logger.Errorf("[MongoDB] ❌ Failed to open archive: %v", err)
 			return err
 		}
-		relPath, err := filepath.Rel(filepath.Dir(sourceDir), path)
-		if err != nil {
+		defer dump.Close()
+
+		source := cfg.Database
+		if opts.TargetDB != "" && source == "" {
+			err := fmt.Errorf("set MONGO_DB to the database in the archive to restore it into %s", opts.TargetDB)
+			utilities.Logger.Errorf("[MongoDB] ❌ %v", err)
 			return err
 		}
-		header.Name = relPath
-		if err := tw.WriteHeader(header); err != nil {
+		args := append(buildMongorestoreArgs(connArgs, source, opts), "--archive")
+		cmd = utilities.Command(ctx, "mongorestore", args...)
+		cmd.Stdin = dump
+	}
+
+	utilities.Logger.Infof("[MongoDB] 🍃 Restoring %s", archive)
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		utilities.Logger.Errorf("[MongoDB] ❌ mongorestore failed: %v\nOutput:\n%s", err, out)
+		return err
+	}
+
+	utilities.Logger.Info("[MongoDB] ✅ Restore completed successfully")
+	utilities.LogDivider()
+	return nil
+}
+
+// mongorestoreDir unpacks a tarball of a mongodump directory and prepares
+// mongorestore for it; cleanup removes the unpacked files.
+func mongorestoreDir(ctx context.Context, cfg *mongoConfig, connArgs []string, archive string, opts RestoreOptions) (*exec.Cmd, func(), error) {
+	if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
+		return nil, nil, fmt.Errorf("failed to create backup directory: %w", err)
+	}
+	workDir, err := os.MkdirTemp(cfg.BackupDir, "restore_")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create work directory: %w", err)
+	}
+	cleanup := func() { os.RemoveAll(workDir) }
+
+	if err := extractTarGz(archive, workDir); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("extraction failed: %w", err)
+	}
+	dumpDir, err := findDumpRoot(workDir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	source := cfg.Database
+	if opts.TargetDB != "" && source == "" {
+		dbs, err := listDumpDatabases(dumpDir)
+		if err != nil {
+			cleanup()
+			return nil, nil, err
+		}
+		if len(dbs) != 1 {
+			cleanup()
+			return nil, nil, fmt.Errorf("archive contains %d databases; set MONGO_DB to choose which one to restore into %s", len(dbs), opts.TargetDB)
+		}
+		source = dbs[0]
+	}
+	args := append(buildMongorestoreArgs(connArgs, source, opts), "--dir="+dumpDir)
+	return utilities.Command(ctx, "mongorestore", args...), cleanup, nil
+}
+
+// buildMongorestoreArgs returns the mongorestore flags without the input;
+// source is the dumped database to rename when restoring into opts.TargetDB.
+func buildMongorestoreArgs(connArgs []string, source string, opts RestoreOptions) []string {
+	args := slices.Clone(connArgs)
+	if opts.Drop {
+		args = append(args, "--drop")
+	}
+	if opts.TargetDB != "" {
+		args = append(args,
+			"--nsInclude="+source+".*",
+			"--nsFrom="+source+".*",
+			"--nsTo="+opts.TargetDB+".*",
+		)
+	}
+	return args
+}
+
+// findDumpRoot returns the dump_<timestamp> directory of an older archive.
+func findDumpRoot(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), "dump_") {
+			return filepath.Join(dir, e.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("no dump directory found in archive")
+}
+
+func listDumpDatabases(dumpDir string) ([]string, error) {
+	entries, err := os.ReadDir(dumpDir)
+	if err != nil {
+		return nil, err
+	}
+	var dbs []string
+	for _, e := range entries {
+		if e.IsDir() && e.Name() != "admin" {
+			dbs = append(dbs, e.Name())
+		}
+	}
+	return dbs, nil
+}
+
+// extractTarGz unpacks archive into destDir, rejecting entries that escape it.
+func extractTarGz(archive, destDir string) error {
+	file, err := encrypt.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
 			return err
 		}
-		if info.Mode().IsRegular() {
-			f, err := os.Open(path)
+
+		target := filepath.Join(destDir, header.Name)
+		if !strings.HasPrefix(target, filepath.Clean(destDir)+string(os.PathSeparator)) {
+			return fmt.Errorf("illegal path in archive: %s", header.Name)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 			if err != nil {
 				return err
 			}
-			defer f.Close()
-			if _, err := io.Copy(tw, f); err != nil {
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			if err := out.Close(); err != nil {
 				return err
 			}
 		}
-		return nil
-	})
+	}
 }
@@ -1,15 +1,18 @@
 package backup
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"strings"
 	"time"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
@@ -22,17 +25,17 @@ type mysqlConfig struct {
 	BackupDir string
 }
 
-func loadMySQLConfig() (*mysqlConfig, error) {
-	dsn := os.Getenv("MYSQL_DSN")
-	host := os.Getenv("MYSQL_HOST")
-	port := os.Getenv("MYSQL_PORT")
+func loadMySQLConfig(env utilities.Env) (*mysqlConfig, error) {
+	dsn := env.Getenv("MYSQL_DSN")
+	host := env.Getenv("MYSQL_HOST")
+	port := env.Getenv("MYSQL_PORT")
 	if port == "" {
 		port = "3306"
 	}
-	user := os.Getenv("MYSQL_USER")
-	pass := os.Getenv("MYSQL_PASSWORD")
-	db := os.Getenv("MYSQL_DATABASE")
-	backupDir := os.Getenv("MYSQL_BACKUP_DIR")
+	user := env.Getenv("MYSQL_USER")
+	pass := env.Getenv("MYSQL_PASSWORD")
+	db := env.Getenv("MYSQL_DATABASE")
+	backupDir := env.Getenv("MYSQL_BACKUP_DIR")
 	if backupDir == "" {
 		backupDir = "/home/hyper-backup/mysql"
 	}
@@ -74,68 +77,162 @@ func loadMySQLConfig() (*mysqlConfig, error) {
 	}, nil
 }
 
-func RunMySQL() error {
-	cfg, err := loadMySQLConfig()
+// ValidateMySQL reports whether the MySQL settings are complete, the dump
+// tools are installed and the backup directory is writable.
+func ValidateMySQL(env utilities.Env) error {
+	cfg, err := loadMySQLConfig(env)
 	if err != nil {
-		utilities.Logger.Errorf("[MySQL] ❌ Configuration error: %v", err)
 		return err
 	}
+	return errors.Join(
+		utilities.RequireBinaries("mysqldump", "gzip"),
+		utilities.CheckWritable(cfg.BackupDir),
+	)
+}
+
+// RunMySQL dumps the database configured by the MYSQL_* settings in env.
+func RunMySQL(ctx context.Context, env utilities.Env) ([]catalog.Artifact, error) {
+	cfg, err := loadMySQLConfig(env)
+	if err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Configuration error: %v", err)
+		return nil, err
+	}
 
 	if err := os.MkdirAll(cfg.BackupDir, 0755); err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ Failed to create backup directory: %v", err)
-		return err
+		return nil, err
 	}
 
 	timestamp := time.Now().Format("20060102_150405")
 	filename := fmt.Sprintf("%s_%s.sql.gz", cfg.Database, timestamp)
 	outputFile := filepath.Join(cfg.BackupDir, filename)
 
+	artifacts := []catalog.Artifact{{Source: cfg.Database, Path: outputFile}}
+
 	utilities.Logger.Infof("[MySQL] 🐬 Backing up %s to %s", cfg.Database, outputFile)
 
-	dumpArgs := []string{
-		"-h", cfg.Host,
-		"-P", cfg.Port,
-		"-u", cfg.User,
-		fmt.Sprintf("-p%s", cfg.Password),
-		cfg.Database,
+	optionFile, err := writeMySQLOptions(cfg)
+	if err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Failed to write option file: %v", err)
+		return artifacts, err
 	}
-	dumpCmd := exec.Command("mysqldump", dumpArgs...)
+	defer os.Remove(optionFile)
+
+	dumpCmd := utilities.Command(ctx, "mysqldump", cfg.args(optionFile, cfg.Database)...)
 
-	gzipCmd := exec.Command("gzip")
+	gzipCmd := utilities.Command(ctx, "gzip")
 	dumpOut, err := dumpCmd.StdoutPipe()
 	if err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ Failed to get dump stdout: %v", err)
-		return err
+		return artifacts, err
 	}
 	gzipCmd.Stdin = dumpOut
 
-	outFile, err := os.Create(outputFile)
+	outFile, err := encrypt.Create(outputFile)
 	if err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ Failed to create output file: %v", err)
-		return err
+		return artifacts, err
 	}
-	defer outFile.Close()
+	defer outFile.Abort()
+	artifacts[0].Path = outFile.Path
 	gzipCmd.Stdout = outFile
 
 	if err := dumpCmd.Start(); err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ mysqldump start error: %v", err)
-		return err
+		return artifacts, err
 	}
 	if err := gzipCmd.Start(); err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ gzip start error: %v", err)
-		return err
+		return artifacts, err
 	}
 
 	if err := dumpCmd.Wait(); err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ mysqldump execution error: %v", err)
-		return err
+		return artifacts, err
 	}
 	if err := gzipCmd.Wait(); err != nil {
 		utilities.Logger.Errorf("[MySQL] ❌ gzip execution error: %v", err)
-		return err
+		return artifacts, err
+	}
+	if err := outFile.Commit(); err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Failed to finalize output file: %v", err)
+		return artifacts, err
 	}
 
 	utilities.Logger.Info("[MySQL] ✅ Backup completed successfully")
 	utilities.LogDivider()
+	return artifacts, nil
+}
+
+// RestoreMySQL streams a (gzipped) SQL dump into the configured MySQL server.
+func RestoreMySQL(ctx context.Context, archive string, opts RestoreOptions) error {
+	cfg, err := loadMySQLConfig(opts.Env)
+	if err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Configuration error: %v", err)
+		return err
+	}
+
+	target := cfg.Database
+	if opts.TargetDB != "" {
+		target = opts.TargetDB
+	}
+
+	dump, err := openDump(archive)
+	if err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Failed to open archive: %v", err)
+		return err
+	}
+	defer dump.Close()
+
+	utilities.Logger.Infof("[MySQL] 🐬 Restoring %s into %s", archive, target)
+
+	optionFile, err := writeMySQLOptions(cfg)
+	if err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ Failed to write option file: %v", err)
+		return err
+	}
+	defer os.Remove(optionFile)
+
+	cmd := utilities.Command(ctx, "mysql", cfg.args(optionFile, target)...)
+	cmd.Stdin = dump
+
+	if out, err := cmd.CombinedOutput(); err != nil {
+		utilities.Logger.Errorf("[MySQL] ❌ mysql execution error: %v\nOutput:\n%s", err, out)
+		return err
+	}
+
+	utilities.Logger.Info("[MySQL] ✅ Restore completed successfully")
+	utilities.LogDivider()
 	return nil
 }
+
+// writeMySQLOptions writes the password to a private option file, so it never
+// shows up on the command line. The caller removes the file.
+func writeMySQLOptions(cfg *mysqlConfig) (string, error) {
+	f, err := os.CreateTemp("", "hyper-backup-mysql-*.cnf")
+	if err != nil {
+		return "", err
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(cfg.Password)
+	_, err = fmt.Fprintf(f, "[client]\npassword=\"%s\"\n", escaped)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// args builds mysql/mysqldump arguments for database. The option file has to
+// come first.
+func (cfg *mysqlConfig) args(optionFile, database string) []string {
+	return []string{
+		"--defaults-extra-file=" + optionFile,
+		"-h", cfg.Host,
+		"-P", cfg.Port,
+		"-u", cfg.User,
+		database,
+	}
+}
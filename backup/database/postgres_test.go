@@ -0,0 +1,28 @@
+package backup
+
+import "testing"
+
+func TestSplitPostgresPassword(t *testing.T) {
+	tests := []struct {
+		dsn      string
+		rest     string
+		password string
+	}{
+		{"postgres://app:s3cret@db:5432/shop?sslmode=disable", "postgres://app@db:5432/shop?sslmode=disable", "s3cret"},
+		{"postgresql://app:p%40ss%20word@db/shop", "postgresql://app@db/shop", "p@ss word"},
+		{"postgres://app@db/shop", "postgres://app@db/shop", ""},
+		{"postgres://db/shop", "postgres://db/shop", ""},
+		{"host=db password=s3cret dbname=shop", "host=db dbname=shop", "s3cret"},
+		{"password=s3cret host=db", "host=db", "s3cret"},
+		{"host=db  password = s3cret", "host=db", "s3cret"},
+		{`host=db password='it\'s a \\ secret' dbname=shop`, "host=db dbname=shop", `it's a \ secret`},
+		{"host=db dbname=shop", "host=db dbname=shop", ""},
+		{"host=db user=password_admin", "host=db user=password_admin", ""},
+	}
+	for _, tt := range tests {
+		rest, password := splitPostgresPassword(tt.dsn)
+		if rest != tt.rest || password != tt.password {
+			t.Errorf("splitPostgresPassword(%q) = %q, %q, want %q, %q", tt.dsn, rest, password, tt.rest, tt.password)
+		}
+	}
+}
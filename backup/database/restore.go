@@ -0,0 +1,118 @@
+package backup
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// RestoreOptions controls how an archive is loaded back into a database.
+type RestoreOptions struct {
+	// TargetDB overrides the database configured for backups.
+	TargetDB string
+	// Drop removes existing collections before restoring (MongoDB only).
+	Drop bool
+	// Env holds the settings of the instance to restore into. The zero
+	// value reads the environment.
+	Env utilities.Env
+}
+
+// Restore streams archive back into the database managed by service.
+// service accepts "mysql", "postgres"/"postgresql" and "mongo"/"mongodb".
+func Restore(ctx context.Context, service, archive string, opts RestoreOptions) error {
+	if _, err := os.Stat(archive); err != nil {
+		return fmt.Errorf("archive not accessible: %w", err)
+	}
+
+	switch strings.ToLower(service) {
+	case "mysql":
+		return RestoreMySQL(ctx, archive, opts)
+	case "postgres", "postgresql":
+		return RestorePostgres(ctx, archive, opts)
+	case "mongo", "mongodb":
+		return RestoreMongo(ctx, archive, opts)
+	default:
+		return fmt.Errorf("unknown restore service %q (expected mysql, postgres or mongo)", service)
+	}
+}
+
+// RestoreTarget returns the database that Restore would write into for service,
+// so callers can show it before asking for confirmation.
+func RestoreTarget(service string, opts RestoreOptions) (string, error) {
+	if opts.TargetDB != "" {
+		return opts.TargetDB, nil
+	}
+
+	switch strings.ToLower(service) {
+	case "mysql":
+		cfg, err := loadMySQLConfig(opts.Env)
+		if err != nil {
+			return "", err
+		}
+		return cfg.Database, nil
+	case "postgres", "postgresql":
+		cfg, err := loadPostgresConfig(opts.Env)
+		if err != nil {
+			return "", err
+		}
+		return cfg.restoreDatabase(""), nil
+	case "mongo", "mongodb":
+		cfg, err := loadMongoConfig(opts.Env)
+		if err != nil {
+			return "", err
+		}
+		if cfg.Database == "" {
+			return "all", nil
+		}
+		return cfg.Database, nil
+	default:
+		return "", fmt.Errorf("unknown restore service %q (expected mysql, postgres or mongo)", service)
+	}
+}
+
+// openDump opens a dump file and transparently decrypts and decompresses it.
+func openDump(path string) (io.ReadCloser, error) {
+	f, err := encrypt.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(f)
+	magic, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return &readCloser{Reader: br, close: f.Close}, nil
+	}
+
+	gr, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("open gzip stream: %w", err)
+	}
+	return &readCloser{
+		Reader: gr,
+		close: func() error {
+			gr.Close()
+			return f.Close()
+		},
+	}, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
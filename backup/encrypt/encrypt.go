@@ -0,0 +1,307 @@
+// Package encrypt encrypts artifacts while they are written, so a dump never
+// reaches the disk — or a third-party bucket — in plaintext, and decrypts them
+// again for restore. It supports age (recipients or a passphrase) and OpenPGP
+// public keys, configured through the ENCRYPT_* settings; each of them can be
+// read from a file with the _FILE convention.
+package encrypt
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Methods, as recorded in the catalog.
+const (
+	MethodAge     = catalog.EncryptionAge
+	MethodOpenPGP = catalog.EncryptionOpenPGP
+)
+
+// Config is the encryption applied to new artifacts.
+type Config struct {
+	Method     string
+	recipients []age.Recipient
+	keys       openpgp.EntityList
+	// identities decrypt what the config encrypted, when it holds the
+	// secret itself: a passphrase.
+	identities []age.Identity
+}
+
+// Load reads the ENCRYPT_* settings. It returns nil when encryption is off.
+func Load() (*Config, error) {
+	return LoadEnv(utilities.Env{}, "")
+}
+
+// LoadEnv reads the encryption a destination applies to its uploads from the
+// <prefix>_ENCRYPT_* settings in env, e.g. S3_ENCRYPT_AGE_RECIPIENTS; an empty
+// prefix reads the ENCRYPT_* settings. It returns nil when encryption is off.
+func LoadEnv(env utilities.Env, prefix string) (*Config, error) {
+	key := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + "_" + name
+	}
+	recipients := env.Getenv(key("ENCRYPT_AGE_RECIPIENTS"))
+	passphrase := env.Getenv(key("ENCRYPT_PASSPHRASE"))
+	publicKey := env.Getenv(key("ENCRYPT_PGP_PUBLIC_KEY"))
+
+	useAge := recipients != "" || passphrase != ""
+	switch {
+	case useAge && publicKey != "":
+		return nil, fmt.Errorf("%s cannot be combined with age encryption", key("ENCRYPT_PGP_PUBLIC_KEY"))
+	case recipients != "" && passphrase != "":
+		// age only allows a passphrase as the single recipient
+		return nil, fmt.Errorf("%s and %s cannot be combined", key("ENCRYPT_AGE_RECIPIENTS"), key("ENCRYPT_PASSPHRASE"))
+	case recipients != "":
+		// one recipient per line or comma-separated; # starts a comment
+		list, err := age.ParseRecipients(strings.NewReader(strings.ReplaceAll(recipients, ",", "\n")))
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key("ENCRYPT_AGE_RECIPIENTS"), err)
+		}
+		return &Config{Method: MethodAge, recipients: list}, nil
+	case passphrase != "":
+		r, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key("ENCRYPT_PASSPHRASE"), err)
+		}
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key("ENCRYPT_PASSPHRASE"), err)
+		}
+		return &Config{Method: MethodAge, recipients: []age.Recipient{r}, identities: []age.Identity{id}}, nil
+	case publicKey != "":
+		keys, err := readKeyRing(publicKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", key("ENCRYPT_PGP_PUBLIC_KEY"), err)
+		}
+		return &Config{Method: MethodOpenPGP, keys: keys}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// Validate reports whether the encryption settings are usable.
+func Validate() error {
+	_, err := Load()
+	return err
+}
+
+// Ext is the suffix added to encrypted file names.
+func (c *Config) Ext() string {
+	if c.Method == MethodOpenPGP {
+		return ".gpg"
+	}
+	return ".age"
+}
+
+// Wrap returns a writer that encrypts into w. Closing it writes the final
+// block but leaves w open.
+func (c *Config) Wrap(w io.Writer) (io.WriteCloser, error) {
+	if c.Method == MethodOpenPGP {
+		return openpgp.Encrypt(w, c.keys, nil, &openpgp.FileHints{IsBinary: true}, nil)
+	}
+	return age.Encrypt(w, c.recipients...)
+}
+
+// File is an artifact being written under its final name plus the partial
+// suffix. With encryption on, everything written to it is encrypted before it
+// reaches the disk and Path carries the extra extension.
+type File struct {
+	// Path is the name the file will have once committed.
+	Path string
+
+	out *utilities.AtomicFile
+	enc io.WriteCloser
+}
+
+// Create starts the artifact path, encrypted as configured.
+func Create(path string) (*File, error) {
+	cfg, err := Load()
+	if err != nil {
+		return nil, err
+	}
+	if cfg != nil {
+		path += cfg.Ext()
+	}
+
+	out, err := utilities.CreateAtomic(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &File{Path: path, out: out}
+	if cfg != nil {
+		if f.enc, err = cfg.Wrap(out); err != nil {
+			out.Abort()
+			return nil, fmt.Errorf("start encryption: %w", err)
+		}
+	}
+	return f, nil
+}
+
+func (f *File) Write(p []byte) (int, error) {
+	if f.enc != nil {
+		return f.enc.Write(p)
+	}
+	return f.out.Write(p)
+}
+
+// Commit finishes the encryption stream and moves the file into place.
+func (f *File) Commit() error {
+	if f.enc != nil {
+		if err := f.enc.Close(); err != nil {
+			f.out.Abort()
+			return fmt.Errorf("finish encryption: %w", err)
+		}
+	}
+	return f.out.Commit()
+}
+
+// Abort discards the file; it does nothing after a successful Commit.
+func (f *File) Abort() {
+	f.out.Abort()
+}
+
+// Open opens the artifact at path for reading, decrypting it when its name
+// says it is encrypted. Decryption uses ENCRYPT_AGE_IDENTITY,
+// ENCRYPT_PASSPHRASE or the passphrase of a destination (see
+// destinationPrefixes) for age, and ENCRYPT_PGP_PRIVATE_KEY with
+// ENCRYPT_PGP_PASSPHRASE for OpenPGP.
+func Open(path string) (io.ReadCloser, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := Decrypt(catalog.EncryptionOf(path), f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &readCloser{Reader: r, close: f.Close}, nil
+}
+
+// Decrypt returns the plaintext of r encrypted with method; an empty method
+// returns r unchanged.
+func Decrypt(method string, r io.Reader) (io.Reader, error) {
+	return decrypt(method, r, nil)
+}
+
+// Decrypt is the package-level Decrypt that also tries the passphrase of c,
+// so a destination reads back the copies it encrypted with a passphrase of
+// its own. Setting ENCRYPT_PASSPHRASE instead would encrypt the local
+// artifacts too. c may be nil.
+func (c *Config) Decrypt(method string, r io.Reader) (io.Reader, error) {
+	if c == nil {
+		return decrypt(method, r, nil)
+	}
+	return decrypt(method, r, c.identities)
+}
+
+func decrypt(method string, r io.Reader, own []age.Identity) (io.Reader, error) {
+	switch method {
+	case "":
+		return r, nil
+	case MethodAge:
+		identities, err := ageIdentities(own)
+		if err != nil {
+			return nil, err
+		}
+		plain, err := age.Decrypt(bufio.NewReader(r), identities...)
+		if err != nil {
+			return nil, fmt.Errorf("age: %w", err)
+		}
+		return plain, nil
+	case MethodOpenPGP:
+		keys, err := privateKeys()
+		if err != nil {
+			return nil, err
+		}
+		md, err := openpgp.ReadMessage(r, keys, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("openpgp: %w", err)
+		}
+		return md.UnverifiedBody, nil
+	default:
+		return nil, fmt.Errorf("unknown encryption %q", method)
+	}
+}
+
+// destinationPrefixes are the destinations that can encrypt their copies
+// with a passphrase of their own, e.g. S3_ENCRYPT_PASSPHRASE. A copy downloaded
+// from one of them decrypts with it.
+var destinationPrefixes = []string{"RCLONE", "S3", "LOCAL_DEST", "SFTP"}
+
+func ageIdentities(own []age.Identity) ([]age.Identity, error) {
+	identities := slices.Clone(own)
+	if keys := utilities.Getenv("ENCRYPT_AGE_IDENTITY"); keys != "" {
+		parsed, err := age.ParseIdentities(strings.NewReader(keys))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPT_AGE_IDENTITY: %w", err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if passphrase := utilities.Getenv("ENCRYPT_PASSPHRASE"); passphrase != "" {
+		id, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ENCRYPT_PASSPHRASE: %w", err)
+		}
+		identities = append(identities, id)
+	}
+	for _, prefix := range destinationPrefixes {
+		key := prefix + "_ENCRYPT_PASSPHRASE"
+		if passphrase := utilities.Getenv(key); passphrase != "" {
+			id, err := age.NewScryptIdentity(passphrase)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", key, err)
+			}
+			identities = append(identities, id)
+		}
+	}
+	if len(identities) == 0 {
+		return nil, errors.New("archive is age-encrypted; set ENCRYPT_AGE_IDENTITY or ENCRYPT_PASSPHRASE to decrypt it")
+	}
+	return identities, nil
+}
+
+func privateKeys() (openpgp.EntityList, error) {
+	key := utilities.Getenv("ENCRYPT_PGP_PRIVATE_KEY")
+	if key == "" {
+		return nil, errors.New("archive is OpenPGP-encrypted; set ENCRYPT_PGP_PRIVATE_KEY to decrypt it")
+	}
+	keys, err := readKeyRing(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ENCRYPT_PGP_PRIVATE_KEY: %w", err)
+	}
+	if passphrase := utilities.Getenv("ENCRYPT_PGP_PASSPHRASE"); passphrase != "" {
+		for _, e := range keys {
+			if err := e.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+				return nil, fmt.Errorf("unlock ENCRYPT_PGP_PRIVATE_KEY: %w", err)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// readKeyRing reads ASCII-armored keys.
+func readKeyRing(key string) (openpgp.EntityList, error) {
+	return openpgp.ReadArmoredKeyRing(strings.NewReader(key))
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
@@ -0,0 +1,288 @@
+package encrypt
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+var encryptKeys = []string{
+	"ENCRYPT_AGE_RECIPIENTS", "ENCRYPT_AGE_IDENTITY", "ENCRYPT_PASSPHRASE",
+	"ENCRYPT_PGP_PUBLIC_KEY", "ENCRYPT_PGP_PRIVATE_KEY", "ENCRYPT_PGP_PASSPHRASE",
+}
+
+// setEncryptEnv clears every ENCRYPT_* setting and sets the ones in values.
+func setEncryptEnv(t *testing.T, values map[string]string) {
+	t.Helper()
+	for _, key := range encryptKeys {
+		t.Setenv(key, values[key])
+		t.Setenv(key+"_FILE", "")
+	}
+}
+
+// pgpKeys returns a new armored key pair. With a passphrase the private key
+// is locked with it.
+func pgpKeys(t *testing.T, passphrase string) (public, private string) {
+	t.Helper()
+	e, err := openpgp.NewEntity("backup", "", "backup@example.com", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	armored := func(blockType string, serialize func(io.Writer) error) string {
+		var buf bytes.Buffer
+		w, err := armor.Encode(&buf, blockType, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := serialize(w); err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		return buf.String()
+	}
+
+	public = armored(openpgp.PublicKeyType, e.Serialize)
+	if passphrase == "" {
+		return public, armored(openpgp.PrivateKeyType, func(w io.Writer) error { return e.SerializePrivate(w, nil) })
+	}
+	if err := e.EncryptPrivateKeys([]byte(passphrase), nil); err != nil {
+		t.Fatal(err)
+	}
+	return public, armored(openpgp.PrivateKeyType, func(w io.Writer) error { return e.SerializePrivateWithoutSigning(w, nil) })
+}
+
+func TestRoundTrip(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := age.GenerateX25519Identity()
+	pgpPublic, pgpPrivate := pgpKeys(t, "")
+	lockedPublic, lockedPrivate := pgpKeys(t, "unlock me")
+
+	tests := []struct {
+		name  string
+		write map[string]string
+		read  map[string]string
+		ext   string
+	}{
+		{
+			name: "plain",
+		},
+		{
+			name:  "age recipient",
+			write: map[string]string{"ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()},
+			read:  map[string]string{"ENCRYPT_AGE_IDENTITY": identity.String()},
+			ext:   ".age",
+		},
+		{
+			name:  "age recipients with comments",
+			write: map[string]string{"ENCRYPT_AGE_RECIPIENTS": "# ops\n" + other.Recipient().String() + "," + identity.Recipient().String()},
+			read:  map[string]string{"ENCRYPT_AGE_IDENTITY": identity.String()},
+			ext:   ".age",
+		},
+		{
+			name:  "age passphrase",
+			write: map[string]string{"ENCRYPT_PASSPHRASE": "correct horse"},
+			read:  map[string]string{"ENCRYPT_PASSPHRASE": "correct horse"},
+			ext:   ".age",
+		},
+		{
+			name:  "openpgp",
+			write: map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": pgpPublic},
+			read:  map[string]string{"ENCRYPT_PGP_PRIVATE_KEY": pgpPrivate},
+			ext:   ".gpg",
+		},
+		{
+			name:  "openpgp with a locked key",
+			write: map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": lockedPublic},
+			read:  map[string]string{"ENCRYPT_PGP_PRIVATE_KEY": lockedPrivate, "ENCRYPT_PGP_PASSPHRASE": "unlock me"},
+			ext:   ".gpg",
+		},
+	}
+	plaintext := bytes.Repeat([]byte("CREATE TABLE t (id int);\n"), 500)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "db.sql.gz")
+			setEncryptEnv(t, tt.write)
+			f, err := Create(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Path != path+tt.ext {
+				t.Errorf("Path = %s, want %s", f.Path, path+tt.ext)
+			}
+			if _, err := f.Write(plaintext); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Commit(); err != nil {
+				t.Fatal(err)
+			}
+			stored, err := os.ReadFile(f.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if encrypted := !bytes.Equal(stored, plaintext); encrypted != (tt.ext != "") {
+				t.Errorf("stored file encrypted: %v, want %v", encrypted, tt.ext != "")
+			}
+
+			setEncryptEnv(t, tt.read)
+			r, err := Open(f.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, plaintext) {
+				t.Errorf("decrypted %d bytes, want the %d written", len(got), len(plaintext))
+			}
+		})
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	identity, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	pgpPublic, _ := pgpKeys(t, "")
+	_, otherPrivate := pgpKeys(t, "")
+	_, lockedPrivate := pgpKeys(t, "unlock me")
+
+	tests := []struct {
+		name    string
+		write   map[string]string
+		read    map[string]string
+		wantErr string
+	}{
+		{
+			name:    "age without identity",
+			write:   map[string]string{"ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()},
+			wantErr: "set ENCRYPT_AGE_IDENTITY or ENCRYPT_PASSPHRASE",
+		},
+		{
+			name:    "age with another identity",
+			write:   map[string]string{"ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()},
+			read:    map[string]string{"ENCRYPT_AGE_IDENTITY": other.String()},
+			wantErr: "did not match any of the recipients",
+		},
+		{
+			name:    "invalid age identity",
+			write:   map[string]string{"ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()},
+			read:    map[string]string{"ENCRYPT_AGE_IDENTITY": "AGE-SECRET-KEY-NOPE"},
+			wantErr: "invalid ENCRYPT_AGE_IDENTITY",
+		},
+		{
+			name:    "openpgp without private key",
+			write:   map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": pgpPublic},
+			wantErr: "set ENCRYPT_PGP_PRIVATE_KEY",
+		},
+		{
+			name:    "openpgp with another key",
+			write:   map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": pgpPublic},
+			read:    map[string]string{"ENCRYPT_PGP_PRIVATE_KEY": otherPrivate},
+			wantErr: "openpgp:",
+		},
+		{
+			name:    "openpgp with a wrong passphrase",
+			write:   map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": pgpPublic},
+			read:    map[string]string{"ENCRYPT_PGP_PRIVATE_KEY": lockedPrivate, "ENCRYPT_PGP_PASSPHRASE": "guess"},
+			wantErr: "unlock ENCRYPT_PGP_PRIVATE_KEY",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEncryptEnv(t, tt.write)
+			f, err := Create(filepath.Join(t.TempDir(), "db.sql.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write([]byte("secret rows"))
+			if err := f.Commit(); err != nil {
+				t.Fatal(err)
+			}
+
+			setEncryptEnv(t, tt.read)
+			r, err := Open(f.Path)
+			if err == nil {
+				r.Close()
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("Open error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	identity, _ := age.GenerateX25519Identity()
+	pgpPublic, _ := pgpKeys(t, "")
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		method  string
+		wantErr string
+	}{
+		{name: "off"},
+		{name: "age recipients", env: map[string]string{"ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()}, method: MethodAge},
+		{name: "age passphrase", env: map[string]string{"ENCRYPT_PASSPHRASE": "load passphrase"}, method: MethodAge},
+		{name: "openpgp", env: map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": pgpPublic}, method: MethodOpenPGP},
+		{
+			name:    "age and openpgp",
+			env:     map[string]string{"ENCRYPT_PASSPHRASE": "load passphrase", "ENCRYPT_PGP_PUBLIC_KEY": pgpPublic},
+			wantErr: "cannot be combined with age",
+		},
+		{
+			name:    "recipients and passphrase",
+			env:     map[string]string{"ENCRYPT_PASSPHRASE": "load passphrase", "ENCRYPT_AGE_RECIPIENTS": identity.Recipient().String()},
+			wantErr: "ENCRYPT_AGE_RECIPIENTS and ENCRYPT_PASSPHRASE cannot be combined",
+		},
+		{name: "invalid recipient", env: map[string]string{"ENCRYPT_AGE_RECIPIENTS": "age1nope"}, wantErr: "invalid ENCRYPT_AGE_RECIPIENTS"},
+		{name: "invalid public key", env: map[string]string{"ENCRYPT_PGP_PUBLIC_KEY": "not a key"}, wantErr: "invalid ENCRYPT_PGP_PUBLIC_KEY"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setEncryptEnv(t, tt.env)
+			cfg, err := Load()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("Load error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			method := ""
+			if cfg != nil {
+				method = cfg.Method
+			}
+			if method != tt.method {
+				t.Errorf("method = %q, want %q", method, tt.method)
+			}
+		})
+	}
+}
+
+func TestAbort(t *testing.T) {
+	setEncryptEnv(t, map[string]string{"ENCRYPT_PASSPHRASE": "load passphrase"})
+	dir := t.TempDir()
+	f, err := Create(filepath.Join(dir, "db.sql.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("half a dump"))
+	f.Abort()
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("Abort left %v behind", entries)
+	}
+}
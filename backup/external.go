@@ -1,33 +1,186 @@
 package backup
 
 import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
 	"github.com/fvoci/hyper-backup/backup/folders"
 	"github.com/fvoci/hyper-backup/backup/storage"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
-// RunExternalBackups runs folder compression and remote uploads via rclone/rsync.
-func RunExternalBackups() error {
+func init() {
+	// Folder failures are recorded per archive and fail the Files service
+	Register(StageFiles, &envService{
+		name:         "Files",
+		kind:         "folders",
+		envKeys:      []string{"PACK_UP_HYPER_BACKUP_1"},
+		timeoutKey:   "FILE_BACKUP_TIMEOUT",
+		retentionKey: "FILE_BACKUP",
+		dirKey:       "FILE_BACKUP_DIR",
+		run:          folders.RunFileBackup,
+		validate:     folders.ValidateFileBackup,
+	})
+	Register(StageStorage, &envService{
+		name:          "Rclone",
+		kind:          "rclone",
+		envKeys:       []string{"RCLONE_REMOTE", "RCLONE_PATH"},
+		timeoutKey:    "RCLONE_TIMEOUT",
+		bestEffortKey: "RCLONE_BEST_EFFORT",
+		dependsOn:     producers,
+		upload:        storage.RunRclone,
+		validate:      storage.ValidateRclone,
+	})
+	Register(StageStorage, &envService{
+		name:          "S3",
+		kind:          "s3",
+		envKeys:       []string{"S3_BUCKET"},
+		timeoutKey:    "S3_TIMEOUT",
+		bestEffortKey: "S3_BEST_EFFORT",
+		dependsOn:     producers,
+		upload:        storage.RunS3,
+		validate:      storage.ValidateS3,
+	})
+	Register(StageStorage, &envService{
+		name:          "Local",
+		kind:          "local",
+		envKeys:       []string{"LOCAL_DEST_PATH"},
+		timeoutKey:    "LOCAL_DEST_TIMEOUT",
+		bestEffortKey: "LOCAL_DEST_BEST_EFFORT",
+		dependsOn:     producers,
+		upload:        storage.RunLocal,
+		validate:      storage.ValidateLocal,
+	})
+	Register(StageStorage, &envService{
+		name:          "SFTP",
+		kind:          "sftp",
+		envKeys:       []string{"SFTP_HOST"},
+		timeoutKey:    "SFTP_TIMEOUT",
+		bestEffortKey: "SFTP_BEST_EFFORT",
+		dependsOn:     producers,
+		upload:        storage.RunSFTP,
+		validate:      storage.ValidateSFTP,
+	})
+	Register(StageStorage, &envService{
+		name:          "Rsync",
+		kind:          "rsync",
+		envKeys:       []string{"RSYNC_SRC", "RSYNC_DEST"},
+		timeoutKey:    "RSYNC_TIMEOUT",
+		bestEffortKey: "RSYNC_BEST_EFFORT",
+		dependsOn:     producers,
+		run:           noArtifacts(storage.RunRsync),
+		validate:      storage.ValidateRsync,
+	})
+}
+
+// RunExternalBackups runs folder compression and the uploads to every
+// configured destination: rclone, the built-in S3 client, a local path, an
+// SFTP server or rsync. It then applies the local retention policies, unless
+// an upload failed, and reports on each service. Cancelling ctx stops the
+// running service and skips the remaining ones.
+func RunExternalBackups(ctx context.Context) *CycleReport {
 	utilities.LogDivider()
 	utilities.Logger.Info("☁️ [External Backups]")
 
-	// Folder backup doesn't return error (yet), so just run it first
-	folders.RunFileBackup()
-
-	services := []service{
-		{
-			Name:     "Rclone",
-			EnvKeys:  []string{"RCLONE_REMOTE", "RCLONE_PATH"},
-			RunFunc:  storage.RunRclone,
-			Optional: true,
-		},
-		{
-			Name:     "Rsync",
-			EnvKeys:  []string{"RSYNC_SRC", "RSYNC_DEST"},
-			RunFunc:  storage.RunRsync,
-			Optional: true,
-		},
-	}
-
-	return runServices(services)
+	report := runServices(ctx, StageFiles)
+
+	// Write the manifest before uploading so it travels with the data
+	if err := catalog.Save(); err != nil {
+		utilities.Logger.Warnf("[Catalog] ⚠️ Failed to write manifest: %v", err)
+	}
+
+	started := time.Now()
+	uploads := runServices(ctx, StageStorage)
+	recordUploads(started)
+	report.Merge(uploads)
+
+	// A failed upload may have left artifacts whose only copy is local
+	if err := uploads.Err(); err != nil {
+		utilities.Logger.Warn("[HyperBackup] ⚠️ Local retention skipped: an upload failed")
+		return report
+	}
+	pruneLocal(ctx, os.Getenv("RETENTION_DRY_RUN") == "true")
+	return report
+}
+
+// producers makes upload services wait for every service that writes
+// artifacts. With UPLOAD_SKIP_ON_FAILURE=true a failure in any of them skips
+// the upload, so a broken dump never replaces good remote copies.
+func producers() []Dependency {
+	strict := os.Getenv("UPLOAD_SKIP_ON_FAILURE") == "true"
+	var deps []Dependency
+	for _, stage := range []Stage{StageCore, StageFiles} {
+		for _, svc := range Services(stage) {
+			deps = append(deps, Dependency{Service: svc.Name(), RequireSuccess: strict})
+		}
+	}
+	return deps
+}
+
+// startUploadPipeline lets per-artifact destinations (see storage.PerArtifact)
+// upload each artifact as soon as it is written when UPLOAD_STREAMING=true.
+// UPLOAD_SKIP_ON_FAILURE turns it off, because that policy can only decide
+// once every producer has finished.
+func startUploadPipeline(ctx context.Context) {
+	if os.Getenv("UPLOAD_STREAMING") != "true" {
+		return
+	}
+	var destinations []*envService
+	for _, svc := range Services(StageStorage) {
+		if s, ok := svc.(*envService); ok && storage.PerArtifact(s.kind) && s.Configured() && inCycle(ctx, s) {
+			destinations = append(destinations, s)
+		}
+	}
+	if len(destinations) == 0 {
+		return
+	}
+	if os.Getenv("UPLOAD_SKIP_ON_FAILURE") == "true" {
+		utilities.Logger.Warn("[HyperBackup] ⚠️ UPLOAD_STREAMING is ignored while UPLOAD_SKIP_ON_FAILURE=true")
+		return
+	}
+	for _, s := range destinations {
+		if err := storage.StartUploads(ctx, s.kind, s.env); err != nil {
+			utilities.Logger.Warnf("[%s] ⚠️ Uploading after the cycle instead: %v", s.name, err)
+		}
+	}
+}
+
+// RetryUploads retries the queued uploads of every configured per-artifact
+// destination (see storage.PerArtifact) whose backoff has expired, and with
+// force every artifact one of them has no verified copy of. It reports on the
+// destinations that had something to retry, or returns nil when none had.
+func RetryUploads(ctx context.Context, force bool) *CycleReport {
+	report := &CycleReport{StartedAt: time.Now()}
+	for _, svc := range Services(StageStorage) {
+		s, ok := svc.(*envService)
+		if !ok || !storage.PerArtifact(s.kind) || !s.Configured() || ctx.Err() != nil {
+			continue
+		}
+		runCtx, cancel := ctx, context.CancelFunc(func() {})
+		if timeout := s.Timeout(); timeout > 0 {
+			runCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+		started := time.Now()
+		n, t, err := storage.RetryUploads(runCtx, s.kind, s.env, force)
+		cancel()
+		if n == 0 && err == nil {
+			continue
+		}
+		sr := ServiceReport{
+			Name: s.name, Stage: StageStorage, Status: StatusSuccess, StartedAt: started, FinishedAt: time.Now(), Err: err,
+			Uploaded: t.Uploaded, UploadedBytes: t.Bytes, Queued: t.Queued, BestEffort: s.BestEffort(),
+		}
+		if err != nil {
+			sr.Status = StatusFailed
+		}
+		report.Services = append(report.Services, sr)
+	}
+	report.FinishedAt = time.Now()
+	if len(report.Services) == 0 {
+		return nil
+	}
+	recordUploads(report.FinishedAt)
+	return report
 }
@@ -3,6 +3,8 @@ package folders
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,33 +14,44 @@ import (
 
 	"github.com/klauspost/compress/zstd"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
-// RunFileBackup compresses directories defined by PACK_UP_HYPER_BACKUP_* env vars.
-// Returns a list of created archive file paths.
-func RunFileBackup() []string {
-	baseDir := "/home/hyper-backup/files"
+// RunFileBackup compresses directories defined by the PACK_UP_HYPER_BACKUP_*
+// settings in env into FILE_BACKUP_DIR (default /home/hyper-backup/files).
+// Returns one catalog artifact per folder, and an error joining every folder
+// that could not be archived; the others are still packed.
+func RunFileBackup(ctx context.Context, env utilities.Env) ([]catalog.Artifact, error) {
+	baseDir := fileBackupDir(env)
 	_ = os.MkdirAll(baseDir, 0755)
 
-	var created []string
+	var artifacts []catalog.Artifact
+	var errs []error
+	packed := 0
 
 	for i := 1; ; i++ {
 		envKey := fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", i)
-		src := os.Getenv(envKey)
+		src := env.Getenv(envKey)
 		if src == "" {
 			break
 		}
+		if err := ctx.Err(); err != nil {
+			utilities.Logger.Warnf("[Files] 🛑 Stopping before %s: %v", src, err)
+			return artifacts, err
+		}
 
 		if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
 			utilities.Logger.Warnf("[Files] ⚠️ Skipping %s: not a valid directory", src)
 			continue
 		}
 
-		timestamp := time.Now().Format("20060102_150405")
+		started := time.Now()
+		timestamp := started.Format("20060102_150405")
 		name := strings.ReplaceAll(filepath.Base(src), " ", "_")
 
-		method := os.Getenv("FILE_BACKUP_COMPRESSION")
+		method := env.Getenv("FILE_BACKUP_COMPRESSION")
 		if method == "" {
 			method = "zstd"
 		}
@@ -48,71 +61,135 @@ func RunFileBackup() []string {
 
 		switch strings.ToLower(method) {
 		case "gzip":
-			outPath = filepath.Join(baseDir, fmt.Sprintf("%s_%s.tar.gz", name, timestamp))
-			err = compressToTarGz(src, outPath)
+			outPath, err = compressToTarGz(ctx, src, filepath.Join(baseDir, fmt.Sprintf("%s_%s.tar.gz", name, timestamp)))
 		case "zstd":
-			outPath = filepath.Join(baseDir, fmt.Sprintf("%s_%s.tar.zst", name, timestamp))
-			err = compressToTarZst(src, outPath)
+			outPath, err = compressToTarZst(ctx, src, filepath.Join(baseDir, fmt.Sprintf("%s_%s.tar.zst", name, timestamp)))
 		default:
 			utilities.Logger.Errorf("[Files] ❌ Unknown compression method: %s", method)
+			errs = append(errs, fmt.Errorf("%s: unknown compression method %q", src, method))
 			continue
 		}
 
+		artifact := catalog.Artifact{
+			Source:     src,
+			Path:       outPath,
+			StartedAt:  started,
+			FinishedAt: time.Now(),
+		}
 		if err != nil {
 			utilities.Logger.Errorf("[Files] ❌ Failed to compress %s: %v", src, err)
+			artifact.Status = catalog.StatusFailed
+			artifact.Error = utilities.Redact(err.Error())
+			artifacts = append(artifacts, artifact)
+			errs = append(errs, fmt.Errorf("%s: %w", src, err))
 			continue
 		}
 
 		utilities.Logger.Infof("[Files] 📦 Packed %s → %s", src, outPath)
-		created = append(created, outPath)
+		artifact.Status = catalog.StatusSuccess
+		artifacts = append(artifacts, artifact)
+		packed++
 	}
 
-	if len(created) == 0 {
+	if packed == 0 {
 		utilities.Logger.Info("[Files] 🤷 No folders were packed")
 	}
 	utilities.LogDivider()
-	return created
+	return artifacts, errors.Join(errs...)
 }
 
-// compressToTarGz compresses a directory into .tar.gz
-func compressToTarGz(srcDir, outFile string) error {
-	out, err := os.Create(outFile)
-	if err != nil {
-		return err
+// ValidateFileBackup checks the compression method, that every
+// PACK_UP_HYPER_BACKUP_* entry points at a directory and that the archive
+// directory is writable.
+func ValidateFileBackup(env utilities.Env) error {
+	var errs []error
+	if env.Getenv("PACK_UP_HYPER_BACKUP_1") != "" {
+		if err := utilities.CheckWritable(fileBackupDir(env)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	switch method := strings.ToLower(env.Getenv("FILE_BACKUP_COMPRESSION")); method {
+	case "", "zstd", "gzip":
+	default:
+		errs = append(errs, fmt.Errorf("unknown FILE_BACKUP_COMPRESSION %q (expected zstd or gzip)", method))
 	}
-	defer out.Close()
 
-	gw := gzip.NewWriter(out)
-	defer gw.Close()
+	for i := 1; ; i++ {
+		envKey := fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", i)
+		src := env.Getenv(envKey)
+		if src == "" {
+			break
+		}
+		if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("%s=%s is not a directory", envKey, src))
+		}
+	}
+	return errors.Join(errs...)
+}
 
-	tw := tar.NewWriter(gw)
-	defer tw.Close()
+func fileBackupDir(env utilities.Env) string {
+	if dir := env.Getenv("FILE_BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return "/home/hyper-backup/files"
+}
+
+// compressToTarGz compresses a directory into .tar.gz and returns the path
+// written, which gains an extension when encryption is on.
+func compressToTarGz(ctx context.Context, srcDir, outFile string) (string, error) {
+	out, err := encrypt.Create(outFile)
+	if err != nil {
+		return outFile, err
+	}
+	defer out.Abort()
 
-	return walkAndWriteTar(srcDir, tw)
+	gw := gzip.NewWriter(out)
+	if err := writeTarTo(ctx, srcDir, gw); err != nil {
+		return out.Path, err
+	}
+	if err := gw.Close(); err != nil {
+		return out.Path, err
+	}
+	return out.Path, out.Commit()
 }
 
-// compressToTarZst compresses a directory into .tar.zst
-func compressToTarZst(srcDir, outFile string) error {
-	out, err := os.Create(outFile)
+// compressToTarZst compresses a directory into .tar.zst and returns the path
+// written, which gains an extension when encryption is on.
+func compressToTarZst(ctx context.Context, srcDir, outFile string) (string, error) {
+	out, err := encrypt.Create(outFile)
 	if err != nil {
-		return err
+		return outFile, err
 	}
-	defer out.Close()
+	defer out.Abort()
 
 	zw, err := zstd.NewWriter(out)
 	if err != nil {
-		return err
+		return out.Path, err
 	}
-	defer zw.Close()
-
-	tw := tar.NewWriter(zw)
-	defer tw.Close()
+	if err := writeTarTo(ctx, srcDir, zw); err != nil {
+		zw.Close()
+		return out.Path, err
+	}
+	if err := zw.Close(); err != nil {
+		return out.Path, err
+	}
+	return out.Path, out.Commit()
+}
 
-	return walkAndWriteTar(srcDir, tw)
+// writeTarTo writes srcDir as a complete tar stream into w.
+func writeTarTo(ctx context.Context, srcDir string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	if err := walkAndWriteTar(ctx, srcDir, tw); err != nil {
+		return err
+	}
+	return tw.Close()
 }
 
-func walkAndWriteTar(srcDir string, tw *tar.Writer) error {
+func walkAndWriteTar(ctx context.Context, srcDir string, tw *tar.Writer) error {
 	return filepath.Walk(srcDir, func(path string, info os.FileInfo, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
 		if err != nil {
 			utilities.Logger.Warnf("[Files] ⚠️ Skipping %s: stat error: %v", path, err)
 			return nil
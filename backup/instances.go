@@ -0,0 +1,47 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fvoci/hyper-backup/config"
+)
+
+// RegisterInstances registers a service for every instance defined in a
+// config file, next to the services configured through the environment. An
+// instance runs the built-in runner of its kind, in the same stage, under the
+// name "<Service>:<instance>", e.g. "MySQL:reporting".
+func RegisterInstances(instances []config.Instance) error {
+	var errs []error
+	for _, inst := range instances {
+		base, stage := builtin(inst.Kind)
+		if base == nil {
+			errs = append(errs, fmt.Errorf("%s %q: no service for this kind", inst.Kind, inst.Name))
+			continue
+		}
+
+		svc := *base
+		svc.name = base.name + ":" + inst.Name
+		svc.env = inst.Env
+		svc.instance = true
+		svc.schedule = inst.Schedule
+		if _, _, ok := Lookup(svc.name); ok {
+			errs = append(errs, fmt.Errorf("service %s is already registered", svc.name))
+			continue
+		}
+		Register(stage, &svc)
+	}
+	return errors.Join(errs...)
+}
+
+// builtin finds the service registered at start-up for kind.
+func builtin(kind string) (*envService, Stage) {
+	for _, stage := range []Stage{StageCore, StageFiles, StageStorage} {
+		for _, svc := range Services(stage) {
+			if s, ok := svc.(*envService); ok && s.kind == kind && !s.instance {
+				return s, stage
+			}
+		}
+	}
+	return nil, 0
+}
@@ -0,0 +1,197 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Prune applies the local retention policies and the remote ones of every
+// configured per-artifact destination (see storage.PerArtifact) outside a
+// backup cycle. With dryRun it only logs what it would delete.
+func Prune(ctx context.Context, dryRun bool) error {
+	pruneLocal(ctx, dryRun)
+
+	var errs []error
+	for _, svc := range Services(StageStorage) {
+		s, ok := svc.(*envService)
+		if !ok || !s.Configured() {
+			continue
+		}
+		if err := storage.Prune(ctx, s.kind, s.env, dryRun); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// recordUploads marks the artifacts finished before the storage stage started
+// as uploaded once every per-artifact destination (see storage.PerArtifact)
+// has a verified copy. Rsync does not count: it cannot verify single
+// artifacts and mirrors deletions, so its copy disappears with the local file.
+// Best-effort destinations are left out unless all of them are, so that their
+// outages never hold back local retention. Queued uploads to destinations that
+// are no longer configured are dropped.
+func recordUploads(started time.Time) {
+	var all, targets, fallback []string
+	for _, svc := range Services(StageStorage) {
+		s, ok := svc.(*envService)
+		if !ok || !s.Configured() || !storage.PerArtifact(s.kind) {
+			continue
+		}
+		target, err := storage.Target(s.kind, s.env)
+		if err != nil {
+			utilities.Logger.Warnf("[%s] ⚠️ Uploads not recorded: %v", s.name, err)
+			continue
+		}
+		all = append(all, target)
+		if s.BestEffort() {
+			fallback = append(fallback, target)
+		} else {
+			targets = append(targets, target)
+		}
+	}
+	storage.ForgetUploads(all)
+	if len(targets) == 0 {
+		targets = fallback
+	}
+	if len(targets) == 0 {
+		return
+	}
+	if err := catalog.MarkUploaded(targets, started, time.Now()); err != nil {
+		utilities.Logger.Warnf("[Catalog] ⚠️ Failed to record uploads: %v", err)
+	}
+}
+
+// pruneLocal applies the local retention policy of every configured service
+// that produces artifacts. Only files recorded in the catalog are deleted.
+// With any storage service configured, artifacts that have not been marked
+// uploaded are kept whatever the policy says, since the local file may be
+// their only copy. With dryRun it only logs what it would delete.
+func pruneLocal(ctx context.Context, dryRun bool) {
+	if ctx.Err() != nil {
+		return
+	}
+
+	policies := localPolicies()
+	if len(policies) == 0 {
+		return
+	}
+	guarded := storageConfigured()
+
+	candidates := map[string][]retention.Item{}
+	uploaded := map[string]bool{}
+	_ = catalog.Update(func(m *catalog.Manifest) bool {
+		for _, a := range m.Artifacts {
+			if _, ok := policies[a.Service]; !ok || a.Status != catalog.StatusSuccess || a.Path == "" || !a.RemovedAt.IsZero() {
+				continue
+			}
+			if _, err := os.Stat(a.Path); err != nil {
+				continue
+			}
+			candidates[a.Service] = append(candidates[a.Service], retention.FromArtifact(a))
+			uploaded[a.Path] = !a.UploadedAt.IsZero()
+		}
+		return false
+	})
+
+	now := time.Now()
+	removed := map[string]bool{}
+	for name, p := range policies {
+		count, freed := 0, int64(0)
+		for _, it := range retention.Select(p, candidates[name], now) {
+			if guarded && !uploaded[it.Path] {
+				utilities.Logger.Debugf("[%s] 🔒 Keeping %s: not uploaded yet", name, it.Path)
+				continue
+			}
+			if dryRun {
+				utilities.Logger.Infof("[%s] 🔍 Would remove local %s", name, it.Path)
+				count++
+				freed += it.Size
+				continue
+			}
+			if err := os.Remove(it.Path); err != nil {
+				utilities.Logger.Warnf("[%s] ⚠️ Failed to remove %s: %v", name, it.Path, err)
+				continue
+			}
+			utilities.Logger.Infof("[%s] 🗑️ Removed local %s", name, it.Path)
+			removed[it.Path] = true
+			count++
+			freed += it.Size
+		}
+		switch {
+		case count > 0 && dryRun:
+			utilities.Logger.Infof("[%s] 🔍 Local retention (%s) would remove %d artifact(s), freeing %s", name, p, count, utilities.HumanBytes(freed))
+		case count > 0:
+			utilities.Logger.Infof("[%s] 🧹 Local retention removed %d artifact(s), freed %s", name, count, utilities.HumanBytes(freed))
+		case dryRun:
+			utilities.Logger.Infof("[%s] 🔍 Local retention (%s) would remove nothing", name, p)
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+
+	err := catalog.Update(func(m *catalog.Manifest) bool {
+		changed := false
+		for i := range m.Artifacts {
+			if a := &m.Artifacts[i]; removed[a.Path] && a.RemovedAt.IsZero() {
+				a.RemovedAt = now
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		utilities.Logger.Warnf("[Catalog] ⚠️ Failed to record removed artifacts: %v", err)
+	}
+}
+
+// localPolicies returns the local retention policy of every configured
+// service that produces artifacts and has one, by service name. Invalid
+// policies are logged and left out.
+func localPolicies() map[string]retention.Policy {
+	policies := map[string]retention.Policy{}
+	for _, stage := range []Stage{StageCore, StageFiles} {
+		for _, svc := range Services(stage) {
+			r, ok := svc.(RetentionService)
+			if !ok || !svc.Configured() {
+				continue
+			}
+			p, err := r.LocalRetention()
+			if err != nil {
+				utilities.Logger.Warnf("[%s] ⚠️ Local retention disabled: %v", svc.Name(), err)
+				continue
+			}
+			if !p.IsZero() {
+				policies[svc.Name()] = p
+			}
+		}
+	}
+	return policies
+}
+
+// LocalRetentionConfigured reports whether any configured service has a
+// local retention policy.
+func LocalRetentionConfigured() bool {
+	return len(localPolicies()) > 0
+}
+
+// storageConfigured reports whether any storage service is configured, rsync
+// included. Without one, the local backups are the only copies and the policy
+// alone decides.
+func storageConfigured() bool {
+	for _, svc := range Services(StageStorage) {
+		if svc.Configured() {
+			return true
+		}
+	}
+	return false
+}
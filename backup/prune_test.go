@@ -0,0 +1,113 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// isolateRegistry restores the registered services after the test.
+func isolateRegistry(t *testing.T) {
+	t.Helper()
+	saved := map[Stage][]Service{}
+	for _, stage := range []Stage{StageCore, StageFiles, StageStorage} {
+		saved[stage] = Services(stage)
+	}
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		for stage, services := range saved {
+			registry[stage] = services
+		}
+	})
+}
+
+// instance returns a service configured through env, like a config file
+// instance.
+func instance(name, kind string, values map[string]string) *envService {
+	return &envService{name: name, kind: kind, retentionKey: "PRUNE_TEST", env: utilities.NewEnv(values), instance: true}
+}
+
+func TestPruneLocal(t *testing.T) {
+	t.Setenv("LOCAL_KEEP_LAST", "")
+	tests := []struct {
+		name     string
+		storage  *envService
+		uploaded bool
+		removed  bool
+	}{
+		{name: "no storage service", removed: true},
+		{name: "not uploaded", storage: instance("prune-test-rsync", "rsync", nil)},
+		{name: "uploaded", storage: instance("prune-test-rsync", "rsync", nil), uploaded: true, removed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			isolateRegistry(t)
+			dir := t.TempDir()
+			t.Setenv("CATALOG_DIR", dir)
+			Register(StageCore, instance("prune-test", "mysql", map[string]string{"PRUNE_TEST_LOCAL_KEEP_LAST": "1"}))
+			if tt.storage != nil {
+				Register(StageStorage, tt.storage)
+			}
+
+			old, latest := filepath.Join(dir, "old.sql.zst"), filepath.Join(dir, "latest.sql.zst")
+			start := time.Now().Add(-time.Hour)
+			catalog.Begin(start)
+			for i, path := range []string{old, latest} {
+				if err := os.WriteFile(path, []byte("rows"), 0644); err != nil {
+					t.Fatal(err)
+				}
+				a := catalog.Artifact{Service: "prune-test", Path: path, Size: 4, Status: catalog.StatusSuccess, FinishedAt: start.Add(time.Duration(i) * time.Minute)}
+				if tt.uploaded {
+					a.UploadedAt = start
+				}
+				catalog.Add(a)
+			}
+			if err := catalog.End(start.Add(time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			pruneLocal(t.Context(), false)
+			if _, err := os.Stat(old); os.IsNotExist(err) != tt.removed {
+				t.Errorf("old artifact removed: %v, want %v", os.IsNotExist(err), tt.removed)
+			}
+			if _, err := os.Stat(latest); err != nil {
+				t.Errorf("latest artifact: %v", err)
+			}
+		})
+	}
+}
+
+func TestRecordUploads(t *testing.T) {
+	isolateRegistry(t)
+	dir := t.TempDir()
+	t.Setenv("CATALOG_DIR", dir)
+	dest := t.TempDir()
+	// The broken S3 instance is left out instead of stopping the others
+	Register(StageStorage, instance("prune-test-s3", "s3", nil))
+	Register(StageStorage, instance("prune-test-local", "local", map[string]string{"LOCAL_DEST_PATH": dest}))
+
+	path := filepath.Join(dir, "db.sql.zst")
+	start := time.Now().Add(-time.Hour)
+	catalog.Begin(start)
+	catalog.Add(catalog.Artifact{Service: "prune-test", Path: path, Status: catalog.StatusSuccess, FinishedAt: start})
+	if err := catalog.End(start); err != nil {
+		t.Fatal(err)
+	}
+	if err := catalog.RecordUpload(path, dest, start); err != nil {
+		t.Fatal(err)
+	}
+
+	recordUploads(time.Now())
+	m, err := catalog.LoadManifests(catalog.LocalReader(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 1 || m[0].Artifacts[0].UploadedAt.IsZero() {
+		t.Errorf("artifact with a verified local copy not marked uploaded")
+	}
+}
@@ -0,0 +1,198 @@
+package backup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Service outcomes in a report; they match the catalog status values.
+const (
+	StatusSuccess = catalog.StatusSuccess
+	StatusFailed  = catalog.StatusFailed
+	StatusSkipped = catalog.StatusSkipped
+)
+
+// ServiceReport is the outcome of one service in a cycle.
+type ServiceReport struct {
+	Name       string
+	Stage      Stage
+	Status     string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	// Artifacts are the catalog entries the service produced, checksummed.
+	Artifacts []catalog.Artifact
+	// Bytes is the total size of the successful artifacts.
+	Bytes int64
+	// Err is set when the service failed or could not start.
+	Err error
+	// SkipReason explains why a skipped service did not run.
+	SkipReason string
+	// Uploaded and UploadedBytes count the artifacts an upload service sent
+	// and verified; Queued counts those left for a retry.
+	Uploaded      int
+	UploadedBytes int64
+	Queued        int
+	// BestEffort is set when a failure of the service does not fail the cycle.
+	BestEffort bool
+}
+
+// Duration is how long the service ran.
+func (s ServiceReport) Duration() time.Duration {
+	return s.FinishedAt.Sub(s.StartedAt)
+}
+
+// CycleReport collects the outcome of every service that was configured in a
+// backup cycle, in the order they were registered. Services that are not
+// configured and not required do not appear.
+type CycleReport struct {
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Services   []ServiceReport
+}
+
+// Merge appends the services of other and widens the time span to cover it.
+func (r *CycleReport) Merge(other *CycleReport) {
+	if other == nil {
+		return
+	}
+	if r.StartedAt.IsZero() || (!other.StartedAt.IsZero() && other.StartedAt.Before(r.StartedAt)) {
+		r.StartedAt = other.StartedAt
+	}
+	if other.FinishedAt.After(r.FinishedAt) {
+		r.FinishedAt = other.FinishedAt
+	}
+	r.Services = append(r.Services, other.Services...)
+}
+
+// Duration is the wall time of the cycle.
+func (r *CycleReport) Duration() time.Duration {
+	return r.FinishedAt.Sub(r.StartedAt)
+}
+
+// Err joins the errors of all services that are not best effort, prefixed
+// with their names.
+func (r *CycleReport) Err() error {
+	var errs []error
+	for _, s := range r.Services {
+		if s.Err != nil && !s.BestEffort {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name, s.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Status is "failed" if any service that is not best effort failed or could
+// not start, "skipped" if nothing ran, and "success" otherwise.
+func (r *CycleReport) Status() string {
+	ran := false
+	for _, s := range r.Services {
+		if (s.Err != nil || s.Status == StatusFailed) && !s.BestEffort {
+			return StatusFailed
+		}
+		if s.Status == StatusSuccess {
+			ran = true
+		}
+	}
+	if !ran {
+		return StatusSkipped
+	}
+	return StatusSuccess
+}
+
+// Count returns how many services ended with status.
+func (r *CycleReport) Count(status string) int {
+	n := 0
+	for _, s := range r.Services {
+		if s.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// Bytes is the total size of the artifacts written in the cycle.
+func (r *CycleReport) Bytes() int64 {
+	var n int64
+	for _, s := range r.Services {
+		n += s.Bytes
+	}
+	return n
+}
+
+// Artifacts returns the artifacts of every service in the cycle.
+func (r *CycleReport) Artifacts() []catalog.Artifact {
+	var all []catalog.Artifact
+	for _, s := range r.Services {
+		all = append(all, s.Artifacts...)
+	}
+	return all
+}
+
+// Service returns the report of the named service.
+func (r *CycleReport) Service(name string) (ServiceReport, bool) {
+	for _, s := range r.Services {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return ServiceReport{}, false
+}
+
+// MarshalJSON encodes the report with snake_case keys and durations in seconds.
+func (s ServiceReport) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Name       string    `json:"name"`
+		Stage      string    `json:"stage"`
+		Status     string    `json:"status"`
+		StartedAt  time.Time `json:"started_at"`
+		FinishedAt time.Time `json:"finished_at"`
+		Duration   float64   `json:"duration_seconds"`
+		Artifacts  int       `json:"artifacts"`
+		Bytes      int64     `json:"bytes"`
+		Error      string    `json:"error,omitempty"`
+		SkipReason string    `json:"skip_reason,omitempty"`
+		Uploaded   int       `json:"uploaded,omitempty"`
+		UpBytes    int64     `json:"uploaded_bytes,omitempty"`
+		Queued     int       `json:"queued,omitempty"`
+		BestEffort bool      `json:"best_effort,omitempty"`
+	}{
+		Name:       s.Name,
+		Stage:      s.Stage.String(),
+		Status:     s.Status,
+		StartedAt:  s.StartedAt,
+		FinishedAt: s.FinishedAt,
+		Duration:   s.Duration().Seconds(),
+		Artifacts:  len(s.Artifacts),
+		Bytes:      s.Bytes,
+		SkipReason: s.SkipReason,
+		Uploaded:   s.Uploaded,
+		UpBytes:    s.UploadedBytes,
+		Queued:     s.Queued,
+		BestEffort: s.BestEffort,
+	}
+	if s.Err != nil {
+		v.Error = utilities.Redact(s.Err.Error())
+	}
+	return json.Marshal(v)
+}
+
+// MarshalJSON encodes the cycle summary followed by its services.
+func (r *CycleReport) MarshalJSON() ([]byte, error) {
+	services := r.Services
+	if services == nil {
+		services = []ServiceReport{}
+	}
+	return json.Marshal(struct {
+		Status     string          `json:"status"`
+		StartedAt  time.Time       `json:"started_at"`
+		FinishedAt time.Time       `json:"finished_at"`
+		Duration   float64         `json:"duration_seconds"`
+		Bytes      int64           `json:"bytes"`
+		Services   []ServiceReport `json:"services"`
+	}{r.Status(), r.StartedAt, r.FinishedAt, r.Duration().Seconds(), r.Bytes(), services})
+}
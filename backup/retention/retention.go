@@ -0,0 +1,315 @@
+// Package retention decides which artifacts a backup service may delete.
+package retention
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Policy limits the artifacts kept for one service. A zero field does not
+// limit anything.
+//
+// The Keep fields select the artifacts to keep grandfather-father-son style:
+// KeepDaily=7 keeps the newest artifact of each of the last seven days that
+// have one, KeepWeekly=4 the newest of each of the last four ISO weeks, and
+// so on. An artifact is kept when any of them selects it. Without Keep
+// fields every artifact is kept unless MaxAge or MaxSize removes it; those
+// two apply on top of the Keep fields.
+type Policy struct {
+	// KeepLast keeps the newest N artifacts of each source.
+	KeepLast    int
+	KeepHourly  int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	KeepYearly  int
+	// MaxAge removes artifacts older than this.
+	MaxAge time.Duration
+	// MaxSize caps the total size of the service's artifacts in bytes.
+	MaxSize int64
+}
+
+// IsZero reports whether p keeps everything.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// HasKeep reports whether any Keep field is set.
+func (p Policy) HasKeep() bool {
+	return p.KeepLast > 0 || p.KeepHourly > 0 || p.KeepDaily > 0 ||
+		p.KeepWeekly > 0 || p.KeepMonthly > 0 || p.KeepYearly > 0
+}
+
+// String describes p for log messages, e.g. "last 3, daily 7, max age 30d".
+func (p Policy) String() string {
+	var parts []string
+	for _, r := range p.rules() {
+		parts = append(parts, fmt.Sprintf("%s %d", r.name, r.n))
+	}
+	switch day := 24 * time.Hour; {
+	case p.MaxAge > 0 && p.MaxAge%day == 0:
+		parts = append(parts, fmt.Sprintf("max age %dd", p.MaxAge/day))
+	case p.MaxAge > 0:
+		parts = append(parts, "max age "+p.MaxAge.String())
+	}
+	if p.MaxSize > 0 {
+		parts = append(parts, "max size "+utilities.HumanBytes(p.MaxSize))
+	}
+	if len(parts) == 0 {
+		return "keep everything"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// keepSettings maps the setting suffixes to the Keep fields.
+var keepSettings = []struct {
+	suffix string
+	field  func(*Policy) *int
+}{
+	{"KEEP_LAST", func(p *Policy) *int { return &p.KeepLast }},
+	{"KEEP_HOURLY", func(p *Policy) *int { return &p.KeepHourly }},
+	{"KEEP_DAILY", func(p *Policy) *int { return &p.KeepDaily }},
+	{"KEEP_WEEKLY", func(p *Policy) *int { return &p.KeepWeekly }},
+	{"KEEP_MONTHLY", func(p *Policy) *int { return &p.KeepMonthly }},
+	{"KEEP_YEARLY", func(p *Policy) *int { return &p.KeepYearly }},
+}
+
+// LoadLocal reads the local retention of a service from the
+// <prefix>_LOCAL_KEEP_LAST, _LOCAL_KEEP_HOURLY, _LOCAL_KEEP_DAILY,
+// _LOCAL_KEEP_WEEKLY, _LOCAL_KEEP_MONTHLY, _LOCAL_KEEP_YEARLY, _LOCAL_MAX_AGE
+// and _LOCAL_MAX_SIZE settings in env, each falling back to the global
+// setting without the prefix, e.g. LOCAL_KEEP_DAILY.
+func LoadLocal(env utilities.Env, prefix string) (Policy, error) {
+	get := func(suffix string) (string, string) {
+		key := "LOCAL_" + suffix
+		if v := env.Getenv(prefix + "_" + key); v != "" {
+			return prefix + "_" + key, v
+		}
+		return key, os.Getenv(key)
+	}
+
+	var p Policy
+	errs := loadKeep(&p, get)
+	if key, v := get("MAX_AGE"); v != "" {
+		d, err := ParseAge(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+		p.MaxAge = d
+	}
+	if key, v := get("MAX_SIZE"); v != "" {
+		n, err := ParseSize(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s: %w", key, err))
+		}
+		p.MaxSize = n
+	}
+	if err := errors.Join(errs...); err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+// LoadKeep reads the <prefix>_KEEP_LAST, _KEEP_HOURLY, _KEEP_DAILY,
+// _KEEP_WEEKLY, _KEEP_MONTHLY and _KEEP_YEARLY settings in env.
+func LoadKeep(env utilities.Env, prefix string) (Policy, error) {
+	var p Policy
+	errs := loadKeep(&p, func(suffix string) (string, string) {
+		return prefix + "_" + suffix, env.Getenv(prefix + "_" + suffix)
+	})
+	if err := errors.Join(errs...); err != nil {
+		return Policy{}, err
+	}
+	return p, nil
+}
+
+func loadKeep(p *Policy, get func(suffix string) (key, value string)) []error {
+	var errs []error
+	for _, s := range keepSettings {
+		key, v := get(s.suffix)
+		if v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			errs = append(errs, fmt.Errorf("invalid %s %q: expected a positive number", key, v))
+		}
+		*s.field(p) = n
+	}
+	return errs
+}
+
+// ParseAge reads a duration given in days ("30d"), weeks ("2w") or any unit
+// time.ParseDuration accepts ("36h").
+func ParseAge(s string) (time.Duration, error) {
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(s, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(s, "w"):
+		unit = 7 * 24 * time.Hour
+	}
+	if unit != 0 {
+		n, err := strconv.Atoi(s[:len(s)-1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("%q: expected e.g. 30d, 2w or 36h", s)
+		}
+		return time.Duration(n) * unit, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("%q: expected e.g. 30d, 2w or 36h", s)
+	}
+	return d, nil
+}
+
+// ParseSize reads a byte count with an optional binary unit, e.g. "500M",
+// "10GiB" or "1T".
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mult := int64(1)
+	if i := strings.IndexAny(num, "KMGT"); i >= 0 && i == len(num)-1 {
+		mult = 1 << (10 * (strings.IndexByte("KMGT", num[i]) + 1))
+		num = num[:i]
+	}
+	v, err := strconv.ParseFloat(strings.TrimSpace(num), 64)
+	if err != nil || v <= 0 {
+		return 0, fmt.Errorf("%q: expected e.g. 500M or 10G", s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// Item is an artifact retention decides about.
+type Item struct {
+	// Path identifies the artifact, locally or on a remote.
+	Path string
+	// Source groups the artifacts of one database, folder or log; the Keep
+	// rules count per source.
+	Source string
+	// Time is when the artifact was written.
+	Time time.Time
+	Size int64
+}
+
+// nameTimestamp matches the timestamp hyper-backup puts into artifact names,
+// e.g. app_20240131_020000.sql.gz or access.log.20240131_020000.
+var nameTimestamp = regexp.MustCompile(`^(.+)[._](\d{8}_\d{6})(\..*)?$`)
+
+// ParseName splits an artifact file name into the name it was derived from
+// and the time stamped into it, read in the local time zone.
+func ParseName(name string) (base string, t time.Time, ok bool) {
+	m := nameTimestamp.FindStringSubmatch(path.Base(name))
+	if m == nil {
+		return "", time.Time{}, false
+	}
+	t, err := time.ParseInLocation("20060102_150405", m[2], time.Local)
+	if err != nil {
+		return "", time.Time{}, false
+	}
+	return m[1], t, true
+}
+
+// FromArtifact describes a catalog artifact for Select. The time comes from
+// its name when it has one, otherwise from when it finished.
+func FromArtifact(a catalog.Artifact) Item {
+	it := Item{Path: a.Path, Source: a.Source, Time: a.FinishedAt, Size: a.Size}
+	if _, t, ok := ParseName(a.Path); ok {
+		it.Time = t
+	}
+	return it
+}
+
+type rule struct {
+	name   string
+	n      int
+	bucket func(time.Time) string
+}
+
+func (p Policy) rules() []rule {
+	all := []rule{
+		{"last", p.KeepLast, nil},
+		{"hourly", p.KeepHourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{"daily", p.KeepDaily, func(t time.Time) string { return t.Format("20060102") }},
+		{"weekly", p.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", y, w)
+		}},
+		{"monthly", p.KeepMonthly, func(t time.Time) string { return t.Format("200601") }},
+		{"yearly", p.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+	var rules []rule
+	for _, r := range all {
+		if r.n > 0 {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// Select returns the items p removes. The newest item of each source is
+// always kept, so a policy never leaves a source without a backup.
+func Select(p Policy, items []Item, now time.Time) []Item {
+	sorted := append([]Item(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Time.After(sorted[j].Time)
+	})
+
+	type state struct {
+		seen int
+		left []int
+		last []string
+	}
+	rules := p.rules()
+	sources := map[string]*state{}
+
+	var remove []Item
+	var total int64
+	for _, it := range sorted {
+		st := sources[it.Source]
+		if st == nil {
+			st = &state{left: make([]int, len(rules)), last: make([]string, len(rules))}
+			for i, r := range rules {
+				st.left[i] = r.n
+			}
+			sources[it.Source] = st
+		}
+		st.seen++
+
+		keep := len(rules) == 0
+		for i, r := range rules {
+			if st.left[i] == 0 {
+				continue
+			}
+			bucket := strconv.Itoa(st.seen)
+			if r.bucket != nil {
+				bucket = r.bucket(it.Time)
+			}
+			if bucket != st.last[i] {
+				st.last[i] = bucket
+				st.left[i]--
+				keep = true
+			}
+		}
+		if p.MaxAge > 0 && now.Sub(it.Time) > p.MaxAge ||
+			p.MaxSize > 0 && total+it.Size > p.MaxSize {
+			keep = false
+		}
+
+		if st.seen > 1 && !keep {
+			remove = append(remove, it)
+			continue
+		}
+		total += it.Size
+	}
+	return remove
+}
@@ -0,0 +1,131 @@
+package retention
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSelect(t *testing.T) {
+	now := time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC)
+	at := func(s string) time.Time {
+		parsed, err := time.Parse("2006-01-02 15:04", s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	// item names an artifact of source written at when
+	item := func(source, when string, size int64) Item {
+		return Item{Path: source + " " + when, Source: source, Time: at(when), Size: size}
+	}
+	ago := func(source string, d time.Duration, size int64) Item {
+		return item(source, now.Add(-d).Format("2006-01-02 15:04"), size)
+	}
+
+	tests := []struct {
+		name   string
+		policy Policy
+		items  []Item
+		remove []string
+	}{
+		{
+			name:   "empty policy keeps everything",
+			policy: Policy{},
+			items:  []Item{item("db", "2020-01-01 00:00", 1), item("db", "2026-01-01 00:00", 1)},
+		},
+		{
+			name:   "keep last counts per source",
+			policy: Policy{KeepLast: 2},
+			items: []Item{
+				item("db", "2026-01-01 00:00", 1),
+				item("db", "2026-01-04 00:00", 1),
+				item("db", "2026-01-02 00:00", 1),
+				item("db", "2026-01-03 00:00", 1),
+				item("logs", "2025-06-01 00:00", 1),
+			},
+			remove: []string{"db 2026-01-02 00:00", "db 2026-01-01 00:00"},
+		},
+		{
+			name:   "keep daily takes the newest of each day",
+			policy: Policy{KeepDaily: 2},
+			items: []Item{
+				item("db", "2026-01-09 02:00", 1),
+				item("db", "2026-01-09 14:00", 1),
+				item("db", "2026-01-08 02:00", 1),
+				item("db", "2026-01-08 14:00", 1),
+				item("db", "2026-01-07 14:00", 1),
+			},
+			remove: []string{"db 2026-01-09 02:00", "db 2026-01-08 02:00", "db 2026-01-07 14:00"},
+		},
+		{
+			name:   "keep weekly uses ISO weeks across the new year",
+			policy: Policy{KeepWeekly: 2},
+			items: []Item{
+				item("db", "2026-01-04 00:00", 1), // Sunday, 2026-W01
+				item("db", "2026-01-01 00:00", 1), // 2026-W01
+				item("db", "2025-12-29 00:00", 1), // Monday, 2026-W01
+				item("db", "2025-12-28 00:00", 1), // Sunday, 2025-W52
+				item("db", "2025-12-22 00:00", 1), // 2025-W52
+				item("db", "2025-12-21 00:00", 1), // 2025-W51
+			},
+			remove: []string{"db 2026-01-01 00:00", "db 2025-12-29 00:00", "db 2025-12-22 00:00", "db 2025-12-21 00:00"},
+		},
+		{
+			name:   "keep rules add up",
+			policy: Policy{KeepLast: 1, KeepMonthly: 2},
+			items: []Item{
+				item("db", "2026-01-09 00:00", 1),
+				item("db", "2026-01-08 00:00", 1),
+				item("db", "2025-12-31 00:00", 1),
+				item("db", "2025-12-01 00:00", 1),
+				item("db", "2025-11-30 00:00", 1),
+			},
+			remove: []string{"db 2026-01-08 00:00", "db 2025-12-01 00:00", "db 2025-11-30 00:00"},
+		},
+		{
+			name:   "max age overrides keep rules",
+			policy: Policy{KeepLast: 10, MaxAge: 48 * time.Hour},
+			items:  []Item{ago("db", time.Hour, 1), ago("db", 30*time.Hour, 1), ago("db", 50*time.Hour, 1), ago("db", 100*time.Hour, 1)},
+			remove: []string{"db 2026-01-08 10:00", "db 2026-01-06 08:00"},
+		},
+		{
+			name:   "max size counts the kept items of every source",
+			policy: Policy{KeepDaily: 10, MaxSize: 100},
+			items: []Item{
+				item("db", "2026-01-09 00:00", 40),
+				item("logs", "2026-01-08 00:00", 40),
+				item("db", "2026-01-07 00:00", 40),
+				item("logs", "2026-01-06 00:00", 10),
+			},
+			remove: []string{"db 2026-01-07 00:00"},
+		},
+		{
+			name:   "the newest item of each source survives max age",
+			policy: Policy{MaxAge: time.Hour},
+			items: []Item{
+				item("db", "2026-01-01 00:00", 1),
+				item("db", "2026-01-02 00:00", 1),
+				item("logs", "2025-01-01 00:00", 1),
+			},
+			remove: []string{"db 2026-01-01 00:00"},
+		},
+		{
+			name:   "the newest item survives max size",
+			policy: Policy{MaxSize: 100},
+			items:  []Item{item("db", "2026-01-02 00:00", 500), item("db", "2026-01-01 00:00", 10)},
+			remove: []string{"db 2026-01-01 00:00"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, it := range Select(tt.policy, tt.items, now) {
+				got = append(got, it.Path)
+			}
+			if !slices.Equal(got, tt.remove) {
+				t.Errorf("Select removes %q, want %q", got, tt.remove)
+			}
+		})
+	}
+}
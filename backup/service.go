@@ -1,42 +1,62 @@
 package backup
 
 import (
+	"context"
+
 	db "github.com/fvoci/hyper-backup/backup/database"
 	"github.com/fvoci/hyper-backup/backup/traefik"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
-// RunCoreServices executes core backup components and returns any error encountered.
-func RunCoreServices() error {
+func init() {
+	Register(StageCore, &envService{
+		name:         "MySQL",
+		kind:         "mysql",
+		anyKeys:      []string{"MYSQL_HOST", "MYSQL_DSN"},
+		timeoutKey:   "MYSQL_TIMEOUT",
+		retentionKey: "MYSQL",
+		dirKey:       "MYSQL_BACKUP_DIR",
+		run:          db.RunMySQL,
+		validate:     db.ValidateMySQL,
+	})
+	Register(StageCore, &envService{
+		name:         "PostgreSQL",
+		kind:         "postgres",
+		anyKeys:      []string{"POSTGRES_HOST", "POSTGRES_DSN"},
+		timeoutKey:   "POSTGRES_TIMEOUT",
+		retentionKey: "POSTGRES",
+		dirKey:       "POSTGRES_BACKUP_DIR",
+		run:          db.RunPostgres,
+		validate:     db.ValidatePostgres,
+	})
+	Register(StageCore, &envService{
+		name:         "MongoDB",
+		kind:         "mongo",
+		anyKeys:      []string{"MONGO_HOST", "MONGO_URI"},
+		timeoutKey:   "MONGO_TIMEOUT",
+		retentionKey: "MONGO",
+		dirKey:       "MONGO_BACKUP_DIR",
+		run:          db.RunMongo,
+		validate:     db.ValidateMongo,
+	})
+	Register(StageCore, &envService{
+		name:         "Traefik",
+		kind:         "traefik",
+		envKeys:      []string{"TRAEFIK_LOG_FILE"},
+		timeoutKey:   "TRAEFIK_TIMEOUT",
+		retentionKey: "TRAEFIK",
+		dirKey:       "TRAEFIK_BACKUP_DIR",
+		run:          traefik.LogrotateAndNotify,
+		validate:     traefik.ValidateLogrotate,
+	})
+}
+
+// RunCoreServices executes core backup components and reports on each of them.
+// Cancelling ctx stops the running service and skips the remaining ones.
+func RunCoreServices(ctx context.Context) *CycleReport {
 	utilities.LogDivider()
 	utilities.Logger.Info("🔧 [Core Services]")
 
-	services := []service{
-		{
-			Name:     "MySQL",
-			EnvKeys:  []string{"MYSQL_HOST"},
-			RunFunc:  db.RunMySQL,
-			Optional: true,
-		},
-		{
-			Name:     "PostgreSQL",
-			EnvKeys:  []string{"POSTGRES_HOST"},
-			RunFunc:  db.RunPostgres,
-			Optional: true,
-		},
-		{
-			Name:     "MongoDB",
-			EnvKeys:  []string{"MONGO_HOST"},
-			RunFunc:  db.RunMongo,
-			Optional: true,
-		},
-		{
-			Name:     "Traefik",
-			EnvKeys:  []string{"TRAEFIK_LOG_FILE"},
-			RunFunc:  traefik.LogrotateAndNotify,
-			Optional: true,
-		},
-	}
-
-	return runServices(services)
+	startUploadPipeline(ctx)
+	return runServices(ctx, StageCore)
 }
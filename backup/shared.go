@@ -1,63 +1,687 @@
 package backup
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/metrics"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
-type service struct {
-	Name     string
-	EnvKeys  []string
-	RunFunc  func() error
-	Optional bool
+// Service is a unit of backup work run by the orchestrator. Built-in database,
+// folder and storage runners implement it, and programs embedding hyper-backup
+// can add their own through Register.
+type Service interface {
+	// Name identifies the service in logs and the catalog.
+	Name() string
+	// Configured reports whether enough settings are present to run the service.
+	Configured() bool
+	// Validate checks the settings in depth without side effects.
+	Validate() error
+	// Run performs the backup and reports what it produced.
+	Run(ctx context.Context) (Result, error)
 }
 
-func runServices(services []service) error {
+// RequiredService is implemented by services that must be configured;
+// an unconfigured required service fails the cycle instead of being skipped.
+type RequiredService interface {
+	Required() bool
+}
+
+// TimeoutService is implemented by services with a run time limit.
+// A zero duration means no limit.
+type TimeoutService interface {
+	Timeout() time.Duration
+}
+
+// ScheduledService is implemented by services that run on a cron schedule of
+// their own instead of in every cycle. An empty schedule means every cycle.
+type ScheduledService interface {
+	Schedule() string
+}
+
+// RetentionService is implemented by services whose local artifacts are
+// pruned by a retention policy once they have been uploaded.
+type RetentionService interface {
+	LocalRetention() (retention.Policy, error)
+}
+
+// BestEffortService is implemented by services whose failure is reported but
+// does not fail the cycle, such as a secondary upload destination.
+type BestEffortService interface {
+	BestEffort() bool
+}
+
+// DependentService is implemented by services that have to wait for others.
+type DependentService interface {
+	DependsOn() []Dependency
+}
+
+// Dependency names a service that must finish before the dependent one starts.
+// Services of earlier stages have always finished; unconfigured or unknown
+// services are ignored.
+type Dependency struct {
+	Service string
+	// RequireSuccess skips the dependent service when the dependency failed
+	// or was skipped in the current cycle.
+	RequireSuccess bool
+}
+
+// Result is what a service produced in one run.
+type Result struct {
+	Artifacts []catalog.Artifact
+	// Transfer is what an upload service sent to its destination.
+	Transfer storage.Transfer
+}
+
+// Stage determines when a service runs within a backup cycle.
+type Stage int
+
+const (
+	// StageCore services dump databases and rotate logs.
+	StageCore Stage = iota
+	// StageFiles services archive folders after the core services.
+	StageFiles
+	// StageStorage services upload or sync everything produced before them.
+	StageStorage
+)
+
+func (s Stage) String() string {
+	switch s {
+	case StageCore:
+		return "core"
+	case StageFiles:
+		return "files"
+	case StageStorage:
+		return "storage"
+	default:
+		return fmt.Sprintf("stage(%d)", int(s))
+	}
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[Stage][]Service{}
+)
+
+// Register adds a service to a stage. Services run in registration order.
+// It panics if a service with the same name is already registered.
+func Register(stage Stage, svc Service) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	if svc == nil {
+		panic("backup: Register service is nil")
+	}
+	for _, list := range registry {
+		for _, existing := range list {
+			if existing.Name() == svc.Name() {
+				panic("backup: Register called twice for service " + svc.Name())
+			}
+		}
+	}
+	registry[stage] = append(registry[stage], svc)
+}
+
+// Services returns the services registered for a stage.
+func Services(stage Stage) []Service {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return append([]Service(nil), registry[stage]...)
+}
+
+// Lookup finds a registered service by name, ignoring case, and its stage.
+func Lookup(name string) (Service, Stage, bool) {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for stage, list := range registry {
+		for _, svc := range list {
+			if strings.EqualFold(svc.Name(), name) {
+				return svc, stage, true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// RunService runs a single configured service outside its stage, for example
+// when triggered manually. It does not wait for dependencies.
+func RunService(ctx context.Context, name string) (*CycleReport, error) {
+	svc, stage, ok := Lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown service %q", name)
+	}
+	if !svc.Configured() {
+		return nil, fmt.Errorf("service %s is not configured", svc.Name())
+	}
+
+	report := &CycleReport{StartedAt: time.Now()}
+	r := runService(ctx, svc)
+	r.Stage = stage
+	metrics.ObserveService(r.Name, stage.String(), r.Status, r.FinishedAt, r.Duration(), r.Bytes)
+	report.Services = append(report.Services, r)
+	report.FinishedAt = time.Now()
+	return report, nil
+}
+
+type selectionKey struct{}
+
+// WithServices restricts the runners called with the returned context to the
+// named services (case-insensitive). Other services are left out as if they
+// were not configured; named services that are not configured fail.
+func WithServices(ctx context.Context, names ...string) context.Context {
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[strings.ToLower(n)] = true
+	}
+	return context.WithValue(ctx, selectionKey{}, set)
+}
+
+type scheduledKey struct{}
+
+// ExcludeScheduled leaves services with a schedule of their own (see
+// ScheduledService) out of runs with the returned context, unless they are
+// selected with WithServices. The daemon uses it for its regular cycles.
+func ExcludeScheduled(ctx context.Context) context.Context {
+	return context.WithValue(ctx, scheduledKey{}, true)
+}
+
+// ValidateSelection checks that every name refers to a registered service.
+func ValidateSelection(names []string) error {
 	var errs []error
-	executed := 0
+	for _, n := range names {
+		if _, _, ok := Lookup(n); !ok {
+			errs = append(errs, fmt.Errorf("unknown service %q", n))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selection reports whether ctx restricts services and whether svc is selected.
+func selection(ctx context.Context, svc Service) (restricted, selected bool) {
+	set, ok := ctx.Value(selectionKey{}).(map[string]bool)
+	if !ok {
+		return false, true
+	}
+	return true, set[strings.ToLower(svc.Name())]
+}
 
+var (
+	activeMu sync.Mutex
+	active   = map[string]time.Time{}
+)
+
+// Active returns the services running right now and when each started.
+func Active() map[string]time.Time {
+	activeMu.Lock()
+	defer activeMu.Unlock()
+	out := make(map[string]time.Time, len(active))
+	for name, started := range active {
+		out[name] = started
+	}
+	return out
+}
+
+// runServices runs the configured services of one stage and reports on each.
+// With BACKUP_CONCURRENCY=N (default 1) up to N services run at the same time.
+// Services start in registration order unless a dependency has to finish
+// first; it always waits for all of them, and reports keep registration order.
+func runServices(ctx context.Context, stage Stage) *CycleReport {
+	report := &CycleReport{StartedAt: time.Now()}
+	defer func() { report.FinishedAt = time.Now() }()
+
+	services := Services(stage)
+	order, err := dependencyOrder(services)
+	if err != nil {
+		utilities.Logger.Errorf("[HyperBackup] ❌ %v", err)
+		for _, svc := range services {
+			if svc.Configured() || isRequired(svc) {
+				report.Services = append(report.Services, failedReport(svc.Name(), stage, err))
+			}
+		}
+		return report
+	}
+
+	results := make([]*ServiceReport, len(services))
+	done := make(map[string]chan struct{}, len(services))
 	for _, svc := range services {
-		if shouldRun(svc.EnvKeys...) {
-			utilities.Logger.Infof("[%s] ▶️ Starting backup...", svc.Name)
-			if err := safeRunWithError(svc.Name, svc.RunFunc); err != nil {
-				utilities.Logger.Errorf("[%s] ❌ Backup failed: %v", svc.Name, err)
-				errs = append(errs, fmt.Errorf("%s: %w", svc.Name, err))
+		done[svc.Name()] = make(chan struct{})
+	}
+	sem := make(chan struct{}, concurrencyLimit())
+	var wg sync.WaitGroup
+
+	for _, i := range order {
+		svc := services[i]
+		name := svc.Name()
+		restricted, _ := selection(ctx, svc)
+		if !inCycle(ctx, svc) {
+			close(done[name])
+			continue
+		}
+		if !svc.Configured() {
+			if isRequired(svc) || restricted {
+				err := fmt.Errorf("required service not configured")
+				if restricted {
+					err = fmt.Errorf("selected service not configured")
+				}
+				utilities.Logger.Errorf("[%s] ❌ %v", name, err)
+				r := failedReport(name, stage, err)
+				results[i] = &r
 			}
-			executed++
-		} else if !svc.Optional {
-			msg := fmt.Errorf("required service not configured")
-			utilities.Logger.Errorf("[%s] ❌ %v", svc.Name, msg)
-			errs = append(errs, fmt.Errorf("%s: %w", svc.Name, msg))
+			close(done[name])
+			continue
+		}
+
+		// A service waits for its dependencies in its own goroutine, so the
+		// loop goes on with the independent ones. Those that can start right
+		// away take their slot here, which keeps them in order.
+		deps := dependencies(svc)
+		ready := finished(done, deps)
+		if ready {
+			sem <- struct{}{}
 		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[name])
+			if !ready {
+				for _, d := range deps {
+					if ch, ok := done[d.Service]; ok {
+						<-ch
+					}
+				}
+				sem <- struct{}{}
+			}
+			defer func() { <-sem }()
+
+			if dep := unmetDependency(deps); dep != "" {
+				reason := fmt.Sprintf("dependency %s did not succeed", dep)
+				utilities.Logger.Warnf("[%s] ⏭️ Skipped: %s", name, reason)
+				now := time.Now()
+				catalog.Add(catalog.Artifact{Service: name, StartedAt: now, FinishedAt: now, Status: catalog.StatusSkipped, Error: reason})
+				results[i] = &ServiceReport{Name: name, Stage: stage, Status: StatusSkipped, StartedAt: now, FinishedAt: now, SkipReason: reason}
+				return
+			}
+			r := runService(ctx, svc)
+			r.Stage = stage
+			results[i] = &r
+		}()
 	}
+	wg.Wait()
 
-	if executed == 0 && len(errs) == 0 {
+	for _, r := range results {
+		if r != nil {
+			metrics.ObserveService(r.Name, stage.String(), r.Status, r.FinishedAt, r.Duration(), r.Bytes)
+			report.Services = append(report.Services, *r)
+		}
+	}
+	if _, restricted := ctx.Value(selectionKey{}).(map[string]bool); len(report.Services) == 0 && !restricted {
 		utilities.Logger.Warn("🤷 No services matched conditions")
 	}
+	return report
+}
+
+func failedReport(name string, stage Stage, err error) ServiceReport {
+	now := time.Now()
+	return ServiceReport{Name: name, Stage: stage, Status: StatusFailed, StartedAt: now, FinishedAt: now, Err: err}
+}
+
+// inCycle reports whether svc takes part in the cycle run with ctx.
+func inCycle(ctx context.Context, svc Service) bool {
+	restricted, selected := selection(ctx, svc)
+	excluded, _ := ctx.Value(scheduledKey{}).(bool)
+	return selected && (restricted || !excluded || schedule(svc) == "")
+}
+
+func schedule(svc Service) string {
+	if s, ok := svc.(ScheduledService); ok {
+		return s.Schedule()
+	}
+	return ""
+}
+
+func dependencies(svc Service) []Dependency {
+	if d, ok := svc.(DependentService); ok {
+		return d.DependsOn()
+	}
+	return nil
+}
+
+// dependencyOrder sorts services so that each comes after its dependencies
+// within the same stage, otherwise keeping registration order.
+func dependencyOrder(services []Service) ([]int, error) {
+	index := make(map[string]int, len(services))
+	for i, svc := range services {
+		index[svc.Name()] = i
+	}
+
+	placed := make([]bool, len(services))
+	order := make([]int, 0, len(services))
+	for len(order) < len(services) {
+		progress := false
+		for i, svc := range services {
+			if placed[i] || !depsPlaced(svc, index, placed) {
+				continue
+			}
+			placed[i] = true
+			order = append(order, i)
+			progress = true
+			break
+		}
+		if !progress {
+			var names []string
+			for i, svc := range services {
+				if !placed[i] {
+					names = append(names, svc.Name())
+				}
+			}
+			return nil, fmt.Errorf("dependency cycle between services %v", names)
+		}
+	}
+	return order, nil
+}
+
+func depsPlaced(svc Service, index map[string]int, placed []bool) bool {
+	for _, d := range dependencies(svc) {
+		if j, ok := index[d.Service]; ok && !placed[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// finished reports whether every registered service in deps has finished.
+func finished(done map[string]chan struct{}, deps []Dependency) bool {
+	for _, d := range deps {
+		ch, ok := done[d.Service]
+		if !ok {
+			continue
+		}
+		select {
+		case <-ch:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unmetDependency returns the first dependency that had to succeed but failed
+// or was skipped in the current cycle.
+func unmetDependency(deps []Dependency) string {
+	for _, d := range deps {
+		if d.RequireSuccess && catalog.Failed(d.Service) {
+			return d.Service
+		}
+	}
+	return ""
+}
+
+// runService runs one configured service and records what it produced.
+func runService(ctx context.Context, svc Service) ServiceReport {
+	name := svc.Name()
+	started := time.Now()
+	if err := ctx.Err(); err != nil {
+		utilities.Logger.Warnf("[%s] 🛑 Not started: %v", name, err)
+		return ServiceReport{Name: name, Status: StatusSkipped, StartedAt: started, FinishedAt: started, Err: err, SkipReason: "cycle cancelled"}
+	}
+
+	utilities.Logger.Infof("[%s] ▶️ Starting backup...", name)
+	activeMu.Lock()
+	active[name] = started
+	activeMu.Unlock()
+	defer func() {
+		activeMu.Lock()
+		delete(active, name)
+		activeMu.Unlock()
+	}()
+
+	res, err := runWithTimeout(ctx, svc)
+	artifacts, cerr := recordArtifacts(name, res.Artifacts, started, err)
+	err = errors.Join(err, cerr)
+	report := ServiceReport{Name: name, Status: StatusSuccess, StartedAt: started, FinishedAt: time.Now(), Err: err, BestEffort: isBestEffort(svc)}
+	report.Uploaded, report.UploadedBytes, report.Queued = res.Transfer.Uploaded, res.Transfer.Bytes, res.Transfer.Queued
+	report.Artifacts = artifacts
+	for _, a := range report.Artifacts {
+		if a.Status == catalog.StatusSuccess {
+			report.Bytes += a.Size
+		}
+	}
+	switch {
+	case err != nil && report.BestEffort:
+		report.Status = StatusFailed
+		utilities.Logger.Warnf("[%s] ⚠️ Backup failed, continuing as it is best effort: %v", name, err)
+	case err != nil:
+		report.Status = StatusFailed
+		utilities.Logger.Errorf("[%s] ❌ Backup failed: %v", name, err)
+	}
+	return report
+}
+
+// concurrencyLimit reads BACKUP_CONCURRENCY; anything invalid means sequential.
+func concurrencyLimit() int {
+	str := os.Getenv("BACKUP_CONCURRENCY")
+	if str == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(str)
+	if err != nil || n < 1 {
+		utilities.Logger.Warnf("[HyperBackup] ⚠️ Invalid BACKUP_CONCURRENCY '%s'. Running services one at a time", str)
+		return 1
+	}
+	return n
+}
+
+// runWithTimeout runs svc under its own deadline, if it has one.
+func runWithTimeout(ctx context.Context, svc Service) (Result, error) {
+	var timeout time.Duration
+	if t, ok := svc.(TimeoutService); ok {
+		timeout = t.Timeout()
+	}
+	if timeout <= 0 {
+		return safeRunWithError(ctx, svc)
+	}
+
+	runCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	res, err := safeRunWithError(runCtx, svc)
+	if err != nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		err = fmt.Errorf("timed out after %s: %w", timeout, err)
+	}
+	return res, err
+}
+
+func isRequired(svc Service) bool {
+	r, ok := svc.(RequiredService)
+	return ok && r.Required()
+}
+
+func isBestEffort(svc Service) bool {
+	b, ok := svc.(BestEffortService)
+	return ok && b.BestEffort()
+}
+
+// recordArtifacts completes the artifacts reported by a service and adds them
+// to the catalog. A failed service without artifacts still gets an entry so the
+// manifest shows its exit status. An artifact that cannot be checksummed is
+// recorded as failed, since no copy of it could be verified, and never
+// uploaded. It returns the completed artifacts and the checksum errors.
+func recordArtifacts(name string, artifacts []catalog.Artifact, started time.Time, runErr error) ([]catalog.Artifact, error) {
+	finished := time.Now()
+	if runErr != nil && len(artifacts) == 0 {
+		artifacts = []catalog.Artifact{{}}
+	}
+
+	recorded := make([]catalog.Artifact, 0, len(artifacts))
+	var errs []error
+	for _, a := range artifacts {
+		if a.Service == "" {
+			a.Service = name
+		}
+		if a.StartedAt.IsZero() {
+			a.StartedAt = started
+		}
+		if a.FinishedAt.IsZero() {
+			a.FinishedAt = finished
+		}
+		if a.Status == "" {
+			a.Status = catalog.StatusSuccess
+			if runErr != nil {
+				a.Status = catalog.StatusFailed
+				a.Error = utilities.Redact(runErr.Error())
+			}
+		}
+		if a.Status == catalog.StatusSuccess && a.Path != "" {
+			if err := a.Describe(); err != nil {
+				a.Status = catalog.StatusFailed
+				a.Error = fmt.Sprintf("checksum: %v", err)
+				errs = append(errs, fmt.Errorf("checksum %s: %w", a.Path, err))
+			}
+		}
+		catalog.Add(a)
+		// Enqueue after Add, so the worker can record the verified upload
+		if a.Status == catalog.StatusSuccess && a.Path != "" {
+			storage.Enqueue(a)
+		}
+		recorded = append(recorded, a)
+	}
+	return recorded, errors.Join(errs...)
+}
+
+// envService adapts a built-in runner to its settings. Services registered at
+// start-up read the environment and are enabled once all envKeys and at least
+// one of anyKeys are set; instances from a config file carry their own
+// settings in env and are always enabled. timeoutKey names the setting
+// holding the time limit, e.g. MYSQL_TIMEOUT=30m, and retentionKey the prefix
+// of the local retention settings, e.g. MYSQL for MYSQL_LOCAL_KEEP_LAST.
+// dirKey names the setting holding a custom backup directory, e.g.
+// MYSQL_BACKUP_DIR. bestEffortKey names the setting that makes a failure not fail the cycle,
+// e.g. S3_BEST_EFFORT=true.
+// Upload services set upload instead of run to report what they sent.
+type envService struct {
+	name          string
+	kind          string
+	envKeys       []string
+	anyKeys       []string
+	timeoutKey    string
+	retentionKey  string
+	dirKey        string
+	bestEffortKey string
+	env           utilities.Env
+	instance      bool
+	schedule      string
+	dependsOn     func() []Dependency
+	run           func(context.Context, utilities.Env) ([]catalog.Artifact, error)
+	upload        func(context.Context, utilities.Env) (storage.Transfer, error)
+	validate      func(utilities.Env) error
+}
+
+func (s *envService) Name() string { return s.name }
+
+func (s *envService) Configured() bool {
+	if s.instance {
+		return true
+	}
+	if !shouldRun(s.env, s.envKeys...) {
+		return false
+	}
+	for _, k := range s.anyKeys {
+		if s.env.Getenv(k) != "" {
+			return true
+		}
+	}
+	return len(s.anyKeys) == 0
+}
 
+func (s *envService) Validate() error {
+	var errs []error
+	if s.validate != nil {
+		errs = append(errs, s.validate(s.env))
+	}
+	if _, err := s.LocalRetention(); err != nil {
+		errs = append(errs, err)
+	}
 	return errors.Join(errs...)
 }
 
-func shouldRun(keys ...string) bool {
+func (s *envService) LocalRetention() (retention.Policy, error) {
+	if s.retentionKey == "" {
+		return retention.Policy{}, nil
+	}
+	return retention.LoadLocal(s.env, s.retentionKey)
+}
+
+func (s *envService) Schedule() string { return s.schedule }
+
+func (s *envService) Timeout() time.Duration {
+	if s.timeoutKey == "" {
+		return 0
+	}
+	str := s.env.Getenv(s.timeoutKey)
+	if str == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(str)
+	if err != nil || d < 0 {
+		utilities.Logger.Warnf("[%s] ⚠️ Invalid %s '%s', running without a timeout", s.name, s.timeoutKey, str)
+		return 0
+	}
+	return d
+}
+
+func (s *envService) BestEffort() bool {
+	return s.bestEffortKey != "" && s.env.Getenv(s.bestEffortKey) == "true"
+}
+
+func (s *envService) DependsOn() []Dependency {
+	if s.dependsOn == nil {
+		return nil
+	}
+	return s.dependsOn()
+}
+
+func (s *envService) Run(ctx context.Context) (Result, error) {
+	if s.upload != nil {
+		t, err := s.upload(ctx, s.env)
+		return Result{Transfer: t}, err
+	}
+	artifacts, err := s.run(ctx, s.env)
+	return Result{Artifacts: artifacts}, err
+}
+
+// noArtifacts adapts runners that upload or sync data but produce no files.
+func noArtifacts(fn func(context.Context, utilities.Env) error) func(context.Context, utilities.Env) ([]catalog.Artifact, error) {
+	return func(ctx context.Context, env utilities.Env) ([]catalog.Artifact, error) {
+		return nil, fn(ctx, env)
+	}
+}
+
+func shouldRun(env utilities.Env, keys ...string) bool {
 	for _, k := range keys {
-		if os.Getenv(k) == "" {
+		if env.Getenv(k) == "" {
 			return false
 		}
 	}
 	return true
 }
 
-func safeRunWithError(name string, fn func() error) (err error) {
+func safeRunWithError(ctx context.Context, svc Service) (res Result, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			stack := debug.Stack()
-			utilities.Logger.Errorf("[%s] 💥 panic recovered: %v\n%s", name, r, stack)
-			err = fmt.Errorf("panic in [%s]: %v\n%s", name, r, string(stack))
+			utilities.Logger.Errorf("[%s] 💥 panic recovered: %v\n%s", svc.Name(), r, stack)
+			err = fmt.Errorf("panic in [%s]: %v\n%s", svc.Name(), r, string(stack))
 		}
 	}()
-	return fn()
+	return svc.Run(ctx)
 }
@@ -0,0 +1,432 @@
+package backup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+)
+
+// testService is a Service whose outcome is set by the test. It records its
+// name in ran once its hook returned.
+type testService struct {
+	name       string
+	unset      bool
+	required   bool
+	err        error
+	panicValue any
+	hook       func()
+	deps       []Dependency
+	ran        *ranList
+}
+
+type ranList struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (r *ranList) add(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.names = append(r.names, name)
+}
+
+func (s *testService) Name() string     { return s.name }
+func (s *testService) Configured() bool { return !s.unset }
+func (s *testService) Validate() error  { return nil }
+func (s *testService) Required() bool   { return s.required }
+
+func (s *testService) DependsOn() []Dependency { return s.deps }
+
+func (s *testService) Run(ctx context.Context) (Result, error) {
+	if s.hook != nil {
+		s.hook()
+	}
+	if s.ran != nil {
+		s.ran.add(s.name)
+	}
+	if s.panicValue != nil {
+		panic(s.panicValue)
+	}
+	return Result{}, s.err
+}
+
+// runStage registers services in a stage of their own and runs it.
+func runStage(t *testing.T, services ...Service) *CycleReport {
+	t.Helper()
+	stage := Stage(101)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(registry, stage)
+	})
+	for _, svc := range services {
+		Register(stage, svc)
+	}
+	return runServices(context.Background(), stage)
+}
+
+// outcomes lists the services of report as "name status".
+func outcomes(report *CycleReport) []string {
+	var list []string
+	for _, s := range report.Services {
+		list = append(list, s.Name+" "+s.Status)
+	}
+	return list
+}
+
+// mustPanic returns the message fn panics with.
+func mustPanic(t *testing.T, fn func()) (msg string) {
+	t.Helper()
+	defer func() {
+		msg, _ = recover().(string)
+	}()
+	fn()
+	t.Fatal("no panic")
+	return ""
+}
+
+func TestRegister(t *testing.T) {
+	stage := Stage(100)
+	t.Cleanup(func() {
+		registryMu.Lock()
+		defer registryMu.Unlock()
+		delete(registry, stage)
+	})
+	Register(stage, &testService{name: "test-register-b"})
+	Register(stage, &testService{name: "test-register-a"})
+
+	var names []string
+	for _, svc := range Services(stage) {
+		names = append(names, svc.Name())
+	}
+	if !slices.Equal(names, []string{"test-register-b", "test-register-a"}) {
+		t.Errorf("Services = %v, want registration order", names)
+	}
+	Services(stage)[0] = nil
+	if Services(stage)[0] == nil {
+		t.Error("Services returned the registry itself")
+	}
+	if stage.String() != "stage(100)" || StageStorage.String() != "storage" {
+		t.Errorf("stage names %s, %s", stage, StageStorage)
+	}
+
+	if msg := mustPanic(t, func() { Register(StageCore, &testService{name: "test-register-a"}) }); !strings.Contains(msg, "called twice") {
+		t.Errorf("duplicate name panics with %q", msg)
+	}
+	if msg := mustPanic(t, func() { Register(stage, nil) }); !strings.Contains(msg, "nil") {
+		t.Errorf("nil service panics with %q", msg)
+	}
+}
+
+func TestRunServices(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	t.Setenv("BACKUP_CONCURRENCY", "")
+
+	tests := []struct {
+		name     string
+		services []testService
+		ran      []string
+		outcomes []string
+		errs     []string
+	}{
+		{
+			name:     "all succeed in order",
+			services: []testService{{name: "a"}, {name: "b"}},
+			ran:      []string{"a", "b"},
+			outcomes: []string{"a success", "b success"},
+		},
+		{
+			name:     "a failure does not stop the others",
+			services: []testService{{name: "a", err: errors.New("dump failed")}, {name: "b"}},
+			ran:      []string{"a", "b"},
+			outcomes: []string{"a failed", "b success"},
+			errs:     []string{"a: dump failed"},
+		},
+		{
+			name:     "a panic is recovered",
+			services: []testService{{name: "a", panicValue: "boom"}, {name: "b"}},
+			ran:      []string{"a", "b"},
+			outcomes: []string{"a failed", "b success"},
+			errs:     []string{"panic in [a]: boom"},
+		},
+		{
+			name:     "unconfigured services are left out",
+			services: []testService{{name: "a", unset: true}, {name: "b"}},
+			ran:      []string{"b"},
+			outcomes: []string{"b success"},
+		},
+		{
+			name:     "an unconfigured required service fails",
+			services: []testService{{name: "a", unset: true, required: true}, {name: "b"}},
+			ran:      []string{"b"},
+			outcomes: []string{"a failed", "b success"},
+			errs:     []string{"a: required service not configured"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := &ranList{}
+			var services []Service
+			for _, svc := range tt.services {
+				svc.ran = ran
+				services = append(services, &svc)
+			}
+
+			report := runStage(t, services...)
+			if !slices.Equal(ran.names, tt.ran) {
+				t.Errorf("ran %v, want %v", ran.names, tt.ran)
+			}
+			if got := outcomes(report); !slices.Equal(got, tt.outcomes) {
+				t.Errorf("report lists %v, want %v", got, tt.outcomes)
+			}
+			err := report.Err()
+			if len(tt.errs) == 0 && err != nil {
+				t.Errorf("report error: %v", err)
+			}
+			for _, want := range tt.errs {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("report error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int
+	}{
+		{"", 1},
+		{"1", 1},
+		{"4", 4},
+		{"0", 1},
+		{"-2", 1},
+		{"many", 1},
+	}
+	for _, tt := range tests {
+		t.Setenv("BACKUP_CONCURRENCY", tt.value)
+		if got := concurrencyLimit(); got != tt.want {
+			t.Errorf("BACKUP_CONCURRENCY=%q gives %d, want %d", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestRunServicesConcurrency(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+
+	tests := []struct {
+		limit    string
+		services int
+		want     int
+	}{
+		{"", 4, 1},
+		{"2", 5, 2},
+		{"8", 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s of %d", tt.limit, tt.services), func(t *testing.T) {
+			t.Setenv("BACKUP_CONCURRENCY", tt.limit)
+			var mu sync.Mutex
+			running, peak := 0, 0
+			hook := func() {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				mu.Unlock()
+				time.Sleep(20 * time.Millisecond)
+				mu.Lock()
+				running--
+				mu.Unlock()
+			}
+
+			ran := &ranList{}
+			var services []Service
+			for i := range tt.services {
+				services = append(services, &testService{name: fmt.Sprint(i), hook: hook, ran: ran})
+			}
+			if err := runStage(t, services...).Err(); err != nil {
+				t.Fatal(err)
+			}
+			if len(ran.names) != tt.services {
+				t.Errorf("ran %d services, want %d", len(ran.names), tt.services)
+			}
+			if peak != tt.want {
+				t.Errorf("%d services ran at once, want %d", peak, tt.want)
+			}
+		})
+	}
+}
+
+func TestDependencyOrder(t *testing.T) {
+	on := func(names ...string) []Dependency {
+		var deps []Dependency
+		for _, name := range names {
+			deps = append(deps, Dependency{Service: name})
+		}
+		return deps
+	}
+
+	tests := []struct {
+		name     string
+		services []testService
+		want     []string
+		wantErr  string
+	}{
+		{
+			name:     "registration order without dependencies",
+			services: []testService{{name: "a"}, {name: "b"}, {name: "c"}},
+			want:     []string{"a", "b", "c"},
+		},
+		{
+			name:     "a dependency moves ahead",
+			services: []testService{{name: "a"}, {name: "b", deps: on("c")}, {name: "c"}},
+			want:     []string{"a", "c", "b"},
+		},
+		{
+			name:     "chains resolve",
+			services: []testService{{name: "a", deps: on("b")}, {name: "b", deps: on("c")}, {name: "c"}},
+			want:     []string{"c", "b", "a"},
+		},
+		{
+			name:     "unknown services are ignored",
+			services: []testService{{name: "a", deps: on("MySQL", "missing")}, {name: "b"}},
+			want:     []string{"a", "b"},
+		},
+		{
+			name:     "a cycle is an error",
+			services: []testService{{name: "a"}, {name: "b", deps: on("c")}, {name: "c", deps: on("b")}},
+			wantErr:  "dependency cycle between services [b c]",
+		},
+		{
+			name:     "a service depending on itself is a cycle",
+			services: []testService{{name: "a", deps: on("a")}},
+			wantErr:  "dependency cycle between services [a]",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var services []Service
+			for _, svc := range tt.services {
+				services = append(services, &svc)
+			}
+			order, err := dependencyOrder(services)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, i := range order {
+				names = append(names, services[i].Name())
+			}
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("order = %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunServicesDependencies(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	t.Setenv("BACKUP_CONCURRENCY", "4")
+	failure := errors.New("dump failed")
+
+	tests := []struct {
+		name     string
+		depErr   error
+		require  bool
+		ran      []string
+		outcomes []string
+	}{
+		{name: "waits for its dependency", ran: []string{"dump", "upload"}, outcomes: []string{"upload success", "dump success"}},
+		{name: "runs after a failed dependency", depErr: failure, ran: []string{"dump", "upload"}, outcomes: []string{"upload success", "dump failed"}},
+		{name: "require success after success", require: true, ran: []string{"dump", "upload"}, outcomes: []string{"upload success", "dump success"}},
+		{name: "require success skips after a failure", depErr: failure, require: true, ran: []string{"dump"}, outcomes: []string{"upload skipped", "dump failed"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			catalog.Begin(time.Now())
+			t.Cleanup(func() { catalog.End(time.Now()) })
+
+			ran := &ranList{}
+			slow := func() { time.Sleep(20 * time.Millisecond) }
+			report := runStage(t,
+				&testService{name: "upload", deps: []Dependency{{Service: "dump", RequireSuccess: tt.require}}, ran: ran},
+				&testService{name: "dump", err: tt.depErr, hook: slow, ran: ran},
+			)
+
+			if !slices.Equal(ran.names, tt.ran) {
+				t.Errorf("ran %v, want %v", ran.names, tt.ran)
+			}
+			if got := outcomes(report); !slices.Equal(got, tt.outcomes) {
+				t.Errorf("report lists %v, want %v", got, tt.outcomes)
+			}
+			if upload, _ := report.Service("upload"); upload.Status == StatusSkipped && upload.SkipReason != "dependency dump did not succeed" {
+				t.Errorf("skip reason = %q", upload.SkipReason)
+			}
+		})
+	}
+}
+
+func TestRunServicesWaitingDoesNotBlock(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	t.Setenv("BACKUP_CONCURRENCY", "2")
+	catalog.Begin(time.Now())
+	t.Cleanup(func() { catalog.End(time.Now()) })
+
+	ran := &ranList{}
+	slow := func() { time.Sleep(50 * time.Millisecond) }
+	report := runStage(t,
+		&testService{name: "dump", hook: slow, ran: ran},
+		&testService{name: "upload", deps: []Dependency{{Service: "dump"}}, ran: ran},
+		&testService{name: "other", ran: ran},
+	)
+	if err := report.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// other takes the free slot while upload waits for dump
+	if want := []string{"other", "dump", "upload"}; !slices.Equal(ran.names, want) {
+		t.Errorf("ran %v, want %v", ran.names, want)
+	}
+}
+
+func TestRecordArtifacts(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("CATALOG_DIR", dir)
+	catalog.Begin(time.Now())
+	t.Cleanup(func() { catalog.End(time.Now()) })
+
+	written := filepath.Join(dir, "db.sql.zst")
+	if err := os.WriteFile(written, []byte("rows"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "gone.sql.zst")
+
+	recorded, err := recordArtifacts("MySQL", []catalog.Artifact{{Path: written}, {Path: missing}}, time.Now(), nil)
+	if err == nil || !strings.Contains(err.Error(), "checksum "+missing) {
+		t.Errorf("error = %v, want the checksum failure of %s", err, missing)
+	}
+	if a := recorded[0]; a.Status != catalog.StatusSuccess || a.Size != 4 || a.SHA256 == "" {
+		t.Errorf("described artifact = %+v", a)
+	}
+	if a := recorded[1]; a.Status != catalog.StatusFailed || !strings.HasPrefix(a.Error, "checksum: ") {
+		t.Errorf("undescribed artifact = %+v, want it failed", a)
+	}
+	if !catalog.Failed("MySQL") {
+		t.Error("catalog does not list the failure")
+	}
+}
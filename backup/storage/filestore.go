@@ -0,0 +1,281 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// fileStore is a directory tree that receives uploads, such as a local or
+// mounted path. Paths are slash-separated and relative to its root.
+type fileStore interface {
+	// Create starts writing rel under a temporary name, creating its parent
+	// directories. The file only appears under rel once committed.
+	Create(rel string) (storeWriter, error)
+	Open(rel string) (io.ReadCloser, error)
+	Remove(rel string) error
+	// List returns the files below dir; a missing dir has none.
+	List(dir string) ([]remoteFile, error)
+}
+
+// storeWriter is a file being written to a fileStore.
+type storeWriter interface {
+	io.Writer
+	// Commit makes the file durable and moves it into place.
+	Commit() error
+	// Abort stops writing the file; it does nothing after a successful
+	// Commit. Stores that resume keep what was written.
+	Abort()
+}
+
+// resumingStore is a fileStore that keeps the temporary file of an
+// interrupted upload, so the next attempt only sends the rest.
+type resumingStore interface {
+	fileStore
+	// Resume continues writing rel after what an earlier attempt left and
+	// returns how many bytes that is. Anything longer than size is discarded.
+	Resume(rel string, size int64) (storeWriter, int64, error)
+}
+
+// copyBuffer is large enough for network stores to read ahead.
+const copyBuffer = 1 << 20
+
+// storeFile writes the file of a to its place in store, encrypted with enc if
+// set, and reads the copy back to check it. tag prefixes log messages.
+func storeFile(ctx context.Context, tag string, store fileStore, a catalog.Artifact, enc *encrypt.Config) (int64, error) {
+	p, err := openPayload(a, enc)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	var w storeWriter
+	var done int64
+	// Encrypted copies differ on every attempt, so only plain ones resume
+	if rs, ok := store.(resumingStore); ok && p.Encryption == "" {
+		w, done, err = rs.Resume(p.Rel, a.Size)
+	} else {
+		w, err = store.Create(p.Rel)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer w.Abort()
+	if done > 0 {
+		utilities.Logger.Infof("[%s] ⏯️ Resuming %s after %s", tag, p.Rel, utilities.HumanBytes(done))
+		// Still read the start, so the whole file is checked against the catalog
+		if _, err := io.CopyN(io.Discard, p, done); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := io.Copy(w, &ctxReader{ctx: ctx, r: p}); err != nil {
+		return 0, err
+	}
+	// Only a copy of the recorded file may take the final name
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+	if err := w.Commit(); err != nil {
+		return 0, err
+	}
+
+	r, err := store.Open(p.Rel)
+	if err != nil {
+		return 0, fmt.Errorf("verify: %w", err)
+	}
+	defer r.Close()
+	h := sha256.New()
+	n, err := io.CopyBuffer(h, &ctxReader{ctx: ctx, r: r}, make([]byte, copyBuffer))
+	switch {
+	case err != nil:
+		return 0, fmt.Errorf("verify: %w", err)
+	case n != p.Size():
+		return 0, fmt.Errorf("verify: copy is %d bytes, expected %d", n, p.Size())
+	case hex.EncodeToString(h.Sum(nil)) != p.SHA256():
+		return 0, errors.New("verify: copy does not match its checksum")
+	}
+	return n, nil
+}
+
+// storeCatalog copies the catalog files that changed since store got them
+// last: those whose size differs or that are newer than the stored copy.
+func storeCatalog(ctx context.Context, tag string, store fileStore) error {
+	dir := catalog.Dir()
+	rel, err := relPath(dir)
+	if err != nil {
+		return err
+	}
+	existing, err := store.List(rel)
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]remoteFile, len(existing))
+	for _, f := range existing {
+		stored[f.Path] = f
+	}
+
+	utilities.Logger.Infof("[%s] 🗂️ Uploading catalog %s", tag, dir)
+	var errs []error
+	err = filepath.WalkDir(dir, func(local string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(local, ".tmp") || local == queuePath() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := relPath(local)
+		if err != nil {
+			return nil
+		}
+		if f, ok := stored[rel]; ok && f.Size == info.Size() && !info.ModTime().After(f.ModTime) {
+			return nil
+		}
+		if err := copyToStore(store, local, rel); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+		}
+		return nil
+	})
+	return errors.Join(append(errs, err)...)
+}
+
+func copyToStore(store fileStore, local, rel string) error {
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w, err := store.Create(rel)
+	if err != nil {
+		return err
+	}
+	defer w.Abort()
+	if _, err := io.Copy(w, f); err != nil {
+		return err
+	}
+	return w.Commit()
+}
+
+// pruneStore deletes the files policy drops from store.
+func pruneStore(tag, target string, store fileStore, policy retention.Policy, dryRun bool) error {
+	if policy.IsZero() {
+		return nil
+	}
+	files, err := store.List("")
+	if err != nil {
+		return err
+	}
+	return pruneFiles(tag, target, policy, files, dryRun, store.Remove)
+}
+
+// storeRemote reads back the uploads of store, decrypting the copies it
+// encrypted with enc.
+func storeRemote(name string, store fileStore, enc *encrypt.Config) (*Remote, error) {
+	dir, err := relPath(catalog.Dir())
+	if err != nil {
+		return nil, err
+	}
+	read := func(rel string) ([]byte, error) {
+		r, err := store.Open(path.Join(dir, rel))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	open := func(local string) (io.ReadCloser, error) {
+		rel, method, err := remoteCopy(local, enc)
+		if err != nil {
+			return nil, err
+		}
+		r, err := store.Open(rel)
+		if err != nil {
+			return nil, err
+		}
+		return decrypting(method, enc, r)
+	}
+	return &Remote{Name: name, Catalog: read, Open: open}, nil
+}
+
+// dirStore is a fileStore on a local or mounted directory.
+type dirStore struct {
+	root string
+}
+
+func (s dirStore) path(rel string) string {
+	return filepath.Join(s.root, filepath.FromSlash(rel))
+}
+
+func (s dirStore) Create(rel string) (storeWriter, error) {
+	p := s.path(rel)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return nil, err
+	}
+	return utilities.CreateAtomic(p)
+}
+
+func (s dirStore) Open(rel string) (io.ReadCloser, error) {
+	return os.Open(s.path(rel))
+}
+
+func (s dirStore) Remove(rel string) error {
+	return os.Remove(s.path(rel))
+}
+
+func (s dirStore) List(dir string) ([]remoteFile, error) {
+	var files []remoteFile
+	err := filepath.WalkDir(s.path(dir), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(s.root, p)
+		files = append(files, remoteFile{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	return files, err
+}
+
+// ctxReader stops a copy once ctx is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
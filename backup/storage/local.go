@@ -0,0 +1,132 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+type localConfig struct {
+	// Path is the root of the copies, e.g. an NFS mount.
+	Path      string
+	Retention retention.Policy
+	// Encrypt encrypts the copies; nil copies artifacts as they are.
+	Encrypt *encrypt.Config
+}
+
+func loadLocalConfig(env utilities.Env) (*localConfig, error) {
+	dir := env.Getenv("LOCAL_DEST_PATH")
+	if dir == "" {
+		return nil, fmt.Errorf("LOCAL_DEST_PATH must be set")
+	}
+	if !filepath.IsAbs(dir) {
+		return nil, fmt.Errorf("LOCAL_DEST_PATH must be an absolute path, got %q", dir)
+	}
+	dir = filepath.Clean(dir)
+	if utilities.IsWithin(dir, backupDir) || utilities.IsWithin(backupDir, dir) {
+		return nil, fmt.Errorf("LOCAL_DEST_PATH %s overlaps the backup directory %s", dir, backupDir)
+	}
+
+	policy, err := loadRemoteRetention(env, "LOCAL_DEST", 0)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encrypt.LoadEnv(env, "LOCAL_DEST")
+	if err != nil {
+		return nil, err
+	}
+	return &localConfig{Path: dir, Retention: policy, Encrypt: enc}, nil
+}
+
+// destination copies artifacts into the directory once it is present. The
+// directory is never created, so an unmounted share fails the upload instead
+// of filling the local disk.
+func (cfg *localConfig) destination() *destination {
+	store := dirStore{root: cfg.Path}
+	return &destination{
+		tag:    "Local",
+		target: cfg.Path,
+		check: func(ctx context.Context) error {
+			fi, err := os.Stat(cfg.Path)
+			if err != nil {
+				return err
+			}
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", cfg.Path)
+			}
+			return nil
+		},
+		upload: func(ctx context.Context, a catalog.Artifact) (int64, error) {
+			return storeFile(ctx, "Local", store, a, cfg.Encrypt)
+		},
+		syncCatalog: func(ctx context.Context) error {
+			return storeCatalog(ctx, "Local", store)
+		},
+	}
+}
+
+// RunLocal copies the artifacts the directory configured by LOCAL_DEST_PATH
+// in env has not received yet, verifies each copy, copies the catalog and then
+// applies the LOCAL_DEST_KEEP_* retention.
+func RunLocal(ctx context.Context, env utilities.Env) (Transfer, error) {
+	cfg, err := loadLocalConfig(env)
+	if err != nil {
+		utilities.Logger.Errorf("[Local] ❌ Configuration error: %v", err)
+		return Transfer{}, err
+	}
+
+	return cfg.destination().run(ctx, func(dryRun bool) error {
+		return pruneStore("Local", cfg.Path, dirStore{root: cfg.Path}, cfg.Retention, dryRun)
+	})
+}
+
+// ValidateLocal reports whether the LOCAL_DEST_* settings are complete and
+// the directory, if present, is writable. A missing directory is left to the
+// cycle, which queues the uploads until the share is mounted.
+func ValidateLocal(env utilities.Env) error {
+	cfg, err := loadLocalConfig(env)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(cfg.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("LOCAL_DEST_PATH: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("LOCAL_DEST_PATH: %s is not a directory", cfg.Path)
+	}
+	return utilities.CheckWritable(cfg.Path)
+}
+
+// PruneLocal applies the retention policy to the directory configured in
+// env. With dryRun it only logs what it would delete.
+func PruneLocal(ctx context.Context, env utilities.Env, dryRun bool) error {
+	cfg, err := loadLocalConfig(env)
+	if err != nil {
+		return err
+	}
+	return pruneStore("Local", cfg.Path, dirStore{root: cfg.Path}, cfg.Retention, dryRun)
+}
+
+// LocalRemote reads back the copies in the directory configured in env.
+func LocalRemote(ctx context.Context, env utilities.Env) (*Remote, error) {
+	cfg, err := loadLocalConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(cfg.Path); err != nil {
+		return nil, err
+	}
+	return storeRemote(cfg.Path, dirStore{root: cfg.Path}, cfg.Encrypt)
+}
@@ -0,0 +1,117 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// queueSize bounds how many artifacts can wait for upload. Anything beyond it
+// is left to the final pass over the pending artifacts.
+const queueSize = 256
+
+// uploadQueue uploads artifacts one by one while the rest of the cycle runs.
+type uploadQueue struct {
+	dest  *destination
+	items chan catalog.Artifact
+	done  chan struct{}
+	// sent is what the worker uploaded; read it once done is closed.
+	sent Transfer
+}
+
+var (
+	queueMu sync.Mutex
+	queues  = map[string]*uploadQueue{}
+)
+
+// StartUploads starts uploading artifacts to the destination of kind
+// configured in env (see PerArtifact) as soon as they are passed to Enqueue.
+// The worker stops when ctx is cancelled or when the destination's run drains
+// the queue at the end of the cycle. Each destination gets its own queue.
+func StartUploads(ctx context.Context, kind string, env utilities.Env) error {
+	d, err := loadDestination(ctx, kind, env)
+	if err != nil {
+		return err
+	}
+	if d == nil {
+		return fmt.Errorf("%s cannot upload while the cycle runs", kind)
+	}
+	startQueue(ctx, d)
+	return nil
+}
+
+func startQueue(ctx context.Context, d *destination) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if old := queues[d.target]; old != nil {
+		close(old.items)
+	}
+	q := &uploadQueue{
+		dest:  d,
+		items: make(chan catalog.Artifact, queueSize),
+		done:  make(chan struct{}),
+	}
+	queues[d.target] = q
+	go q.run(ctx)
+
+	utilities.Logger.Infof("[%s] ⏫ Uploading artifacts to %s as they are produced", d.tag, d.target)
+}
+
+// Enqueue schedules an artifact, already recorded in the catalog, for upload
+// to every started destination. It does nothing when StartUploads was not
+// called or the file lies outside the uploaded tree, and never blocks the
+// producing service.
+func Enqueue(a catalog.Artifact) {
+	queueMu.Lock()
+	defer queueMu.Unlock()
+	if !utilities.IsWithin(a.Path, backupDir) {
+		return
+	}
+	for target, q := range queues {
+		select {
+		case q.items <- a:
+		default:
+			utilities.Logger.Warnf("[%s] ⚠️ Upload queue for %s full; %s will be uploaded at the end of the cycle", q.dest.tag, target, a.Path)
+		}
+	}
+}
+
+// drainUploads stops accepting artifacts for target, waits for its queued
+// uploads to finish and returns what they sent.
+func drainUploads(target string) Transfer {
+	queueMu.Lock()
+	q := queues[target]
+	delete(queues, target)
+	if q != nil {
+		close(q.items)
+	}
+	queueMu.Unlock()
+
+	if q == nil {
+		return Transfer{}
+	}
+	<-q.done
+	return q.sent
+}
+
+func (q *uploadQueue) run(ctx context.Context) {
+	defer close(q.done)
+	defer q.dest.release()
+	for a := range q.items {
+		if ctx.Err() != nil {
+			continue
+		}
+		// Failures are only logged: the final pass picks the artifact up again
+		size, err := deliver(ctx, q.dest.target, a, q.dest.upload)
+		if err != nil {
+			utilities.Logger.Warnf("[%s] ⚠️ Early upload of %s failed: %v", q.dest.tag, a.Path, err)
+			continue
+		}
+		q.sent.Uploaded++
+		q.sent.Bytes += size
+		utilities.Logger.Infof("[%s] ⏫ Uploaded and verified %s", q.dest.tag, a.Path)
+	}
+}
@@ -0,0 +1,299 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// queueFile lists the failed uploads waiting for a retry. It lives next to
+// the catalog, so it survives restarts, but is not uploaded with it.
+const queueFile = "upload-queue.json"
+
+const (
+	defaultRetryAttempts   = 10
+	defaultRetryBackoff    = 5 * time.Minute
+	defaultRetryMaxBackoff = 6 * time.Hour
+	defaultStuckAfter      = 24 * time.Hour
+)
+
+// QueuedUpload is an artifact whose upload to a destination failed and is
+// waiting to be retried.
+type QueuedUpload struct {
+	Path   string `json:"path"`
+	Target string `json:"target"`
+	// Attempts counts the failed attempts, in cycles and retries.
+	Attempts    int       `json:"attempts"`
+	FirstFailed time.Time `json:"first_failed"`
+	LastFailed  time.Time `json:"last_failed"`
+	LastError   string    `json:"last_error"`
+	// NextAttempt is when the upload is retried between cycles.
+	NextAttempt time.Time `json:"next_attempt,omitzero"`
+	// GaveUp is set once UPLOAD_RETRY_MAX_ATTEMPTS attempts failed; the
+	// upload is then only retried on request.
+	GaveUp bool `json:"gave_up,omitempty"`
+	// Notified is set once the upload was reported as stuck.
+	Notified bool `json:"notified,omitempty"`
+}
+
+// retryQueueMu serializes the updates of the queue file.
+var retryQueueMu sync.Mutex
+
+func queuePath() string {
+	return filepath.Join(catalog.Dir(), queueFile)
+}
+
+// QueuedUploads returns the failed uploads waiting for a retry.
+func QueuedUploads() ([]QueuedUpload, error) {
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+	return loadQueue()
+}
+
+func loadQueue() ([]QueuedUpload, error) {
+	data, err := os.ReadFile(queuePath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read upload queue: %w", err)
+	}
+	var entries []QueuedUpload
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("parse upload queue: %w", err)
+	}
+	return entries, nil
+}
+
+// updateQueue calls fn with the queued uploads and saves them when it
+// returns true.
+func updateQueue(fn func(entries *[]QueuedUpload) bool) error {
+	retryQueueMu.Lock()
+	defer retryQueueMu.Unlock()
+
+	entries, err := loadQueue()
+	if err != nil {
+		return err
+	}
+	if !fn(&entries) {
+		return nil
+	}
+	if len(entries) == 0 {
+		if err := os.Remove(queuePath()); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(catalog.Dir(), 0755); err != nil {
+		return err
+	}
+	// Replace atomically so a crash never leaves half a queue
+	tmp := queuePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, queuePath())
+}
+
+func findQueued(entries []QueuedUpload, path, target string) int {
+	for i, e := range entries {
+		if e.Path == path && e.Target == target {
+			return i
+		}
+	}
+	return -1
+}
+
+// queueFailure records a failed attempt to upload a to target and schedules
+// the next one, or gives up after UPLOAD_RETRY_MAX_ATTEMPTS attempts. It
+// returns the updated entry.
+func queueFailure(tag, target string, a catalog.Artifact, cause error) QueuedUpload {
+	policy, err := loadRetryPolicy()
+	if err != nil {
+		utilities.Logger.Warnf("[%s] ⚠️ %v", tag, err)
+	}
+
+	now := time.Now()
+	var entry QueuedUpload
+	err = updateQueue(func(entries *[]QueuedUpload) bool {
+		i := findQueued(*entries, a.Path, target)
+		if i < 0 {
+			*entries = append(*entries, QueuedUpload{Path: a.Path, Target: target, FirstFailed: now})
+			i = len(*entries) - 1
+		}
+		e := &(*entries)[i]
+		e.Attempts++
+		e.LastFailed = now
+		e.LastError = utilities.Redact(cause.Error())
+		if policy.attempts > 0 && e.Attempts >= policy.attempts {
+			e.GaveUp, e.NextAttempt = true, time.Time{}
+		} else {
+			e.NextAttempt = now.Add(policy.delay(e.Attempts))
+		}
+		entry = *e
+		return true
+	})
+	if err != nil {
+		utilities.Logger.Warnf("[%s] ⚠️ Failed to queue %s for retry: %v", tag, a.Path, err)
+	}
+	return entry
+}
+
+// retryDue reports whether a queued upload to target is due for a retry.
+func retryDue(target string) bool {
+	entries, err := QueuedUploads()
+	if err != nil {
+		return true
+	}
+	now := time.Now()
+	for _, e := range entries {
+		if e.Target == target && !e.GaveUp && !e.NextAttempt.After(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// unqueue drops the queued uploads to target of the given paths.
+func unqueue(tag, target string, paths ...string) {
+	err := updateQueue(func(entries *[]QueuedUpload) bool {
+		changed := false
+		for _, path := range paths {
+			if i := findQueued(*entries, path, target); i >= 0 {
+				*entries = append((*entries)[:i], (*entries)[i+1:]...)
+				changed = true
+			}
+		}
+		return changed
+	})
+	if err != nil {
+		utilities.Logger.Warnf("[%s] ⚠️ Failed to update the upload queue: %v", tag, err)
+	}
+}
+
+// ForgetUploads drops the queued uploads to destinations other than targets.
+func ForgetUploads(targets []string) {
+	err := updateQueue(func(entries *[]QueuedUpload) bool {
+		n := len(*entries)
+		*entries = slices.DeleteFunc(*entries, func(e QueuedUpload) bool {
+			return !slices.Contains(targets, e.Target)
+		})
+		return len(*entries) != n
+	})
+	if err != nil {
+		utilities.Logger.Warnf("[HyperBackup] ⚠️ Failed to update the upload queue: %v", err)
+	}
+}
+
+// StuckUploads returns the queued uploads that have been failing for longer
+// than UPLOAD_STUCK_AFTER and were not reported yet, and marks them reported.
+func StuckUploads() ([]QueuedUpload, error) {
+	after, err := loadStuckAfter()
+	if err != nil {
+		return nil, err
+	}
+	if after == 0 {
+		return nil, nil
+	}
+
+	var stuck []QueuedUpload
+	now := time.Now()
+	err = updateQueue(func(entries *[]QueuedUpload) bool {
+		for i := range *entries {
+			e := &(*entries)[i]
+			if !e.Notified && now.Sub(e.FirstFailed) >= after {
+				e.Notified = true
+				stuck = append(stuck, *e)
+			}
+		}
+		return len(stuck) > 0
+	})
+	return stuck, err
+}
+
+// retryPolicy spaces out the retries of a failed upload.
+type retryPolicy struct {
+	// attempts is the number of failed attempts before giving up; 0 retries
+	// forever.
+	attempts   int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// delay is the wait after the given number of failed attempts: the backoff,
+// doubled with every further attempt up to the maximum.
+func (p retryPolicy) delay(attempts int) time.Duration {
+	d := p.backoff
+	for i := 1; i < attempts && d < p.maxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, p.maxBackoff)
+}
+
+// loadRetryPolicy reads UPLOAD_RETRY_MAX_ATTEMPTS, UPLOAD_RETRY_BACKOFF and
+// UPLOAD_RETRY_MAX_BACKOFF. Invalid values are reported and replaced by the
+// defaults.
+func loadRetryPolicy() (retryPolicy, error) {
+	p := retryPolicy{attempts: defaultRetryAttempts, backoff: defaultRetryBackoff, maxBackoff: defaultRetryMaxBackoff}
+	var errs []error
+	if str := os.Getenv("UPLOAD_RETRY_MAX_ATTEMPTS"); str != "" {
+		if n, err := strconv.Atoi(str); err != nil || n < 0 {
+			errs = append(errs, fmt.Errorf("invalid UPLOAD_RETRY_MAX_ATTEMPTS '%s': expected a number, 0 for no limit", str))
+		} else {
+			p.attempts = n
+		}
+	}
+	for _, s := range []struct {
+		key string
+		d   *time.Duration
+	}{{"UPLOAD_RETRY_BACKOFF", &p.backoff}, {"UPLOAD_RETRY_MAX_BACKOFF", &p.maxBackoff}} {
+		if str := os.Getenv(s.key); str != "" {
+			if d, err := retention.ParseAge(str); err != nil {
+				errs = append(errs, fmt.Errorf("invalid %s: %w", s.key, err))
+			} else {
+				*s.d = d
+			}
+		}
+	}
+	p.maxBackoff = max(p.maxBackoff, p.backoff)
+	return p, errors.Join(errs...)
+}
+
+// loadStuckAfter reads UPLOAD_STUCK_AFTER; "0" turns the reports off.
+func loadStuckAfter() (time.Duration, error) {
+	str := os.Getenv("UPLOAD_STUCK_AFTER")
+	switch str {
+	case "":
+		return defaultStuckAfter, nil
+	case "0":
+		return 0, nil
+	}
+	d, err := retention.ParseAge(str)
+	if err != nil {
+		return defaultStuckAfter, fmt.Errorf("invalid UPLOAD_STUCK_AFTER: %w", err)
+	}
+	return d, nil
+}
+
+// ValidateRetry reports invalid upload retry settings.
+func ValidateRetry() error {
+	_, err := loadRetryPolicy()
+	_, serr := loadStuckAfter()
+	return errors.Join(err, serr)
+}
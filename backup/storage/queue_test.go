@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+)
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{backoff: 5 * time.Minute, maxBackoff: time.Hour}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{3, 20 * time.Minute},
+		{4, 40 * time.Minute},
+		{5, time.Hour},
+		{50, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := p.delay(tt.attempts); got != tt.want {
+			t.Errorf("delay after %d attempts = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestLoadRetryPolicy(t *testing.T) {
+	tests := []struct {
+		name                          string
+		attempts, backoff, maxBackoff string
+		want                          retryPolicy
+		wantErr                       string
+	}{
+		{name: "defaults", want: retryPolicy{defaultRetryAttempts, defaultRetryBackoff, defaultRetryMaxBackoff}},
+		{name: "set", attempts: "3", backoff: "30s", maxBackoff: "1h", want: retryPolicy{3, 30 * time.Second, time.Hour}},
+		{name: "no limit", attempts: "0", want: retryPolicy{0, defaultRetryBackoff, defaultRetryMaxBackoff}},
+		{name: "backoff above the maximum", backoff: "12h", want: retryPolicy{defaultRetryAttempts, 12 * time.Hour, 12 * time.Hour}},
+		{
+			name:     "invalid values",
+			attempts: "-1", backoff: "soon",
+			want:    retryPolicy{defaultRetryAttempts, defaultRetryBackoff, defaultRetryMaxBackoff},
+			wantErr: "invalid UPLOAD_RETRY_MAX_ATTEMPTS '-1'",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("UPLOAD_RETRY_MAX_ATTEMPTS", tt.attempts)
+			t.Setenv("UPLOAD_RETRY_BACKOFF", tt.backoff)
+			t.Setenv("UPLOAD_RETRY_MAX_BACKOFF", tt.maxBackoff)
+			p, err := loadRetryPolicy()
+			if p != tt.want {
+				t.Errorf("policy = %+v, want %+v", p, tt.want)
+			}
+			if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestQueueFailure(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	t.Setenv("UPLOAD_RETRY_MAX_ATTEMPTS", "3")
+	t.Setenv("UPLOAD_RETRY_BACKOFF", "1m")
+	t.Setenv("UPLOAD_RETRY_MAX_BACKOFF", "")
+	a := catalog.Artifact{Path: "/backups/db.sql.zst"}
+	other := catalog.Artifact{Path: "/backups/files.tar.gz"}
+
+	tests := []struct {
+		delay  time.Duration
+		gaveUp bool
+	}{
+		{time.Minute, false},
+		{2 * time.Minute, false},
+		{0, true},
+	}
+	var first time.Time
+	for i, tt := range tests {
+		before := time.Now()
+		e := queueFailure("test", "s3://bucket", a, errors.New("connection refused"))
+		if i == 0 {
+			first = e.FirstFailed
+		}
+		if e.Attempts != i+1 || !e.FirstFailed.Equal(first) || e.LastError != "connection refused" {
+			t.Errorf("attempt %d queued %+v", i+1, e)
+		}
+		if e.GaveUp != tt.gaveUp {
+			t.Errorf("attempt %d: GaveUp = %v, want %v", i+1, e.GaveUp, tt.gaveUp)
+		}
+		if wait := e.NextAttempt.Sub(before); tt.delay == 0 && !e.NextAttempt.IsZero() || tt.delay != 0 && (wait < tt.delay || wait > tt.delay+time.Minute) {
+			t.Errorf("attempt %d: next attempt in %v, want %v", i+1, wait, tt.delay)
+		}
+		if retryDue("s3://bucket") {
+			t.Errorf("attempt %d: retry due before the backoff expired", i+1)
+		}
+	}
+
+	queueFailure("test", "remote:backups", other, errors.New("timeout"))
+	queueFailure("test", "s3://bucket", other, errors.New("timeout"))
+	unqueue("test", "s3://bucket", a.Path)
+	ForgetUploads([]string{"s3://bucket"})
+	entries, err := QueuedUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Path != other.Path || entries[0].Target != "s3://bucket" {
+		t.Errorf("queue = %+v, want only %s to s3://bucket", entries, other.Path)
+	}
+
+	unqueue("test", "s3://bucket", other.Path)
+	if entries, err := QueuedUploads(); err != nil || len(entries) != 0 {
+		t.Errorf("queue = %+v, %v, want it empty", entries, err)
+	}
+}
+
+func TestStuckUploads(t *testing.T) {
+	t.Setenv("CATALOG_DIR", t.TempDir())
+	t.Setenv("UPLOAD_STUCK_AFTER", "1h")
+	now := time.Now()
+	err := updateQueue(func(entries *[]QueuedUpload) bool {
+		*entries = []QueuedUpload{
+			{Path: "/backups/old.sql.zst", Target: "s3://bucket", FirstFailed: now.Add(-2 * time.Hour)},
+			{Path: "/backups/new.sql.zst", Target: "s3://bucket", FirstFailed: now.Add(-time.Minute)},
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stuck, err := StuckUploads()
+	if err != nil || len(stuck) != 1 || stuck[0].Path != "/backups/old.sql.zst" || !stuck[0].Notified {
+		t.Fatalf("StuckUploads = %+v, %v, want old.sql.zst", stuck, err)
+	}
+	if stuck, err := StuckUploads(); err != nil || len(stuck) != 0 {
+		t.Errorf("second StuckUploads = %+v, %v, want nothing reported twice", stuck, err)
+	}
+
+	t.Setenv("UPLOAD_STUCK_AFTER", "0")
+	if stuck, err := StuckUploads(); err != nil || stuck != nil {
+		t.Errorf("StuckUploads turned off = %+v, %v", stuck, err)
+	}
+}
@@ -1,14 +1,22 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"os/exec"
-	"strconv"
+	"path"
 	"strings"
 	"time"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
@@ -19,79 +27,98 @@ const (
 )
 
 type rcloneConfig struct {
-	Remote    string
-	Target    string
-	Endpoint  string
-	AccessKey string
-	SecretKey string
-	Region    string
-	Retention int
+	Remote     string
+	Target     string
+	Endpoint   string
+	AccessKey  string
+	SecretKey  string
+	Region     string
+	Retention  retention.Policy
+	ConfigFile string
+	// Encrypt encrypts the uploads; nil sends artifacts as they are.
+	Encrypt *encrypt.Config
 }
 
-func RunRclone() error {
-	cfg, err := loadRcloneConfig()
+// RunRclone uploads the artifacts the destination configured by the RCLONE_*
+// and S3 settings in env has not received yet, verifies each copy and then
+// uploads the catalog.
+func RunRclone(ctx context.Context, env utilities.Env) (Transfer, error) {
+	cfg, err := loadRcloneConfig(env)
 	if err != nil {
 		utilities.Logger.Errorf("[Rclone] ❌ Configuration error: %v", err)
-		return err
-	}
-
-	if !waitForHTTP(cfg.Endpoint, 30*time.Second) {
-		utilities.Logger.Error("[Rclone] ❌ S3 endpoint unreachable; skipping upload")
-		return fmt.Errorf("endpoint unreachable: %s", cfg.Endpoint)
-	}
-
-	if err := cleanRemote(cfg); err != nil {
-		utilities.Logger.Warnf("[Rclone] ⚠️ Remote cleanup error: %v", err)
-	}
-
-	if err := copyBackup(cfg); err != nil {
-		utilities.Logger.Errorf("[Rclone] ❌ Upload failed: %v", err)
-		return err
+		return Transfer{}, err
 	}
 
-	utilities.Logger.Info("[Rclone] ✅ Backup completed successfully")
-	utilities.LogDivider()
-	return nil
+	return rcloneDestination(cfg).run(ctx, func(dryRun bool) error {
+		return pruneRemote(ctx, cfg, dryRun)
+	})
 }
 
-func loadRcloneConfig() (*rcloneConfig, error) {
-	remote := os.Getenv("RCLONE_REMOTE")
-	target := os.Getenv("RCLONE_PATH")
-	endpoint := os.Getenv("S3_ENDPOINT")
+func loadRcloneConfig(env utilities.Env) (*rcloneConfig, error) {
+	remote := env.Getenv("RCLONE_REMOTE")
+	target := env.Getenv("RCLONE_PATH")
+	endpoint := env.Getenv("S3_ENDPOINT")
 	if remote == "" || target == "" || endpoint == "" {
 		return nil, fmt.Errorf("RCLONE_REMOTE, RCLONE_PATH and S3_ENDPOINT must be set")
 	}
 
-	retention := defaultRetentionDays
-	if str := os.Getenv("RCLONE_RETENTION_DAYS"); str != "" {
-		if v, err := strconv.Atoi(str); err == nil && v > 0 {
-			retention = v
-		}
+	// RCLONE_RETENTION_DAYS only defaults when no RCLONE_KEEP_* rule is set,
+	// or it would cut a GFS policy down to two weeks
+	policy, err := loadRemoteRetention(env, "RCLONE", defaultRetentionDays)
+	if err != nil {
+		return nil, err
 	}
 
-	region := os.Getenv("AWS_REGION")
+	enc, err := encrypt.LoadEnv(env, "RCLONE")
+	if err != nil {
+		return nil, err
+	}
+
+	region := env.Getenv("AWS_REGION")
 	if region == "" {
 		region = defaultRegion
 	}
 
 	return &rcloneConfig{
-		Remote:    remote,
-		Target:    target,
-		Endpoint:  endpoint,
-		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
-		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
-		Region:    region,
-		Retention: retention,
+		Remote:     remote,
+		Target:     target,
+		Endpoint:   endpoint,
+		AccessKey:  env.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:  env.Getenv("AWS_SECRET_ACCESS_KEY"),
+		Region:     region,
+		Retention:  policy,
+		ConfigFile: env.Getenv("RCLONE_CONFIG_FILE"),
+		Encrypt:    enc,
 	}, nil
 }
 
-func waitForHTTP(url string, timeout time.Duration) bool {
+// ValidateRclone reports whether the rclone settings are complete and rclone
+// and its config file, if one is set, are present.
+func ValidateRclone(env utilities.Env) error {
+	cfg, err := loadRcloneConfig(env)
+	if err != nil {
+		return err
+	}
+	errs := []error{utilities.RequireBinaries("rclone")}
+	if cfg.ConfigFile != "" {
+		if _, err := os.Stat(cfg.ConfigFile); err != nil {
+			errs = append(errs, fmt.Errorf("RCLONE_CONFIG_FILE: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func waitForHTTP(ctx context.Context, url string, timeout time.Duration) bool {
 	utilities.Logger.Infof("[Rclone] ⏳ Waiting for S3 endpoint %s", url)
 	client := &http.Client{Timeout: 5 * time.Second}
 	deadline := time.Now().Add(timeout)
 
 	for time.Now().Before(deadline) {
-		resp, err := client.Head(url)
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return false
+		}
+		resp, err := client.Do(req)
 		if err == nil && resp.StatusCode < 500 {
 			resp.Body.Close()
 			utilities.Logger.Info("[Rclone] ✅ Endpoint is reachable")
@@ -100,28 +127,175 @@ func waitForHTTP(url string, timeout time.Duration) bool {
 		if resp != nil {
 			resp.Body.Close()
 		}
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(2 * time.Second):
+		}
 	}
 	return false
 }
 
-func cleanRemote(cfg *rcloneConfig) error {
-	utilities.Logger.Infof("[Rclone] 🧹 Cleaning remote files older than %d days at %s", cfg.Retention, cfg.Target)
-	age := fmt.Sprintf("%dd", cfg.Retention)
-	cmdArgs := []string{"delete", cfg.Target, "--min-age", age}
-	if cfgFile := os.Getenv("RCLONE_CONFIG_FILE"); cfgFile != "" {
-		cmdArgs = append(cmdArgs, "--config", cfgFile)
+// rcloneDestination uploads artifacts with rclone copyto once the S3 endpoint
+// answers.
+func rcloneDestination(cfg *rcloneConfig) *destination {
+	return &destination{
+		tag:    "Rclone",
+		target: cfg.Target,
+		check: func(ctx context.Context) error {
+			if !waitForHTTP(ctx, cfg.Endpoint, 30*time.Second) {
+				return fmt.Errorf("endpoint %s did not answer", cfg.Endpoint)
+			}
+			return nil
+		},
+		upload: func(ctx context.Context, a catalog.Artifact) (int64, error) {
+			return uploadFile(ctx, cfg, a)
+		},
+		syncCatalog: func(ctx context.Context) error {
+			return copyCatalog(ctx, cfg)
+		},
+	}
+}
+
+// PruneRclone applies the remote retention policy to the rclone destination
+// configured in env. With dryRun it only logs what it would delete.
+func PruneRclone(ctx context.Context, env utilities.Env, dryRun bool) error {
+	cfg, err := loadRcloneConfig(env)
+	if err != nil {
+		return err
+	}
+	return pruneRemote(ctx, cfg, dryRun)
+}
+
+// pruneRemote deletes the files cfg.Retention drops from the remote.
+func pruneRemote(ctx context.Context, cfg *rcloneConfig, dryRun bool) error {
+	var stderr bytes.Buffer
+	cmd := rcloneCommand(ctx, cfg, "lsjson", "-R", "--files-only", cfg.Target)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("rclone lsjson: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var files []remoteFile
+	if err := json.Unmarshal(out, &files); err != nil {
+		return fmt.Errorf("rclone lsjson: %w", err)
+	}
+
+	return pruneFiles("Rclone", cfg.Target, cfg.Retention, files, dryRun, func(rel string) error {
+		remote := path.Join(cfg.Target, rel)
+		out, err := rcloneCommand(ctx, cfg, "deletefile", remote).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	})
+}
+
+// uploadFile copies the file of a to its place on the remote and checks the
+// copy's size and, where the remote provides one, its checksum. Encrypted
+// uploads are streamed with rclone rcat.
+func uploadFile(ctx context.Context, cfg *rcloneConfig, a catalog.Artifact) (int64, error) {
+	p, err := openPayload(a, cfg.Encrypt)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+	remote := path.Join(cfg.Target, p.Rel)
+
+	var out []byte
+	verb := "copyto"
+	if p.Encryption == "" {
+		// Hash first: rclone reads the file itself
+		if _, err := io.Copy(io.Discard, p); err != nil {
+			return 0, err
+		}
+		if err := p.check(); err != nil {
+			return 0, err
+		}
+		out, err = rcloneCommand(ctx, cfg, verb, a.Path, remote).CombinedOutput()
+	} else {
+		verb = "rcat"
+		cmd := rcloneCommand(ctx, cfg, verb, remote)
+		cmd.Stdin = p
+		out, err = cmd.CombinedOutput()
+	}
+	if err != nil {
+		utilities.Logger.Debugf("[Rclone] command output:\n%s", out)
+		return 0, fmt.Errorf("rclone %s: %v: %s", verb, err, strings.TrimSpace(string(out)))
+	}
+	// A mismatching copy is left in place: the next attempt overwrites it
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+	return p.Size(), verifyRemote(ctx, cfg, remote, p)
+}
+
+// verifyRemote compares the remote file with what was sent. Backends report
+// different hashes; SHA-256 is preferred over MD5. Without either only the
+// size is checked.
+func verifyRemote(ctx context.Context, cfg *rcloneConfig, remote string, p *payload) error {
+	var stderr bytes.Buffer
+	cmd := rcloneCommand(ctx, cfg, "lsjson", "--hash", "--files-only", remote)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("verify: rclone lsjson: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	var files []struct {
+		Size   int64
+		Hashes map[string]string
+	}
+	if err := json.Unmarshal(out, &files); err != nil {
+		return fmt.Errorf("verify: rclone lsjson: %w", err)
+	}
+	if len(files) != 1 {
+		return fmt.Errorf("verify: %s not found after upload", remote)
+	}
+
+	f := files[0]
+	if f.Size != p.Size() {
+		return fmt.Errorf("verify: remote copy is %d bytes, expected %d", f.Size, p.Size())
+	}
+	switch sha, sum := f.Hashes["sha256"], f.Hashes["md5"]; {
+	case sha != "":
+		if !strings.EqualFold(sha, p.SHA256()) {
+			return fmt.Errorf("verify: remote SHA-256 %s, expected %s", sha, p.SHA256())
+		}
+	case sum != "":
+		if !strings.EqualFold(sum, p.MD5()) {
+			return fmt.Errorf("verify: remote MD5 %s, expected %s", sum, p.MD5())
+		}
+	default:
+		utilities.Logger.Debugf("[Rclone] %s has no usable checksum; verified its size only", remote)
+	}
+	return nil
+}
+
+// copyCatalog copies the catalog directory next to the uploaded artifacts.
+func copyCatalog(ctx context.Context, cfg *rcloneConfig) error {
+	dir := catalog.Dir()
+	remote, err := remotePath(cfg, dir)
+	if err != nil {
+		return err
 	}
-	cmd := exec.Command("rclone", cmdArgs...)
+	utilities.Logger.Infof("[Rclone] 🗂️ Uploading catalog %s", dir)
+	return rcloneCopy(ctx, cfg, dir, remote)
+}
+
+func rcloneCopy(ctx context.Context, cfg *rcloneConfig, src, dst string) error {
+	cmd := rcloneCommand(ctx, cfg, "copy", src, dst, "--exclude", "*"+utilities.PartialSuffix, "--exclude", "*.tmp", "--exclude", "/"+queueFile)
+
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		utilities.Logger.Warnf("[Rclone] ⚠️ Remote cleanup failed: %v\nOutput:\n%s", err, out)
+		utilities.Logger.Errorf("[Rclone] ❌ Upload failed: %v", err)
+		utilities.Logger.Debugf("[Rclone] command output:\n%s", out)
 	}
 	return err
 }
 
-func copyBackup(cfg *rcloneConfig) error {
-	utilities.Logger.Infof("[Rclone] 🔄 Uploading %s to %s", backupDir, cfg.Target)
+// rcloneCommand prepares an rclone invocation with the remote defined through
+// RCLONE_CONFIG_<REMOTE>_* variables and the RCLONE_CONFIG_FILE, if one is set.
+func rcloneCommand(ctx context.Context, cfg *rcloneConfig, args ...string) *exec.Cmd {
 	key := strings.ToUpper(cfg.Remote)
 
 	env := os.Environ()
@@ -136,13 +310,71 @@ func copyBackup(cfg *rcloneConfig) error {
 		"RCLONE_CONFIG_"+key+"_ENV_AUTH=false",
 	)
 
-	cmd := exec.Command("rclone", "copy", backupDir, cfg.Target)
+	if cfg.ConfigFile != "" {
+		args = append(args, "--config", cfg.ConfigFile)
+	}
+	cmd := utilities.Command(ctx, "rclone", args...)
 	cmd.Env = env
+	return cmd
+}
 
-	out, err := cmd.CombinedOutput()
+// remotePath maps a local file below the backup root (or the catalog
+// directory) to its uploaded location on the remote.
+func remotePath(cfg *rcloneConfig, local string) (string, error) {
+	rel, err := relPath(local)
 	if err != nil {
-		utilities.Logger.Errorf("[Rclone] ❌ Upload failed: %v", err)
-		utilities.Logger.Debugf("[Rclone] command output:\n%s", out)
+		return "", err
 	}
-	return err
+	return path.Join(cfg.Target, rel), nil
+}
+
+// RcloneRemote reads back the uploads of the rclone destination configured
+// in env.
+func RcloneRemote(ctx context.Context, env utilities.Env) (*Remote, error) {
+	cfg, err := loadRcloneConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := remotePath(cfg, catalog.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(rel string) ([]byte, error) {
+		var stderr bytes.Buffer
+		cmd := rcloneCommand(ctx, cfg, "cat", path.Join(dir, rel))
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("rclone cat %s: %v: %s", rel, err, strings.TrimSpace(stderr.String()))
+		}
+		return out, nil
+	}
+	open := func(local string) (io.ReadCloser, error) {
+		rel, method, err := remoteCopy(local, cfg.Encrypt)
+		if err != nil {
+			return nil, err
+		}
+		cmd := rcloneCommand(ctx, cfg, "cat", path.Join(cfg.Target, rel))
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return decrypting(method, cfg.Encrypt, &cmdReader{ReadCloser: stdout, cmd: cmd})
+	}
+	return &Remote{Name: cfg.Target, Catalog: read, Open: open}, nil
+}
+
+// cmdReader reports the command's exit status when the stream is closed.
+type cmdReader struct {
+	io.ReadCloser
+	cmd *exec.Cmd
+}
+
+func (r *cmdReader) Close() error {
+	r.ReadCloser.Close()
+	return r.cmd.Wait()
 }
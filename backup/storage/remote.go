@@ -0,0 +1,206 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// Remote is an upload destination whose catalog and artifacts can be read
+// back, for listing and verifying the uploaded copies.
+type Remote struct {
+	// Name describes the destination, e.g. remote:bucket/path.
+	Name string
+	// Catalog reads a file of the uploaded catalog.
+	Catalog catalog.ReadFunc
+	// Open streams the uploaded copy of a local artifact.
+	Open func(local string) (io.ReadCloser, error)
+}
+
+// PerArtifact reports whether destinations of kind upload and verify
+// artifacts one by one, which lets them upload during the cycle, retry single
+// uploads and be read back. Rsync only mirrors whole directories.
+func PerArtifact(kind string) bool {
+	switch kind {
+	case "rclone", "s3", "local", "sftp":
+		return true
+	}
+	return false
+}
+
+// Prune applies the retention policy of the destination of kind configured
+// in env. With dryRun it only logs what it would delete.
+func Prune(ctx context.Context, kind string, env utilities.Env, dryRun bool) error {
+	switch kind {
+	case "rclone":
+		return PruneRclone(ctx, env, dryRun)
+	case "s3":
+		return PruneS3(ctx, env, dryRun)
+	case "local":
+		return PruneLocal(ctx, env, dryRun)
+	case "sftp":
+		return PruneSFTP(ctx, env, dryRun)
+	}
+	return nil
+}
+
+// OpenRemote reads back the uploads of the destination of kind configured in
+// env.
+func OpenRemote(ctx context.Context, kind string, env utilities.Env) (*Remote, error) {
+	switch kind {
+	case "rclone":
+		return RcloneRemote(ctx, env)
+	case "s3":
+		return S3Remote(ctx, env)
+	case "local":
+		return LocalRemote(ctx, env)
+	case "sftp":
+		return SFTPRemote(ctx, env)
+	}
+	return nil, fmt.Errorf("%s uploads cannot be read back", kind)
+}
+
+// Target names the destination of kind configured in env the way the catalog
+// records its verified uploads. Kinds that cannot verify single uploads, such
+// as rsync, have no target.
+func Target(kind string, env utilities.Env) (string, error) {
+	// Nothing connects before the destination is used
+	d, err := loadDestination(context.Background(), kind, env)
+	if err != nil || d == nil {
+		return "", err
+	}
+	return d.target, nil
+}
+
+// remoteCopy maps a local artifact to its uploaded copy on a destination that
+// encrypts with enc: its place below the root of the destination and how the
+// destination encrypted it, or "" when it did not.
+func remoteCopy(local string, enc *encrypt.Config) (rel, method string, err error) {
+	rel, err = relPath(local)
+	if err != nil || enc == nil || catalog.EncryptionOf(local) != "" {
+		return rel, "", err
+	}
+	return rel + enc.Ext(), enc.Method, nil
+}
+
+// decrypting returns the plaintext of a copy the destination encrypted with
+// method using enc, decrypted with the passphrase of enc or the ENCRYPT_*
+// identities used for restores.
+func decrypting(method string, enc *encrypt.Config, rc io.ReadCloser) (io.ReadCloser, error) {
+	if method == "" {
+		return rc, nil
+	}
+	r, err := enc.Decrypt(method, rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, rc}, nil
+}
+
+// relPath maps a local file below the backup root, or the catalog directory,
+// to its place relative to the root of a destination.
+func relPath(local string) (string, error) {
+	if utilities.IsWithin(local, backupDir) {
+		rel, _ := filepath.Rel(backupDir, local)
+		return filepath.ToSlash(rel), nil
+	}
+	if dir := catalog.Dir(); utilities.IsWithin(local, dir) {
+		rel, _ := filepath.Rel(dir, local)
+		return path.Join("catalog", filepath.ToSlash(rel)), nil
+	}
+	return "", fmt.Errorf("%s is not uploaded", local)
+}
+
+// remoteFile is a file on a destination, relative to its root.
+type remoteFile struct {
+	Path    string
+	Size    int64
+	ModTime time.Time
+}
+
+// pruneFiles deletes the files of a destination that policy drops, logging
+// under tag. It only considers files whose names carry a backup timestamp, so
+// the catalog and anything else stored next to the backups is left alone.
+func pruneFiles(tag, target string, policy retention.Policy, files []remoteFile, dryRun bool, del func(rel string) error) error {
+	utilities.Logger.Infof("[%s] 🧹 Applying remote retention (%s) at %s", tag, policy, target)
+
+	catalogDir, _ := relPath(catalog.Dir())
+	catalogDir += "/"
+
+	var items []retention.Item
+	for _, f := range files {
+		if strings.HasPrefix(f.Path, catalogDir) || strings.HasSuffix(f.Path, utilities.PartialSuffix) {
+			continue
+		}
+		base, t, ok := retention.ParseName(f.Path)
+		if !ok {
+			continue
+		}
+		items = append(items, retention.Item{
+			Path:   f.Path,
+			Source: path.Join(path.Dir(f.Path), base),
+			Time:   t,
+			Size:   f.Size,
+		})
+	}
+
+	var errs []error
+	count, freed := 0, int64(0)
+	for _, it := range retention.Select(policy, items, time.Now()) {
+		if dryRun {
+			utilities.Logger.Infof("[%s] 🔍 Would delete %s", tag, it.Path)
+		} else {
+			if err := del(it.Path); err != nil {
+				errs = append(errs, fmt.Errorf("delete %s: %w", it.Path, err))
+				continue
+			}
+			utilities.Logger.Infof("[%s] 🗑️ Deleted %s", tag, it.Path)
+		}
+		count++
+		freed += it.Size
+	}
+
+	switch {
+	case dryRun:
+		utilities.Logger.Infof("[%s] 🔍 Remote retention would delete %d file(s), freeing %s", tag, count, utilities.HumanBytes(freed))
+	case count > 0:
+		utilities.Logger.Infof("[%s] 🧹 Remote retention deleted %d file(s), freed %s", tag, count, utilities.HumanBytes(freed))
+	}
+	return errors.Join(errs...)
+}
+
+// loadRemoteRetention reads the <prefix>_KEEP_* rules and the
+// <prefix>_RETENTION_DAYS limit of a destination; defaultDays applies when
+// neither is set.
+func loadRemoteRetention(env utilities.Env, prefix string, defaultDays int) (retention.Policy, error) {
+	policy, err := retention.LoadKeep(env, prefix)
+	if err != nil {
+		return policy, err
+	}
+	days := 0
+	if !policy.HasKeep() {
+		days = defaultDays
+	}
+	if str := env.Getenv(prefix + "_RETENTION_DAYS"); str != "" {
+		if v, err := strconv.Atoi(str); err == nil && v > 0 {
+			days = v
+		}
+	}
+	policy.MaxAge = time.Duration(days) * 24 * time.Hour
+	return policy, nil
+}
@@ -1,28 +1,50 @@
 package storage
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"os/exec"
+	"path/filepath"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
+// rsyncCatalogDir is where the catalog lands in RSYNC_DEST when it is not part of RSYNC_SRC.
+const rsyncCatalogDir = "hyper-backup-catalog"
+
 type rsyncConfig struct {
 	Src  string
 	Dest string
 }
 
-func loadRsyncConfig() (*rsyncConfig, error) {
-	src := os.Getenv("RSYNC_SRC")
-	dest := os.Getenv("RSYNC_DEST")
+func loadRsyncConfig(env utilities.Env) (*rsyncConfig, error) {
+	src := env.Getenv("RSYNC_SRC")
+	dest := env.Getenv("RSYNC_DEST")
 	if src == "" || dest == "" {
 		return nil, fmt.Errorf("RSYNC_SRC and RSYNC_DEST must be set")
 	}
 	return &rsyncConfig{Src: src, Dest: dest}, nil
 }
-func RunRsync() error {
-	cfg, err := loadRsyncConfig()
+
+// ValidateRsync reports whether the rsync settings are complete, rsync is
+// installed, RSYNC_SRC exists and RSYNC_DEST is writable.
+func ValidateRsync(env utilities.Env) error {
+	cfg, err := loadRsyncConfig(env)
+	if err != nil {
+		return err
+	}
+	errs := []error{utilities.RequireBinaries("rsync"), utilities.CheckWritable(cfg.Dest)}
+	if _, err := os.Stat(cfg.Src); err != nil {
+		errs = append(errs, fmt.Errorf("RSYNC_SRC: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// RunRsync mirrors RSYNC_SRC to RSYNC_DEST as configured in env.
+func RunRsync(ctx context.Context, env utilities.Env) error {
+	cfg, err := loadRsyncConfig(env)
 	if err != nil {
 		utilities.Logger.Errorf("[Rsync] ❌ Configuration error: %v", err)
 		return err
@@ -35,13 +57,32 @@ func RunRsync() error {
 		return err
 	}
 
-	cmd := exec.Command("rsync", "-a", "--delete", cfg.Src+"/", cfg.Dest+"/")
+	catalogDir := catalog.Dir()
+	catalogOutside := !utilities.IsWithin(catalogDir, cfg.Src)
+
+	args := []string{"-a", "--delete", "--exclude=*" + utilities.PartialSuffix}
+	if catalogOutside {
+		// keep the synced catalog from being deleted as "extraneous"
+		args = append(args, "--exclude=/"+rsyncCatalogDir+"/")
+	}
+	cmd := utilities.Command(ctx, "rsync", append(args, cfg.Src+"/", cfg.Dest+"/")...)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		utilities.Logger.Errorf("[Rsync] ❌ rsync execution failed: %v\nOutput:\n%s", err, string(output))
 		return err
 	}
 
+	if catalogOutside {
+		if _, err := os.Stat(catalogDir); err == nil {
+			dest := filepath.Join(cfg.Dest, rsyncCatalogDir)
+			cmd := utilities.Command(ctx, "rsync", "-a", "--delete", catalogDir+"/", dest+"/")
+			if output, err := cmd.CombinedOutput(); err != nil {
+				utilities.Logger.Errorf("[Rsync] ❌ catalog sync failed: %v\nOutput:\n%s", err, string(output))
+				return err
+			}
+		}
+	}
+
 	utilities.Logger.Info("[Rsync] ✅ Local backup completed successfully")
 	utilities.LogDivider()
 	return nil
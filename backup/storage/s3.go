@@ -0,0 +1,286 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/backup/storage/s3"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+type s3Config struct {
+	Client *s3.Client
+	// Prefix is prepended to every key; empty or ending in a slash.
+	Prefix string
+	// Target names the destination in log messages, e.g. s3://bucket/prefix.
+	Target    string
+	Retention retention.Policy
+	// Encrypt encrypts the uploads; nil sends artifacts as they are.
+	Encrypt *encrypt.Config
+}
+
+// RunS3 uploads the artifacts the bucket configured by the S3_* and AWS_*
+// settings in env has not received yet with the built-in S3 client, verifies
+// each copy, uploads the catalog and then applies the S3_KEEP_* retention.
+func RunS3(ctx context.Context, env utilities.Env) (Transfer, error) {
+	cfg, err := loadS3Config(env)
+	if err != nil {
+		utilities.Logger.Errorf("[S3] ❌ Configuration error: %v", err)
+		return Transfer{}, err
+	}
+
+	return s3Destination(cfg).run(ctx, func(dryRun bool) error {
+		return pruneS3(ctx, cfg, dryRun)
+	})
+}
+
+func loadS3Config(env utilities.Env) (*s3Config, error) {
+	bucket := env.Getenv("S3_BUCKET")
+	if bucket == "" {
+		return nil, errors.New("S3_BUCKET must be set")
+	}
+	endpoint := env.Getenv("S3_ENDPOINT")
+
+	// Custom endpoints (MinIO, Ceph, ...) mostly only serve path-style
+	// requests; AWS prefers virtual-hosted ones
+	pathStyle := endpoint != ""
+	switch style := strings.ToLower(env.Getenv("S3_URL_STYLE")); style {
+	case "":
+	case "path":
+		pathStyle = true
+	case "virtual":
+		pathStyle = false
+	default:
+		return nil, fmt.Errorf("unknown S3_URL_STYLE %q (expected path or virtual)", style)
+	}
+
+	var partSize int64
+	if v := env.Getenv("S3_PART_SIZE"); v != "" {
+		n, err := retention.ParseSize(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid S3_PART_SIZE: %w", err)
+		}
+		partSize = n
+	}
+
+	client, err := s3.New(s3.Config{
+		Endpoint:     endpoint,
+		Region:       env.Getenv("AWS_REGION"),
+		Bucket:       bucket,
+		AccessKey:    env.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    env.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: env.Getenv("AWS_SESSION_TOKEN"),
+		PathStyle:    pathStyle,
+		CAFile:       env.Getenv("S3_CA_FILE"),
+		PartSize:     partSize,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	policy, err := loadRemoteRetention(env, "S3", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := encrypt.LoadEnv(env, "S3")
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := strings.Trim(env.Getenv("S3_PREFIX"), "/")
+	target := "s3://" + bucket
+	if prefix != "" {
+		target += "/" + prefix
+		prefix += "/"
+	}
+	return &s3Config{Client: client, Prefix: prefix, Target: target, Retention: policy, Encrypt: enc}, nil
+}
+
+// s3Destination uploads artifacts with the built-in client once the bucket
+// answers.
+func s3Destination(cfg *s3Config) *destination {
+	return &destination{
+		tag:    "S3",
+		target: cfg.Target,
+		check:  cfg.Client.CheckBucket,
+		upload: func(ctx context.Context, a catalog.Artifact) (int64, error) {
+			return putFile(ctx, cfg, a)
+		},
+		syncCatalog: func(ctx context.Context) error {
+			return putCatalog(ctx, cfg)
+		},
+	}
+}
+
+// ValidateS3 reports whether the S3 settings are complete and usable. It does
+// not contact the bucket.
+func ValidateS3(env utilities.Env) error {
+	_, err := loadS3Config(env)
+	return err
+}
+
+// putCatalog uploads the catalog files that changed since the bucket got
+// them last: those whose size differs or that are newer than the stored copy.
+func putCatalog(ctx context.Context, cfg *s3Config) error {
+	dir := catalog.Dir()
+	rel, err := relPath(dir)
+	if err != nil {
+		return err
+	}
+	existing, err := cfg.Client.List(ctx, cfg.Prefix+rel+"/")
+	if err != nil {
+		return err
+	}
+	remote := make(map[string]s3.Object, len(existing))
+	for _, o := range existing {
+		remote[o.Key] = o
+	}
+
+	utilities.Logger.Infof("[S3] 🗂️ Uploading catalog %s", dir)
+	var errs []error
+	err = filepath.WalkDir(dir, func(local string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(local, ".tmp") || local == queuePath() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := relPath(local)
+		if err != nil {
+			return nil
+		}
+		if o, ok := remote[cfg.Prefix+rel]; ok && o.Size == info.Size() && !info.ModTime().After(o.LastModified) {
+			return nil
+		}
+
+		f, err := os.Open(local)
+		if err != nil {
+			errs = append(errs, err)
+			return nil
+		}
+		defer f.Close()
+		if _, err := cfg.Client.Put(ctx, cfg.Prefix+rel, f); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+		}
+		return nil
+	})
+	return errors.Join(append(errs, err)...)
+}
+
+// putFile uploads the file of a to its place in the bucket and checks the
+// stored object: it must have the size of the upload and an ETag that is
+// either derived from the uploaded content or, for KMS-encrypted objects whose
+// ETags are opaque, the one the service reported for the upload. The content
+// is also covered by the MD5 the service checks on every request.
+func putFile(ctx context.Context, cfg *s3Config, a catalog.Artifact) (int64, error) {
+	p, err := openPayload(a, cfg.Encrypt)
+	if err != nil {
+		return 0, err
+	}
+	defer p.Close()
+
+	key := cfg.Prefix + p.Rel
+	up, err := cfg.Client.Put(ctx, key, p)
+	if err != nil {
+		return 0, err
+	}
+	// A mismatching object is left in place: the next attempt overwrites it
+	if err := p.check(); err != nil {
+		return 0, err
+	}
+
+	o, err := cfg.Client.Stat(ctx, key)
+	if err != nil {
+		return 0, fmt.Errorf("verify: %w", err)
+	}
+	if o.Size != p.Size() {
+		return 0, fmt.Errorf("verify: remote copy is %d bytes, expected %d", o.Size, p.Size())
+	}
+	// Some services report the MD5 of the whole object for multipart uploads
+	for _, etag := range []string{up.MD5ETag, p.MD5(), up.ETag} {
+		if etag != "" && strings.EqualFold(o.ETag, etag) {
+			return p.Size(), nil
+		}
+	}
+	return 0, fmt.Errorf("verify: remote ETag %s, expected %s", o.ETag, up.MD5ETag)
+}
+
+// PruneS3 applies the remote retention policy to the bucket configured in
+// env. With dryRun it only logs what it would delete.
+func PruneS3(ctx context.Context, env utilities.Env, dryRun bool) error {
+	cfg, err := loadS3Config(env)
+	if err != nil {
+		return err
+	}
+	return pruneS3(ctx, cfg, dryRun)
+}
+
+func pruneS3(ctx context.Context, cfg *s3Config, dryRun bool) error {
+	if cfg.Retention.IsZero() {
+		return nil
+	}
+	objects, err := cfg.Client.List(ctx, cfg.Prefix)
+	if err != nil {
+		return err
+	}
+	files := make([]remoteFile, 0, len(objects))
+	for _, o := range objects {
+		files = append(files, remoteFile{Path: strings.TrimPrefix(o.Key, cfg.Prefix), Size: o.Size})
+	}
+	return pruneFiles("S3", cfg.Target, cfg.Retention, files, dryRun, func(rel string) error {
+		return cfg.Client.Delete(ctx, cfg.Prefix+rel)
+	})
+}
+
+// S3Remote reads back the uploads of the bucket configured in env.
+func S3Remote(ctx context.Context, env utilities.Env) (*Remote, error) {
+	cfg, err := loadS3Config(env)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := relPath(catalog.Dir())
+	if err != nil {
+		return nil, err
+	}
+
+	read := func(rel string) ([]byte, error) {
+		r, err := cfg.Client.Get(ctx, cfg.Prefix+dir+"/"+rel)
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", rel, err)
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	}
+	open := func(local string) (io.ReadCloser, error) {
+		rel, method, err := remoteCopy(local, cfg.Encrypt)
+		if err != nil {
+			return nil, err
+		}
+		r, err := cfg.Client.Get(ctx, cfg.Prefix+rel)
+		if err != nil {
+			return nil, err
+		}
+		return decrypting(method, cfg.Encrypt, r)
+	}
+	return &Remote{Name: cfg.Target, Catalog: read, Open: open}, nil
+}
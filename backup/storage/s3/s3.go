@@ -0,0 +1,416 @@
+// Package s3 is a small client for S3-compatible object storage: AWS S3,
+// MinIO, Ceph RGW, Backblaze B2, Cloudflare R2 and the like. It covers what
+// hyper-backup needs — uploading streams (in parts once they outgrow one),
+// listing, downloading and deleting objects — and signs every request with
+// AWS Signature Version 4.
+package s3
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPartSize is the size of the parts of a multipart upload and
+	// the largest object uploaded with a single request.
+	DefaultPartSize = 16 << 20
+	// MinPartSize is the smallest part S3 accepts, except for the last one.
+	MinPartSize = 5 << 20
+	// maxParts is the most parts a multipart upload can have.
+	maxParts = 10000
+)
+
+// Config describes a bucket and how to reach it.
+type Config struct {
+	// Endpoint is the service URL, e.g. http://minio:9000. Empty means AWS,
+	// https://s3.<region>.amazonaws.com.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PathStyle addresses the bucket as <endpoint>/<bucket>/<key> rather
+	// than <bucket>.<endpoint host>/<key>.
+	PathStyle bool
+	// CAFile is a PEM bundle trusted in addition to the system roots.
+	CAFile string
+	// PartSize defaults to DefaultPartSize.
+	PartSize int64
+}
+
+// Client talks to one bucket.
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+	// buffers holds part-sized buffers for Put, so uploads reuse them
+	buffers sync.Pool
+}
+
+// Object is an entry of a bucket listing.
+type Object struct {
+	Key          string
+	Size         int64
+	ETag         string
+	LastModified time.Time
+}
+
+// Error is an error response of the service.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s (HTTP %d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err says the object or bucket does not exist.
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// New checks cfg and prepares a client for it.
+func New(cfg Config) (*Client, error) {
+	if cfg.Bucket == "" {
+		return nil, errors.New("bucket is not set")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid endpoint %q: expected e.g. https://s3.example.com", cfg.Endpoint)
+	}
+	endpoint.Path = strings.TrimSuffix(endpoint.Path, "/")
+	if !cfg.PathStyle && strings.Contains(cfg.Bucket, ".") && endpoint.Scheme == "https" {
+		// a dotted bucket name breaks the wildcard certificate of the endpoint
+		return nil, fmt.Errorf("bucket %q contains dots; use path-style addressing", cfg.Bucket)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+	if cfg.PartSize < MinPartSize {
+		return nil, fmt.Errorf("part size %d is below the minimum of 5 MiB", cfg.PartSize)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.CAFile != "" {
+		pem, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no PEM certificates found", cfg.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	c := &Client{cfg: cfg, endpoint: endpoint, http: &http.Client{Transport: transport}}
+	c.buffers.New = func() any {
+		buf := make([]byte, cfg.PartSize)
+		return &buf
+	}
+	return c, nil
+}
+
+// String names the bucket for log messages.
+func (c *Client) String() string {
+	return "s3://" + c.cfg.Bucket
+}
+
+// CheckBucket reports whether the bucket exists and the credentials may use it.
+func (c *Client) CheckBucket(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Upload describes an object written by Put.
+type Upload struct {
+	// ETag is what the service reported for the stored object.
+	ETag string
+	// MD5ETag is the ETag S3 derives from the content when it does not
+	// encrypt it with KMS: the MD5 of a single upload, or the MD5 of the part
+	// MD5s and the part count for a multipart one.
+	MD5ETag string
+}
+
+// Put uploads everything read from r to key. Anything larger than the part
+// size is sent as a multipart upload, so at most one part is held in memory.
+// Every request carries the MD5 of its body, so the service rejects anything
+// corrupted on the way. The part buffer is reused by later uploads.
+func (c *Client) Put(ctx context.Context, key string, r io.Reader) (Upload, error) {
+	bufp := c.buffers.Get().(*[]byte)
+	defer c.buffers.Put(bufp)
+	buf := *bufp
+	n, err := io.ReadFull(r, buf)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		sum := md5.Sum(buf[:n])
+		resp, err := c.do(ctx, http.MethodPut, key, nil, buf[:n], contentMD5(sum))
+		if err != nil {
+			return Upload{}, err
+		}
+		resp.Body.Close()
+		return Upload{ETag: trimETag(resp.Header.Get("ETag")), MD5ETag: hex.EncodeToString(sum[:])}, nil
+	case err != nil:
+		return Upload{}, err
+	}
+	return c.putMultipart(ctx, key, buf, r)
+}
+
+// Get streams the object at key.
+func (c *Client) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Stat returns the size, ETag and modification time of the object at key.
+func (c *Client) Stat(ctx context.Context, key string) (Object, error) {
+	resp, err := c.do(ctx, http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	modified, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return Object{
+		Key:          key,
+		Size:         resp.ContentLength,
+		ETag:         trimETag(resp.Header.Get("ETag")),
+		LastModified: modified,
+	}, nil
+}
+
+// Delete removes the object at key. Deleting a missing object succeeds.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List returns every object whose key starts with prefix.
+func (c *Client) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				ETag         string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("list %s: %w", prefix, err)
+		}
+		for _, o := range page.Contents {
+			objects = append(objects, Object{Key: o.Key, Size: o.Size, ETag: trimETag(o.ETag), LastModified: o.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// putMultipart uploads first and the rest of r as the parts of one object.
+// The upload is aborted when any part fails, so no parts are left behind.
+func (c *Client) putMultipart(ctx context.Context, key string, first []byte, r io.Reader) (Upload, error) {
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return Upload{}, err
+	}
+	var created struct{ UploadId string }
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil || created.UploadId == "" {
+		return Upload{}, fmt.Errorf("start multipart upload of %s: %v", key, err)
+	}
+
+	up, err := c.uploadParts(ctx, key, created.UploadId, first, r)
+	if err != nil {
+		abort := url.Values{"uploadId": {created.UploadId}}
+		// the upload context may be what failed
+		actx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+		if resp, aerr := c.do(actx, http.MethodDelete, key, abort, nil, nil); aerr == nil {
+			resp.Body.Close()
+		}
+		return Upload{}, err
+	}
+	return up, nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// uploadParts sends the parts of a multipart upload and completes it.
+func (c *Client) uploadParts(ctx context.Context, key, uploadID string, buf []byte, r io.Reader) (Upload, error) {
+	var parts []completedPart
+	sums := md5.New()
+	for n := 1; ; n++ {
+		if n > maxParts {
+			return Upload{}, fmt.Errorf("%s needs more than %d parts; raise the part size", key, maxParts)
+		}
+		sum := md5.Sum(buf)
+		sums.Write(sum[:])
+		query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+		resp, err := c.do(ctx, http.MethodPut, key, query, buf, contentMD5(sum))
+		if err != nil {
+			return Upload{}, fmt.Errorf("upload part %d of %s: %w", n, key, err)
+		}
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+
+		buf = buf[:cap(buf)]
+		size, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return Upload{}, err
+		}
+		buf = buf[:size]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return Upload{}, err
+	}
+	header := http.Header{"Content-Type": {"application/xml"}}
+	resp, err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {uploadID}}, body, header)
+	if err != nil {
+		return Upload{}, fmt.Errorf("complete multipart upload of %s: %w", key, err)
+	}
+	defer resp.Body.Close()
+	// S3 can report a failure in the body of a 200 response
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+		ETag    string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err == nil && result.XMLName.Local == "Error" {
+		return Upload{}, fmt.Errorf("complete multipart upload of %s: %w", key, &Error{StatusCode: resp.StatusCode, Code: result.Code, Message: result.Message})
+	}
+	return Upload{ETag: trimETag(result.ETag), MD5ETag: fmt.Sprintf("%x-%d", sums.Sum(nil), len(parts))}, nil
+}
+
+func contentMD5(sum [md5.Size]byte) http.Header {
+	return http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}}
+}
+
+// trimETag strips the quotes around an ETag.
+func trimETag(etag string) string {
+	return strings.Trim(etag, `"`)
+}
+
+// do sends a signed request for key, or for the bucket itself when key is
+// empty, and turns error responses into *Error.
+func (c *Client) do(ctx context.Context, method, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	if body == nil {
+		req.Body = http.NoBody
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, body, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	e := &Error{StatusCode: resp.StatusCode, Code: http.StatusText(resp.StatusCode)}
+	var parsed struct{ Code, Message string }
+	if data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10)); xml.Unmarshal(data, &parsed) == nil && parsed.Code != "" {
+		e.Code, e.Message = parsed.Code, parsed.Message
+	}
+	return nil, e
+}
+
+// objectURL addresses key in the bucket, path- or virtual-host-style.
+func (c *Client) objectURL(key string) *url.URL {
+	u := *c.endpoint
+	p := u.Path + "/"
+	if c.cfg.PathStyle {
+		p += c.cfg.Bucket + "/"
+	} else {
+		u.Host = c.cfg.Bucket + "." + u.Host
+	}
+	p += key
+	u.Path = p
+	u.RawPath = encodePath(p)
+	return &u
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/storage/s3"
+)
+
+func TestPutFileVerifiesCopy(t *testing.T) {
+	md5Hex := func(data []byte) string {
+		sum := md5.Sum(data)
+		return hex.EncodeToString(sum[:])
+	}
+	opaque := func([]byte) string { return "0123456789abcdef0123456789abcdef" }
+
+	tests := []struct {
+		name string
+		// put and head return the ETags of the upload and of the stored object
+		put, head func(body []byte) string
+		// short makes the stored object that much smaller than the upload
+		short   int
+		wantErr string
+	}{
+		{name: "content ETag", put: md5Hex, head: md5Hex},
+		{name: "opaque KMS ETag", put: opaque, head: opaque},
+		{name: "whole object MD5", put: opaque, head: md5Hex},
+		{name: "other ETag", put: md5Hex, head: opaque, wantErr: "remote ETag"},
+		{name: "truncated copy", put: md5Hex, head: md5Hex, short: 1, wantErr: "remote copy is"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			stored := map[string][]byte{}
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				switch r.Method {
+				case http.MethodPut:
+					body, _ := io.ReadAll(r.Body)
+					stored[r.URL.Path] = body
+					w.Header().Set("ETag", `"`+tt.put(body)+`"`)
+				case http.MethodHead:
+					body, ok := stored[r.URL.Path]
+					if !ok {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.Header().Set("Content-Length", strconv.Itoa(len(body)-tt.short))
+					w.Header().Set("ETag", `"`+tt.head(body)+`"`)
+				default:
+					w.WriteHeader(http.StatusNotImplemented)
+				}
+			}))
+			defer srv.Close()
+
+			client, err := s3.New(s3.Config{Endpoint: srv.URL, Bucket: "bucket", AccessKey: "key", SecretKey: "secret", PathStyle: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := &s3Config{Client: client, Prefix: "backups/", Target: "s3://bucket/backups"}
+
+			dir := t.TempDir()
+			t.Setenv("CATALOG_DIR", dir)
+			a := catalog.Artifact{Path: filepath.Join(dir, "db_20260101_000000.sql.zst")}
+			if err := os.WriteFile(a.Path, []byte(strings.Repeat("backup", 100)), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := a.Describe(); err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := putFile(context.Background(), cfg, a)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("putFile error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != a.Size {
+				t.Errorf("putFile = %d bytes, want %d", n, a.Size)
+			}
+			if _, ok := stored["/bucket/backups/catalog/db_20260101_000000.sql.zst"]; !ok {
+				t.Errorf("stored %v, want the artifact below the prefix", stored)
+			}
+		})
+	}
+}
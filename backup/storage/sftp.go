@@ -0,0 +1,535 @@
+package storage
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpDialTimeout bounds connecting and the SSH handshake.
+const sftpDialTimeout = 30 * time.Second
+
+// resumeSlack is how much of an interrupted upload is sent again. Writes go
+// out concurrently, up to 64 packets of 32 KiB, so the end of the file may
+// have holes where a write never arrived.
+const resumeSlack = 64 * 32 << 10
+
+type sftpConfig struct {
+	// Addr is the host:port of the SSH server.
+	Addr string
+	User string
+	// Path is the root of the uploads; relative paths start in the login
+	// directory.
+	Path string
+	// Target names the destination in log messages, e.g.
+	// sftp://backup@host:22/srv/backups.
+	Target string
+
+	Password string
+	Signer   ssh.Signer
+	// AgentSocket is the ssh-agent to ask for keys, if any.
+	AgentSocket string
+
+	HostKey           ssh.HostKeyCallback
+	HostKeyAlgorithms []string
+
+	Retention retention.Policy
+	// Encrypt encrypts the uploads; nil sends artifacts as they are.
+	Encrypt *encrypt.Config
+}
+
+func loadSFTPConfig(env utilities.Env) (*sftpConfig, error) {
+	host := env.Getenv("SFTP_HOST")
+	user := env.Getenv("SFTP_USER")
+	dir := env.Getenv("SFTP_PATH")
+	if host == "" || user == "" || dir == "" {
+		return nil, fmt.Errorf("SFTP_HOST, SFTP_USER and SFTP_PATH must be set")
+	}
+	port := 22
+	if v := env.Getenv("SFTP_PORT"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("invalid SFTP_PORT %q", v)
+		}
+		port = n
+	}
+	dir = path.Clean(dir)
+	cfg := &sftpConfig{
+		Addr:        net.JoinHostPort(host, strconv.Itoa(port)),
+		User:        user,
+		Path:        dir,
+		Password:    env.Getenv("SFTP_PASSWORD"),
+		AgentSocket: os.Getenv("SSH_AUTH_SOCK"),
+	}
+	switch {
+	case path.IsAbs(dir):
+		cfg.Target = fmt.Sprintf("sftp://%s@%s%s", user, cfg.Addr, dir)
+	case dir == ".":
+		cfg.Target = fmt.Sprintf("sftp://%s@%s/~", user, cfg.Addr)
+	default:
+		cfg.Target = fmt.Sprintf("sftp://%s@%s/~/%s", user, cfg.Addr, dir)
+	}
+
+	if key := env.Getenv("SFTP_PRIVATE_KEY"); key != "" {
+		var err error
+		if pass := env.Getenv("SFTP_KEY_PASSPHRASE"); pass != "" {
+			cfg.Signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(key), []byte(pass))
+		} else {
+			cfg.Signer, err = ssh.ParsePrivateKey([]byte(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("SFTP_PRIVATE_KEY: %w", err)
+		}
+	}
+	if cfg.Signer == nil && cfg.Password == "" && cfg.AgentSocket == "" {
+		return nil, fmt.Errorf("SFTP_PRIVATE_KEY, SFTP_PASSWORD or an ssh-agent (SSH_AUTH_SOCK) is required")
+	}
+
+	if err := cfg.loadHostKey(env); err != nil {
+		return nil, err
+	}
+
+	policy, err := loadRemoteRetention(env, "SFTP", 0)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := encrypt.LoadEnv(env, "SFTP")
+	if err != nil {
+		return nil, err
+	}
+	cfg.Retention, cfg.Encrypt = policy, enc
+	return cfg, nil
+}
+
+// loadHostKey sets how the server's key is checked: against SFTP_HOST_KEY
+// if set, otherwise against the known_hosts file. Unknown servers are always
+// refused.
+func (cfg *sftpConfig) loadHostKey(env utilities.Env) error {
+	if line := env.Getenv("SFTP_HOST_KEY"); line != "" {
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("SFTP_HOST_KEY: %w", err)
+		}
+		cfg.HostKey = ssh.FixedHostKey(key)
+		cfg.HostKeyAlgorithms = keyAlgorithms(key.Type())
+		return nil
+	}
+
+	file := env.Getenv("SFTP_KNOWN_HOSTS")
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("SFTP_KNOWN_HOSTS or SFTP_HOST_KEY must be set: %w", err)
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return fmt.Errorf("SFTP_KNOWN_HOSTS: %w (add the server with ssh-keyscan or set SFTP_HOST_KEY)", err)
+	}
+	known := knownKeys(callback, cfg.Addr)
+	if len(known) == 0 {
+		return fmt.Errorf("SFTP_KNOWN_HOSTS: %s has no key for %s (add it with ssh-keyscan or set SFTP_HOST_KEY)", file, cfg.Addr)
+	}
+	cfg.HostKey = callback
+	for _, k := range known {
+		for _, algo := range keyAlgorithms(k.Key.Type()) {
+			if !slices.Contains(cfg.HostKeyAlgorithms, algo) {
+				cfg.HostKeyAlgorithms = append(cfg.HostKeyAlgorithms, algo)
+			}
+		}
+	}
+	return nil
+}
+
+// knownKeys returns the keys callback accepts for addr. Checking a key that
+// was just generated always fails, and the error lists the known ones.
+func knownKeys(callback ssh.HostKeyCallback, addr string) []knownhosts.KnownKey {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil
+	}
+	probe, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if errors.As(callback(addr, &net.TCPAddr{}, probe), &keyErr) {
+		return keyErr.Want
+	}
+	return nil
+}
+
+// keyAlgorithms lists the host key algorithms that produce keys of keyType,
+// so the server offers the key we know rather than another one.
+func keyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// dial connects and logs in to the server.
+func (cfg *sftpConfig) dial(ctx context.Context) (*ssh.Client, error) {
+	var d net.Dialer
+	ctx, cancel := context.WithTimeout(ctx, sftpDialTimeout)
+	defer cancel()
+	conn, err := d.DialContext(ctx, "tcp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake has no context of its own
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	signers := func() ([]ssh.Signer, error) { return nil, nil }
+	if cfg.AgentSocket != "" {
+		// The agent signs during the handshake only
+		if sock, err := (&net.Dialer{}).DialContext(ctx, "unix", cfg.AgentSocket); err != nil {
+			utilities.Logger.Warnf("[SFTP] ⚠️ Cannot reach ssh-agent: %v", err)
+		} else {
+			defer sock.Close()
+			signers = agent.NewClient(sock).Signers
+		}
+	}
+	// A method is only tried once, so the key and the agent share one
+	var auth []ssh.AuthMethod
+	auth = append(auth, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		keys, err := signers()
+		if cfg.Signer != nil {
+			keys = append([]ssh.Signer{cfg.Signer}, keys...)
+		}
+		return keys, err
+	}))
+	if cfg.Password != "" {
+		auth = append(auth, ssh.Password(cfg.Password), ssh.KeyboardInteractive(
+			func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = cfg.Password
+				}
+				return answers, nil
+			}))
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, cfg.Addr, &ssh.ClientConfig{
+		User:              cfg.User,
+		Auth:              auth,
+		HostKeyCallback:   cfg.HostKey,
+		HostKeyAlgorithms: cfg.HostKeyAlgorithms,
+	})
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sftpStore is a fileStore on the SFTP server. It connects on first use and
+// again after the connection drops, until ctx is cancelled.
+type sftpStore struct {
+	ctx context.Context
+	cfg *sftpConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func newSFTPStore(ctx context.Context, cfg *sftpConfig) *sftpStore {
+	return &sftpStore{ctx: ctx, cfg: cfg}
+}
+
+func (s *sftpStore) connect() (*sftp.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	if err := s.ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn, err := s.cfg.dial(s.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", s.cfg.Addr, err)
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("start SFTP on %s: %w", s.cfg.Addr, err)
+	}
+	s.conn, s.client = conn, client
+
+	stop := context.AfterFunc(s.ctx, func() { conn.Close() })
+	go func() {
+		conn.Wait()
+		stop()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.conn == conn {
+			s.conn, s.client = nil, nil
+		}
+	}()
+	return client, nil
+}
+
+// Close ends the connection, if any.
+func (s *sftpStore) Close() {
+	s.mu.Lock()
+	conn := s.conn
+	s.conn, s.client = nil, nil
+	s.mu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+func (s *sftpStore) path(rel string) string {
+	return path.Join(s.cfg.Path, rel)
+}
+
+// mkroot creates the root of the uploads.
+func (s *sftpStore) mkroot() error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return c.MkdirAll(s.cfg.Path)
+}
+
+func (s *sftpStore) Create(rel string) (storeWriter, error) {
+	return s.open(rel, false, 0)
+}
+
+func (s *sftpStore) Resume(rel string, size int64) (storeWriter, int64, error) {
+	w, err := s.open(rel, true, size)
+	if err != nil {
+		return nil, 0, err
+	}
+	return w, w.offset, nil
+}
+
+func (s *sftpStore) open(rel string, resume bool, size int64) (*sftpWriter, error) {
+	c, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	final := s.path(rel)
+	if err := c.MkdirAll(path.Dir(final)); err != nil {
+		return nil, err
+	}
+	w := &sftpWriter{client: c, partial: final + utilities.PartialSuffix, final: final, keep: resume}
+	if resume {
+		if fi, err := c.Stat(w.partial); err == nil && fi.Size() <= size {
+			w.offset = max(fi.Size()-resumeSlack, 0)
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if w.offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	if w.f, err = c.OpenFile(w.partial, flags); err != nil {
+		return nil, err
+	}
+	if _, err := w.f.Seek(w.offset, io.SeekStart); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (s *sftpStore) Open(rel string) (io.ReadCloser, error) {
+	c, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	return c.Open(s.path(rel))
+}
+
+func (s *sftpStore) Remove(rel string) error {
+	c, err := s.connect()
+	if err != nil {
+		return err
+	}
+	return c.Remove(s.path(rel))
+}
+
+func (s *sftpStore) List(dir string) ([]remoteFile, error) {
+	c, err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+	var files []remoteFile
+	walker := c.Walk(s.path(dir))
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return files, err
+		}
+		fi := walker.Stat()
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		rel := walker.Path()
+		if s.cfg.Path != "." {
+			rel = strings.TrimPrefix(rel, s.cfg.Path+"/")
+		}
+		files = append(files, remoteFile{Path: rel, Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return files, s.ctx.Err()
+}
+
+// sftpWriter writes a file under a temporary name on the server.
+type sftpWriter struct {
+	client  *sftp.Client
+	f       *sftp.File
+	partial string
+	final   string
+	// offset is where writing started; keep leaves an aborted file for the
+	// next attempt to resume.
+	offset int64
+	keep   bool
+	closed bool
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+// ReadFrom lets io.Copy send several packets at a time, which matters on
+// links with a long round trip.
+func (w *sftpWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.f.ReadFromWithConcurrency(r, 0)
+}
+
+func (w *sftpWriter) Commit() error {
+	if _, ok := w.client.HasExtension("fsync@openssh.com"); ok {
+		if err := w.f.Sync(); err != nil {
+			return err
+		}
+	}
+	w.closed = true
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	// A plain SFTP rename refuses to replace a file; the OpenSSH extension
+	// replaces it atomically
+	if _, ok := w.client.HasExtension("posix-rename@openssh.com"); ok {
+		return w.client.PosixRename(w.partial, w.final)
+	}
+	if err := w.client.Remove(w.final); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return w.client.Rename(w.partial, w.final)
+}
+
+func (w *sftpWriter) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	w.f.Close()
+	if !w.keep {
+		w.client.Remove(w.partial)
+	}
+}
+
+// destination uploads artifacts to the server, creating the directories it
+// needs. The connection is kept for the whole pass.
+func (cfg *sftpConfig) destination(store *sftpStore) *destination {
+	return &destination{
+		tag:    "SFTP",
+		target: cfg.Target,
+		check: func(ctx context.Context) error {
+			return store.mkroot()
+		},
+		upload: func(ctx context.Context, a catalog.Artifact) (int64, error) {
+			return storeFile(ctx, "SFTP", store, a, cfg.Encrypt)
+		},
+		syncCatalog: func(ctx context.Context) error {
+			return storeCatalog(ctx, "SFTP", store)
+		},
+		close: store.Close,
+	}
+}
+
+// RunSFTP uploads the artifacts the server configured by the SFTP_* settings
+// in env has not received yet, verifies each copy, uploads the catalog and
+// then applies the SFTP_KEEP_* retention. Interrupted uploads resume where
+// they stopped.
+func RunSFTP(ctx context.Context, env utilities.Env) (Transfer, error) {
+	cfg, err := loadSFTPConfig(env)
+	if err != nil {
+		utilities.Logger.Errorf("[SFTP] ❌ Configuration error: %v", err)
+		return Transfer{}, err
+	}
+
+	store := newSFTPStore(ctx, cfg)
+	return cfg.destination(store).run(ctx, func(dryRun bool) error {
+		return pruneStore("SFTP", cfg.Target, store, cfg.Retention, dryRun)
+	})
+}
+
+// ValidateSFTP reports whether the SFTP_* settings are complete, the key
+// parses and the server's host key is known. It does not connect.
+func ValidateSFTP(env utilities.Env) error {
+	_, err := loadSFTPConfig(env)
+	return err
+}
+
+// PruneSFTP applies the retention policy to the server configured in env.
+// With dryRun it only logs what it would delete.
+func PruneSFTP(ctx context.Context, env utilities.Env, dryRun bool) error {
+	cfg, err := loadSFTPConfig(env)
+	if err != nil {
+		return err
+	}
+	store := newSFTPStore(ctx, cfg)
+	defer store.Close()
+	return pruneStore("SFTP", cfg.Target, store, cfg.Retention, dryRun)
+}
+
+// SFTPRemote reads back the uploads on the server configured in env. The
+// connection ends with ctx.
+func SFTPRemote(ctx context.Context, env utilities.Env) (*Remote, error) {
+	cfg, err := loadSFTPConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	store := newSFTPStore(ctx, cfg)
+	c, err := store.connect()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := c.Stat(cfg.Path); err != nil {
+		return nil, err
+	}
+	return storeRemote(cfg.Target, store, cfg.Encrypt)
+}
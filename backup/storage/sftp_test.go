@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/retention"
+	"github.com/fvoci/hyper-backup/utilities"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sftpServer is an SSH server on localhost with an in-memory SFTP file
+// system shared by all connections. It accepts the user "backup" with the
+// password "secret" or the key of clientKey.
+type sftpServer struct {
+	addr      string
+	hostKey   ssh.Signer
+	clientKey ed25519.PrivateKey
+}
+
+func startSFTPServer(t *testing.T) *sftpServer {
+	t.Helper()
+	s := &sftpServer{hostKey: newSigner(t)}
+	_, s.clientKey, _ = ed25519.GenerateKey(rand.Reader)
+	clientPub, err := ssh.NewPublicKey(s.clientKey.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(c ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if c.User() == "backup" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("wrong password")
+		},
+		PublicKeyCallback: func(c ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if c.User() == "backup" && bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+
+	handlers := sftp.InMemHandler()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveSSH(conn, config, handlers)
+		}
+	}()
+	return s
+}
+
+func serveSSH(conn net.Conn, config *ssh.ServerConfig, handlers sftp.Handlers) {
+	defer conn.Close()
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		ch, requests, err := nch.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server := sftp.NewRequestServer(ch, handlers)
+					server.Serve()
+					server.Close()
+					return
+				}
+			}
+		}()
+	}
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// env returns the settings of a destination at /backups on s that logs in
+// with the password and checks the host key against a known_hosts file.
+func (s *sftpServer) env(t *testing.T, extra map[string]string) utilities.Env {
+	t.Helper()
+	t.Setenv("SSH_AUTH_SOCK", "")
+	host, port, _ := net.SplitHostPort(s.addr)
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(knownHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{
+		"SFTP_HOST":        host,
+		"SFTP_PORT":        port,
+		"SFTP_USER":        "backup",
+		"SFTP_PATH":        "/backups",
+		"SFTP_PASSWORD":    "secret",
+		"SFTP_KNOWN_HOSTS": knownHosts,
+	}
+	for k, v := range extra {
+		values[k] = v
+	}
+	return utilities.NewEnv(values)
+}
+
+// connectSFTP loads the settings in env and logs in.
+func connectSFTP(t *testing.T, env utilities.Env) (*sftpStore, error) {
+	t.Helper()
+	cfg, err := loadSFTPConfig(env)
+	if err != nil {
+		return nil, err
+	}
+	store := newSFTPStore(context.Background(), cfg)
+	t.Cleanup(store.Close)
+	return store, store.mkroot()
+}
+
+func TestSFTPHostKeys(t *testing.T) {
+	s := startSFTPServer(t)
+	other := string(ssh.MarshalAuthorizedKey(newSigner(t).PublicKey()))
+	otherHosts := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{"[127.0.0.1]:1"}, s.hostKey.PublicKey()) + "\n"
+	if err := os.WriteFile(otherHosts, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mismatched := filepath.Join(t.TempDir(), "known_hosts")
+	line = knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, newSigner(t).PublicKey()) + "\n"
+	if err := os.WriteFile(mismatched, []byte(line), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "known host", env: nil},
+		{name: "pinned key", env: map[string]string{"SFTP_HOST_KEY": string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))}},
+		{name: "unknown host", env: map[string]string{"SFTP_KNOWN_HOSTS": otherHosts}, wantErr: "has no key for"},
+		{name: "changed host key", env: map[string]string{"SFTP_KNOWN_HOSTS": mismatched}, wantErr: "key mismatch"},
+		{name: "other pinned key", env: map[string]string{"SFTP_HOST_KEY": other}, wantErr: "host key mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := connectSFTP(t, s.env(t, tt.env))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSFTPAuth(t *testing.T) {
+	s := startSFTPServer(t)
+	encodeKey := func(key ed25519.PrivateKey) string {
+		block, err := ssh.MarshalPrivateKey(key, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(pem.EncodeToMemory(block))
+	}
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		name string
+		env  map[string]string
+		ok   bool
+	}{
+		{"password", nil, true},
+		{"wrong password", map[string]string{"SFTP_PASSWORD": "guess"}, false},
+		{"key", map[string]string{"SFTP_PASSWORD": "", "SFTP_PRIVATE_KEY": encodeKey(s.clientKey)}, true},
+		{"unknown key", map[string]string{"SFTP_PASSWORD": "", "SFTP_PRIVATE_KEY": encodeKey(otherKey)}, false},
+		{"unknown key and password", map[string]string{"SFTP_PRIVATE_KEY": encodeKey(otherKey)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := connectSFTP(t, s.env(t, tt.env))
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), "unable to authenticate")) {
+				t.Fatalf("error = %v, want the login refused", err)
+			}
+		})
+	}
+}
+
+// sftpArtifact writes n bytes as an artifact in a temporary catalog directory.
+func sftpArtifact(t *testing.T, n int) (catalog.Artifact, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("CATALOG_DIR", dir)
+	data := make([]byte, n)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	a := catalog.Artifact{Path: filepath.Join(dir, "db_20260101_000000.sql.zst")}
+	if err := os.WriteFile(a.Path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Describe(); err != nil {
+		t.Fatal(err)
+	}
+	return a, data
+}
+
+func TestSFTPResume(t *testing.T) {
+	const size = 2*resumeSlack + 12345
+	tests := []struct {
+		name string
+		// partial is what an earlier attempt left; nil leaves nothing
+		partial    func(data []byte) []byte
+		wantOffset int64
+	}{
+		{"no partial file", nil, 0},
+		{"shorter than the slack", func(data []byte) []byte { return data[:resumeSlack/2] }, 0},
+		{"truncated", func(data []byte) []byte { return data[:resumeSlack+100] }, 100},
+		{"complete", func(data []byte) []byte { return data }, size - resumeSlack},
+		{"longer than the artifact", func(data []byte) []byte { return append(slices.Clone(data), "garbage"...) }, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := startSFTPServer(t)
+			store, err := connectSFTP(t, s.env(t, nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, data := sftpArtifact(t, size)
+			const rel = "catalog/db_20260101_000000.sql.zst"
+			c, err := store.connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			partial := "/backups/" + rel + utilities.PartialSuffix
+			if tt.partial != nil {
+				if err := c.MkdirAll("/backups/catalog"); err != nil {
+					t.Fatal(err)
+				}
+				f, err := c.Create(partial)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := f.Write(tt.partial(data)); err != nil {
+					t.Fatal(err)
+				}
+				f.Close()
+			}
+
+			w, offset, err := store.Resume(rel, a.Size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.Abort()
+			if offset != tt.wantOffset {
+				t.Errorf("Resume offset = %d, want %d", offset, tt.wantOffset)
+			}
+
+			n, err := storeFile(context.Background(), "SFTP", store, a, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != size {
+				t.Errorf("storeFile = %d bytes, want %d", n, size)
+			}
+			r, err := c.Open("/backups/" + rel)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("stored copy differs from the artifact")
+			}
+			if _, err := c.Stat(partial); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("partial file left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestSFTPListAndPrune(t *testing.T) {
+	s := startSFTPServer(t)
+	store, err := connectSFTP(t, s.env(t, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CATALOG_DIR", filepath.Join(t.TempDir(), "catalog"))
+
+	files := []string{
+		"mysql/db_20260101_000000.sql.zst",
+		"mysql/db_20260102_000000.sql.zst",
+		"mysql/db_20260103_000000.sql.zst",
+		"files/docs_20260101_000000.tar.zst",
+		"catalog/index.json",
+		"catalog/cycles/20260101_000000.json",
+	}
+	for _, rel := range files {
+		w, err := store.Create(rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fmt.Fprintf(w, "content of %s", rel); err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// An upload that never finished
+	w, err := store.Create("mysql/db_20260104_000000.sql.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+
+	listed, err := store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	for _, f := range listed {
+		paths = append(paths, f.Path)
+		if want := int64(len("content of " + f.Path)); f.Size != want && !strings.HasSuffix(f.Path, utilities.PartialSuffix) {
+			t.Errorf("%s is %d bytes, want %d", f.Path, f.Size, want)
+		}
+	}
+	want := append(slices.Clone(files), "mysql/db_20260104_000000.sql.zst"+utilities.PartialSuffix)
+	slices.Sort(paths)
+	slices.Sort(want)
+	if !slices.Equal(paths, want) {
+		t.Fatalf("List = %v, want %v", paths, want)
+	}
+
+	if err := pruneStore("SFTP", "sftp://test", store, retention.Policy{KeepLast: 1}, false); err != nil {
+		t.Fatal(err)
+	}
+	listed, err = store.List("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	paths = paths[:0]
+	for _, f := range listed {
+		paths = append(paths, f.Path)
+	}
+	slices.Sort(paths)
+	want = []string{
+		"catalog/cycles/20260101_000000.json",
+		"catalog/index.json",
+		"files/docs_20260101_000000.tar.zst",
+		"mysql/db_20260103_000000.sql.zst",
+		"mysql/db_20260104_000000.sql.zst" + utilities.PartialSuffix,
+	}
+	if !slices.Equal(paths, want) {
+		t.Errorf("after pruning List = %v, want %v", paths, want)
+	}
+	w.Abort()
+}
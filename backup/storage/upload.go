@@ -0,0 +1,416 @@
+package storage
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// uploadFunc copies the file of an artifact to a destination, verifies the
+// copy against the catalog and returns its size.
+type uploadFunc func(ctx context.Context, a catalog.Artifact) (int64, error)
+
+// Transfer sums up what an upload pass sent to a destination.
+type Transfer struct {
+	// Uploaded counts the artifacts uploaded and verified.
+	Uploaded int
+	// Bytes is their total size, as stored on the destination.
+	Bytes int64
+	// Queued counts the artifacts whose upload failed and will be retried.
+	Queued int
+}
+
+func (t *Transfer) add(other Transfer) {
+	t.Uploaded += other.Uploaded
+	t.Bytes += other.Bytes
+	t.Queued += other.Queued
+}
+
+// destination is a per-artifact destination (see PerArtifact): a target that
+// receives artifacts one by one.
+type destination struct {
+	tag    string
+	target string
+	// check makes sure the destination can be reached before uploading.
+	check  func(ctx context.Context) error
+	upload uploadFunc
+	// syncCatalog uploads the catalog after the artifacts.
+	syncCatalog func(ctx context.Context) error
+	// close, if set, ends the connection the destination keeps between
+	// uploads.
+	close func()
+}
+
+func (d *destination) release() {
+	if d.close != nil {
+		d.close()
+	}
+}
+
+// loadDestination returns the destination of kind configured in env, or nil
+// for kinds that cannot upload single artifacts. Destinations that connect
+// do so on first use, bound to ctx.
+func loadDestination(ctx context.Context, kind string, env utilities.Env) (*destination, error) {
+	switch kind {
+	case "rclone":
+		cfg, err := loadRcloneConfig(env)
+		if err != nil {
+			return nil, err
+		}
+		return rcloneDestination(cfg), nil
+	case "s3":
+		cfg, err := loadS3Config(env)
+		if err != nil {
+			return nil, err
+		}
+		return s3Destination(cfg), nil
+	case "local":
+		cfg, err := loadLocalConfig(env)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.destination(), nil
+	case "sftp":
+		cfg, err := loadSFTPConfig(env)
+		if err != nil {
+			return nil, err
+		}
+		return cfg.destination(newSFTPStore(ctx, cfg)), nil
+	}
+	return nil, nil
+}
+
+// selection picks the artifacts an upload pass sends.
+type selection int
+
+const (
+	// selectPending picks every artifact without a verified copy, except
+	// those the retry queue gave up on.
+	selectPending selection = iota
+	// selectDue picks the queued artifacts whose retry is due.
+	selectDue
+	// selectAll picks every artifact without a verified copy.
+	selectAll
+)
+
+// pending lists the artifacts to upload, oldest first. Queued uploads whose
+// artifact no longer needs one, because it was uploaded or deleted since,
+// are dropped from the queue.
+func (d *destination) pending(sel selection) []catalog.Artifact {
+	entries, qerr := QueuedUploads()
+	if qerr != nil {
+		utilities.Logger.Warnf("[%s] ⚠️ %v", d.tag, qerr)
+	}
+	queued := map[string]QueuedUpload{}
+	retry := map[string]bool{}
+	for _, e := range entries {
+		if e.Target == d.target {
+			queued[e.Path] = e
+			retry[e.Path] = true
+		}
+	}
+
+	artifacts, cerr := catalog.Pending(d.target, retry)
+	if cerr != nil {
+		// unreadable manifests only hide their own artifacts
+		utilities.Logger.Warnf("[%s] ⚠️ Catalog incomplete: %v", d.tag, cerr)
+	}
+	now := time.Now()
+	var picked []catalog.Artifact
+	for _, a := range artifacts {
+		e, ok := queued[a.Path]
+		delete(queued, a.Path)
+		switch {
+		case sel == selectPending && ok && e.GaveUp:
+			utilities.Logger.Debugf("[%s] Skipping %s: gave up after %d attempt(s)", d.tag, a.Path, e.Attempts)
+			continue
+		case sel == selectDue && (!ok || e.GaveUp || e.NextAttempt.After(now)):
+			continue
+		}
+		picked = append(picked, a)
+	}
+
+	// Only a complete catalog tells which queued uploads are stale
+	if len(queued) > 0 && cerr == nil && qerr == nil {
+		stale := make([]string, 0, len(queued))
+		for path := range queued {
+			stale = append(stale, path)
+		}
+		unqueue(d.tag, d.target, stale...)
+	}
+	return picked
+}
+
+// send uploads artifacts and then the catalog. Each artifact is recorded in
+// the catalog as soon as its copy is verified; failed ones go to the retry
+// queue, and when the destination cannot be reached at all, every one of
+// them does.
+func (d *destination) send(ctx context.Context, artifacts []catalog.Artifact) (Transfer, error) {
+	if err := d.check(ctx); err != nil {
+		utilities.Logger.Errorf("[%s] ❌ %s unreachable: %v", d.tag, d.target, err)
+		if ctx.Err() == nil {
+			for _, a := range artifacts {
+				queueFailure(d.tag, d.target, a, err)
+			}
+			if len(artifacts) > 0 {
+				utilities.Logger.Warnf("[%s] 🔁 Queued %d artifact(s) for retry", d.tag, len(artifacts))
+			}
+		}
+		return Transfer{Queued: len(artifacts)}, err
+	}
+
+	t, err := d.uploadEach(ctx, artifacts)
+	// The catalog goes up even after failures, so it lists the verified copies
+	if cerr := d.syncCatalog(ctx); cerr != nil {
+		err = errors.Join(err, fmt.Errorf("catalog: %w", cerr))
+	}
+	return t, err
+}
+
+// run is the storage stage of a destination: once the uploads started early
+// have finished, it sends what they missed and, only if that succeeded,
+// applies the retention with prune, so the rules count the new copies.
+func (d *destination) run(ctx context.Context, prune func(dryRun bool) error) (Transfer, error) {
+	defer d.release()
+	t := drainUploads(d.target)
+
+	sent, err := d.send(ctx, d.pending(selectPending))
+	t.add(sent)
+	if err != nil {
+		utilities.Logger.Errorf("[%s] ❌ Upload failed: %v", d.tag, err)
+		return t, err
+	}
+
+	if err := prune(os.Getenv("RETENTION_DRY_RUN") == "true"); err != nil {
+		utilities.Logger.Warnf("[%s] ⚠️ Remote cleanup error: %v", d.tag, err)
+	}
+
+	utilities.Logger.Infof("[%s] ✅ Backup completed successfully", d.tag)
+	utilities.LogDivider()
+	return t, nil
+}
+
+func (d *destination) uploadEach(ctx context.Context, artifacts []catalog.Artifact) (Transfer, error) {
+	var t Transfer
+	if len(artifacts) == 0 {
+		utilities.Logger.Infof("[%s] ✅ No new artifacts to upload to %s", d.tag, d.target)
+		return t, nil
+	}
+	utilities.Logger.Infof("[%s] 🔄 Uploading %d artifact(s) to %s", d.tag, len(artifacts), d.target)
+
+	var errs []error
+	for _, a := range artifacts {
+		if ctx.Err() != nil {
+			errs = append(errs, ctx.Err())
+			break
+		}
+		rel, err := relPath(a.Path)
+		if err != nil {
+			utilities.Logger.Debugf("[%s] Skipping %s: outside the backup root", d.tag, a.Path)
+			continue
+		}
+		size, err := deliver(ctx, d.target, a, d.upload)
+		if err != nil {
+			utilities.Logger.Errorf("[%s] ❌ Upload of %s failed: %v", d.tag, rel, err)
+			errs = append(errs, fmt.Errorf("%s: %w", rel, err))
+			// An interrupted attempt does not count
+			if ctx.Err() != nil {
+				continue
+			}
+			if e := queueFailure(d.tag, d.target, a, err); e.GaveUp {
+				utilities.Logger.Errorf("[%s] ❌ Giving up on %s after %d attempt(s)", d.tag, rel, e.Attempts)
+			} else {
+				utilities.Logger.Infof("[%s] 🔁 Retrying %s at %s (attempt %d)", d.tag, rel, e.NextAttempt.Format("2006-01-02 15:04:05"), e.Attempts+1)
+				t.Queued++
+			}
+			continue
+		}
+		unqueue(d.tag, d.target, a.Path)
+		utilities.Logger.Debugf("[%s] ⏫ Uploaded and verified %s", d.tag, rel)
+		t.Uploaded++
+		t.Bytes += size
+	}
+
+	if len(errs) > 0 {
+		utilities.Logger.Warnf("[%s] ⚠️ Uploaded and verified %d artifact(s) (%s); %d queued for retry",
+			d.tag, t.Uploaded, utilities.HumanBytes(t.Bytes), t.Queued)
+	} else {
+		utilities.Logger.Infof("[%s] 📤 Uploaded and verified %d artifact(s) (%s)", d.tag, t.Uploaded, utilities.HumanBytes(t.Bytes))
+	}
+	return t, errors.Join(errs...)
+}
+
+// RetryUploads retries the queued uploads to the destination of kind
+// configured in env whose backoff has expired. With force it sends every
+// artifact the destination has no verified copy of, including those the queue
+// gave up on. It returns how many artifacts it tried and what it sent; kinds
+// that do not upload artifacts one by one have nothing to retry.
+func RetryUploads(ctx context.Context, kind string, env utilities.Env, force bool) (int, Transfer, error) {
+	d, err := loadDestination(ctx, kind, env)
+	if err != nil || d == nil {
+		return 0, Transfer{}, err
+	}
+	defer d.release()
+	sel := selectDue
+	if force {
+		sel = selectAll
+	} else if !retryDue(d.target) {
+		// Spare the catalog scan while nothing is due
+		return 0, Transfer{}, nil
+	}
+	artifacts := d.pending(sel)
+	if len(artifacts) == 0 {
+		return 0, Transfer{}, nil
+	}
+	utilities.Logger.Infof("[%s] 🔁 Retrying %d upload(s) to %s", d.tag, len(artifacts), d.target)
+	t, err := d.send(ctx, artifacts)
+	return len(artifacts), t, err
+}
+
+// deliver uploads a to target and records the verified copy in the catalog.
+// It returns the size of the copy.
+func deliver(ctx context.Context, target string, a catalog.Artifact, upload uploadFunc) (int64, error) {
+	size, err := upload(ctx, a)
+	if err != nil {
+		return 0, err
+	}
+	if err := catalog.RecordUpload(a.Path, target, time.Now()); err != nil {
+		return 0, fmt.Errorf("record upload: %w", err)
+	}
+	return size, nil
+}
+
+// digester hashes everything read through it, so an upload can be checked
+// against the catalog without reading the file twice.
+type digester struct {
+	r      io.Reader
+	n      int64
+	sha256 hash.Hash
+	md5    hash.Hash
+}
+
+func newDigester(r io.Reader) *digester {
+	return &digester{r: r, sha256: sha256.New(), md5: md5.New()}
+}
+
+func (d *digester) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.n += int64(n)
+	d.sha256.Write(p[:n])
+	d.md5.Write(p[:n])
+	return n, err
+}
+
+// check reports whether what was read is the file the catalog recorded for a.
+func (d *digester) check(a catalog.Artifact) error {
+	if d.n != a.Size {
+		return fmt.Errorf("local file is %d bytes but the catalog records %d", d.n, a.Size)
+	}
+	if a.SHA256 != "" && hex.EncodeToString(d.sha256.Sum(nil)) != a.SHA256 {
+		return errors.New("local file no longer matches its catalog checksum")
+	}
+	return nil
+}
+
+// md5Sum returns the hex MD5 of what was read.
+func (d *digester) md5Sum() string {
+	return hex.EncodeToString(d.md5.Sum(nil))
+}
+
+// payload is what an artifact is uploaded as: its file, or the file encrypted
+// for a destination with encryption of its own. Artifacts encrypted when they
+// were written are sent as they are. What is read from the file is checked
+// against the catalog, and what is sent is hashed to verify the copy.
+type payload struct {
+	io.Reader
+	// Rel is the place of the upload below the root of the destination.
+	Rel string
+	// Encryption is how the destination encrypted the upload, or "".
+	Encryption string
+
+	a     catalog.Artifact
+	file  *os.File
+	plain *digester
+	sent  *digester
+	pipe  *io.PipeReader
+	done  chan error
+}
+
+// openPayload opens the file of a for an upload encrypted with enc, if set.
+func openPayload(a catalog.Artifact, enc *encrypt.Config) (*payload, error) {
+	rel, err := relPath(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(a.Path)
+	if err != nil {
+		return nil, err
+	}
+	p := &payload{Rel: rel, a: a, file: f, plain: newDigester(f)}
+	if enc == nil || catalog.EncryptionOf(a.Path) != "" {
+		p.sent = p.plain
+		p.Reader = p.plain
+		return p, nil
+	}
+
+	pr, pw := io.Pipe()
+	p.Rel += enc.Ext()
+	p.Encryption = enc.Method
+	p.pipe = pr
+	p.done = make(chan error, 1)
+	// Wrap already writes the header, so it has to run next to the reader
+	go func() {
+		w, err := enc.Wrap(pw)
+		if err == nil {
+			_, err = io.Copy(w, p.plain)
+		}
+		if err == nil {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+		p.done <- err
+	}()
+	p.sent = newDigester(pr)
+	p.Reader = p.sent
+	return p, nil
+}
+
+// check reports whether the whole file was read and is the one the catalog
+// recorded. Call it once the upload consumed the payload.
+func (p *payload) check() error {
+	if p.done != nil {
+		if err := <-p.done; err != nil {
+			return fmt.Errorf("encrypt: %w", err)
+		}
+		p.done = nil
+	}
+	return p.plain.check(p.a)
+}
+
+// Size, SHA256 and MD5 describe what was sent.
+func (p *payload) Size() int64    { return p.sent.n }
+func (p *payload) SHA256() string { return hex.EncodeToString(p.sent.sha256.Sum(nil)) }
+func (p *payload) MD5() string    { return p.sent.md5Sum() }
+
+// Close releases the file and stops the encryption of an aborted upload.
+func (p *payload) Close() error {
+	if p.pipe != nil {
+		p.pipe.Close()
+		if p.done != nil {
+			<-p.done
+			p.done = nil
+		}
+	}
+	return p.file.Close()
+}
@@ -12,14 +12,14 @@ import (
 	"time"
 )
 
-func GetTraefikContainerID() (string, error) {
-	return queryContainerID("org.opencontainers.image.title=Traefik")
+func GetTraefikContainerID(ctx context.Context) (string, error) {
+	return queryContainerID(ctx, "org.opencontainers.image.title=Traefik")
 }
 
-func queryContainerID(label string) (string, error) {
+func queryContainerID(ctx context.Context, label string) (string, error) {
 	client := dockerClient()
 	filter := url.QueryEscape(fmt.Sprintf(`{"label":["%s"]}`, label))
-	req, err := http.NewRequest("GET", "http://unix/containers/json?filters="+filter, nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://unix/containers/json?filters="+filter, nil)
 	if err != nil {
 		return "", err
 	}
@@ -41,10 +41,10 @@ func queryContainerID(label string) (string, error) {
 	return result[0].ID, nil
 }
 
-func SendUSR1(id string) error {
+func SendUSR1(ctx context.Context, id string) error {
 	client := dockerClient()
 	url := fmt.Sprintf("http://unix/containers/%s/kill?signal=USR1", id)
-	req, err := http.NewRequest("POST", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
 	if err != nil {
 		return err
 	}
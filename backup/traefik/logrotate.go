@@ -8,9 +8,16 @@ import (
 	"os"
 	"path/filepath"
 	"time"
+
+	"github.com/fvoci/hyper-backup/utilities"
 )
 
-func RotateAndBackup(logFile string) (string, int64, error) {
+// rotateDir receives the rotated logs.
+const rotateDir = "/home/hyper-backup/traefik"
+
+// RotateAndBackup copies logFile below the backup root, and into extraDir
+// when it is not empty, then truncates it.
+func RotateAndBackup(logFile, extraDir string) (string, int64, error) {
 	info, err := os.Stat(logFile)
 	if err != nil {
 		return "", 0, fmt.Errorf("log file missing: %w", err)
@@ -20,7 +27,7 @@ func RotateAndBackup(logFile string) (string, int64, error) {
 	}
 
 	timestamp := time.Now().Format("20060102_150405")
-	baseDir := "/home/hyper-backup/traefik"
+	baseDir := rotateDir
 	filename := filepath.Base(logFile)
 	rotated := fmt.Sprintf("%s.%s", filename, timestamp)
 	rotatedPath := filepath.Join(baseDir, rotated)
@@ -33,9 +40,9 @@ func RotateAndBackup(logFile string) (string, int64, error) {
 		return "", 0, fmt.Errorf("copy failed: %w", err)
 	}
 
-	if extra := os.Getenv("TRAEFIK_BACKUP_DIR"); extra != "" {
-		extraPath := filepath.Join(extra, rotated)
-		_ = os.MkdirAll(extra, 0755)
+	if extraDir != "" {
+		extraPath := filepath.Join(extraDir, rotated)
+		_ = os.MkdirAll(extraDir, 0755)
 		_, _ = copyFile(logFile, extraPath)
 	}
 
@@ -55,11 +62,18 @@ func copyFile(src, dst string) (int64, error) {
 	}
 	defer in.Close()
 
-	out, err := os.Create(dst)
+	out, err := utilities.CreateAtomic(dst)
 	if err != nil {
 		return 0, fmt.Errorf("create destination file %s: %w", dst, err)
 	}
-	defer out.Close()
+	defer out.Abort()
 
-	return io.Copy(out, in)
+	n, err := io.Copy(out, in)
+	if err != nil {
+		return 0, err
+	}
+	if err := out.Commit(); err != nil {
+		return 0, fmt.Errorf("finalize destination file %s: %w", dst, err)
+	}
+	return n, nil
 }
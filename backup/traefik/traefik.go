@@ -1,45 +1,69 @@
 package traefik
 
 import (
+	"context"
 	"fmt"
 	"os"
 
+	"github.com/fvoci/hyper-backup/backup/catalog"
 	"github.com/fvoci/hyper-backup/utilities"
 )
 
-func LogrotateAndNotify() error {
+// LogrotateAndNotify rotates the Traefik access log named by TRAEFIK_LOG_FILE
+// in env and signals Traefik to reopen it.
+func LogrotateAndNotify(ctx context.Context, env utilities.Env) ([]catalog.Artifact, error) {
 	utilities.Logger.Info("[Traefik] 🌀 Starting logrotate and notify process...")
 
-	logFile := os.Getenv("TRAEFIK_LOG_FILE")
+	logFile := env.Getenv("TRAEFIK_LOG_FILE")
 	if logFile == "" {
 		utilities.Logger.Warn("[Traefik] ⚠️ TRAEFIK_LOG_FILE is not set")
-		return fmt.Errorf("TRAEFIK_LOG_FILE is not set")
+		return nil, fmt.Errorf("TRAEFIK_LOG_FILE is not set")
 	}
 
-	rotatedPath, copiedBytes, err := RotateAndBackup(logFile)
+	rotatedPath, copiedBytes, err := RotateAndBackup(logFile, env.Getenv("TRAEFIK_BACKUP_DIR"))
 	if err != nil {
 		utilities.Logger.Errorf("[Traefik] ❌ Failed to rotate: %v", err)
-		return err
+		return nil, err
 	}
 
 	if copiedBytes == 0 {
 		utilities.Logger.Info("[Traefik] 💤 Log file empty, skipping rotation")
-		return nil
+		return nil, nil
 	}
 
+	// The rotated copy is complete even if signalling Traefik fails below.
+	artifacts := []catalog.Artifact{{Source: logFile, Path: rotatedPath, Status: catalog.StatusSuccess}}
 	utilities.Logger.Infof("[Traefik] 🔄 Copied %d bytes → %s", copiedBytes, rotatedPath)
 
-	containerID, err := GetTraefikContainerID()
+	containerID, err := GetTraefikContainerID(ctx)
 	if err != nil {
 		utilities.Logger.Warnf("[Traefik] ⚠️ No container found: %v", err)
-	} else if err := SendUSR1(containerID); err != nil {
+	} else if err := SendUSR1(ctx, containerID); err != nil {
 		utilities.Logger.Errorf("[Traefik] ❌ Failed to send USR1: %v", err)
-		return err
+		return artifacts, err
 	} else {
 		utilities.Logger.Infof("[Traefik] 📤 Rotated log: %s", rotatedPath)
 		utilities.Logger.Info("[Traefik] ✅ Logrotate and signal complete.")
 		utilities.LogDivider()
 	}
 
-	return nil
+	return artifacts, nil
+}
+
+// ValidateLogrotate checks that TRAEFIK_LOG_FILE is set and exists and that
+// the rotated copies can be written.
+func ValidateLogrotate(env utilities.Env) error {
+	logFile := env.Getenv("TRAEFIK_LOG_FILE")
+	if logFile == "" {
+		return fmt.Errorf("TRAEFIK_LOG_FILE is not set")
+	}
+	if _, err := os.Stat(logFile); err != nil {
+		return fmt.Errorf("log file missing: %w", err)
+	}
+	if extra := env.Getenv("TRAEFIK_BACKUP_DIR"); extra != "" {
+		if err := utilities.CheckWritable(extra); err != nil {
+			return err
+		}
+	}
+	return utilities.CheckWritable(rotateDir)
 }
@@ -0,0 +1,242 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// catalogSource is a catalog location shown by list and checked by verify.
+// Open streams the uploaded copy of an artifact of a remote catalog.
+type catalogSource struct {
+	Name   string
+	Read   catalog.ReadFunc
+	Remote bool
+	Open   func(local string) (io.ReadCloser, error)
+}
+
+// catalogSources returns the local catalog and the one on every configured
+// per-artifact destination (see storage.PerArtifact).
+func catalogSources(ctx context.Context, localOnly, remoteOnly bool) ([]catalogSource, error) {
+	f, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	var sources []catalogSource
+	if !remoteOnly {
+		dir := catalog.Dir()
+		sources = append(sources, catalogSource{Name: "local " + dir, Read: catalog.LocalReader(dir)})
+	}
+	if localOnly {
+		return sources, nil
+	}
+
+	type destination struct {
+		kind string
+		env  utilities.Env
+	}
+	destinations := []destination{{"rclone", utilities.Env{}}, {"s3", utilities.Env{}}, {"local", utilities.Env{}}, {"sftp", utilities.Env{}}}
+	if f != nil {
+		for _, inst := range f.Instances {
+			if storage.PerArtifact(inst.Kind) {
+				destinations = append(destinations, destination{inst.Kind, inst.Env})
+			}
+		}
+	}
+	var errs []error
+	remotes := 0
+	for _, d := range destinations {
+		remote, err := storage.OpenRemote(ctx, d.kind, d.env)
+		if err != nil {
+			utilities.Logger.Debugf("[Catalog] remote catalog unavailable: %v", err)
+			errs = append(errs, err)
+			continue
+		}
+		sources = append(sources, catalogSource{Name: "remote " + remote.Name, Read: remote.Catalog, Remote: true, Open: remote.Open})
+		remotes++
+	}
+	if remoteOnly && remotes == 0 {
+		return nil, errors.Join(errs...)
+	}
+	return sources, nil
+}
+
+// runList implements `hyper-backup list [flags]`.
+func runList(args []string) error {
+	fs := newFlagSet("list", "hyper-backup list [flags]")
+	service := fs.String("service", "", "only show artifacts of this service")
+	localOnly := fs.Bool("local", false, "only list the local catalog")
+	remoteOnly := fs.Bool("remote", false, "only list the catalogs on the upload destinations")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sources, err := catalogSources(ctx, *localOnly, *remoteOnly)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, src := range sources {
+		manifests, err := catalog.LoadManifests(src.Read)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src.Name, err))
+		}
+		printCatalog(src.Name, manifests, *service)
+	}
+	return errors.Join(errs...)
+}
+
+// printCatalog prints artifacts grouped by service, then by cycle.
+func printCatalog(name string, manifests []*catalog.Manifest, service string) {
+	fmt.Printf("📍 %s\n", name)
+
+	type entry struct {
+		cycle    string
+		artifact catalog.Artifact
+	}
+	byService := map[string][]entry{}
+	var services []string
+	for _, m := range manifests {
+		for _, a := range m.Artifacts {
+			if service != "" && !strings.EqualFold(a.Service, service) {
+				continue
+			}
+			if _, ok := byService[a.Service]; !ok {
+				services = append(services, a.Service)
+			}
+			byService[a.Service] = append(byService[a.Service], entry{m.Cycle, a})
+		}
+	}
+	if len(services) == 0 {
+		fmt.Println("  (no backups recorded)")
+		fmt.Println()
+		return
+	}
+	sort.Strings(services)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, svc := range services {
+		fmt.Fprintf(w, "\n%s\n", svc)
+		fmt.Fprintln(w, "  CYCLE\tSTATUS\tSIZE\tSHA256\tUPLOADED\tPATH")
+		for _, e := range byService[svc] {
+			sum := e.artifact.SHA256
+			if len(sum) > 12 {
+				sum = sum[:12]
+			}
+			status := e.artifact.Status
+			if !e.artifact.RemovedAt.IsZero() {
+				status += " (removed locally)"
+			}
+			fmt.Fprintf(w, "  %s\t%s\t%s\t%s\t%s\t%s\n",
+				e.cycle, status, utilities.HumanBytes(e.artifact.Size), sum, uploadState(e.artifact), e.artifact.Path)
+		}
+	}
+	w.Flush()
+	fmt.Println()
+}
+
+// uploadState tells whether every destination has a verified copy of a, or
+// how many do so far.
+func uploadState(a catalog.Artifact) string {
+	switch {
+	case a.Status != catalog.StatusSuccess || a.Path == "":
+		return "-"
+	case !a.UploadedAt.IsZero():
+		return "yes"
+	case len(a.Uploads) > 0:
+		return fmt.Sprintf("%d destination(s)", len(a.Uploads))
+	default:
+		return "no"
+	}
+}
+
+// runVerify implements `hyper-backup verify [flags]`.
+func runVerify(args []string) error {
+	fs := newFlagSet("verify", "hyper-backup verify [flags]")
+	cycle := fs.String("cycle", "", "only verify this cycle (e.g. 20250101_000000)")
+	service := fs.String("service", "", "only verify artifacts of this service")
+	remote := fs.Bool("remote", false, "verify the copies on the upload destinations instead of local files")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sources, err := catalogSources(ctx, !*remote, *remote)
+	if err != nil {
+		return err
+	}
+
+	checked, failed := 0, 0
+	for _, src := range sources {
+		manifests, err := catalog.LoadManifests(src.Read)
+		if err != nil {
+			utilities.Logger.Warnf("[Catalog] ⚠️ %s: %v", src.Name, err)
+		}
+		fmt.Printf("📍 %s\n", src.Name)
+
+		for _, m := range manifests {
+			if *cycle != "" && m.Cycle != *cycle {
+				continue
+			}
+			for _, a := range m.Artifacts {
+				if a.Status != catalog.StatusSuccess || a.Path == "" {
+					continue
+				}
+				if !src.Remote && !a.RemovedAt.IsZero() {
+					// deleted by local retention; only the uploaded copy is left
+					continue
+				}
+				if *service != "" && !strings.EqualFold(a.Service, *service) {
+					continue
+				}
+
+				checked++
+				if err := verifyArtifact(ctx, a, src); err != nil {
+					failed++
+					fmt.Printf("  ❌ [%s] %s: %v\n", a.Service, a.Path, err)
+					continue
+				}
+				fmt.Printf("  ✅ [%s] %s\n", a.Service, a.Path)
+			}
+		}
+	}
+
+	fmt.Printf("\n%d artifact(s) checked, %d failed\n", checked, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d of %d artifact(s) failed verification", failed, checked)
+	}
+	return nil
+}
+
+func verifyArtifact(ctx context.Context, a catalog.Artifact, src catalogSource) error {
+	if !src.Remote {
+		return catalog.Verify(a)
+	}
+	r, err := src.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	verr := catalog.VerifyReader(a, r)
+	if err := r.Close(); verr == nil && err != nil {
+		return fmt.Errorf("download: %w", err)
+	}
+	return verr
+}
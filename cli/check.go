@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/encrypt"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/notifier"
+	"github.com/fvoci/hyper-backup/scheduler"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// runCheckConfig implements `hyper-backup check-config [flags]`: it validates
+// every configured service without running any backup.
+func runCheckConfig(args []string) error {
+	fs := newFlagSet("check-config", "hyper-backup check-config [flags]")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+
+	err := checkConfig(true, func(name string, configured bool, err error) {
+		switch {
+		case !configured:
+			fmt.Printf("  ⏭️  %s: not configured\n", name)
+		case err != nil:
+			fmt.Printf("  ❌ %s: %v\n", name, err)
+		default:
+			fmt.Printf("  ✅ %s\n", name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Println("\nConfiguration OK")
+	return nil
+}
+
+// checkConfig validates every configured service with its real loader,
+// including its tools and directories, the schedule when the daemon uses it,
+// and the encryption and notification settings. report is called for each
+// service; the returned error joins every problem found.
+func checkConfig(daemon bool, report func(name string, configured bool, err error)) error {
+	var errs []error
+	configured, uploads := 0, 0
+	for _, stage := range []backup.Stage{backup.StageCore, backup.StageFiles, backup.StageStorage} {
+		for _, svc := range backup.Services(stage) {
+			if !svc.Configured() {
+				report(svc.Name(), false, nil)
+				continue
+			}
+			configured++
+			if stage == backup.StageStorage {
+				uploads++
+			}
+			err := svc.Validate()
+			report(svc.Name(), true, err)
+			if err != nil {
+				// One line per problem, each naming its service
+				for _, line := range strings.Split(err.Error(), "\n") {
+					errs = append(errs, fmt.Errorf("%s: %s", svc.Name(), line))
+				}
+			}
+		}
+	}
+
+	if daemon {
+		if err := scheduler.ValidateSchedule(os.Getenv("BACKUP_SCHEDULE"), os.Getenv("BACKUP_INTERVAL_HOURS")); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := encrypt.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("encryption: %w", err))
+	}
+	if err := storage.ValidateRetry(); err != nil {
+		errs = append(errs, fmt.Errorf("upload retries: %w", err))
+	}
+	if err := notifier.ValidateNotify(); err != nil {
+		errs = append(errs, fmt.Errorf("notifications: %w", err))
+	}
+
+	if uploads == 0 {
+		utilities.Logger.Warn("[HyperBackup] ⚠️ Warn: BACKUP WILL BE STORED LOCALLY ONLY")
+		if backup.LocalRetentionConfigured() {
+			utilities.Logger.Warn("[HyperBackup] ⚠️ No storage service configured: local retention deletes by its policy alone")
+		}
+	}
+	if configured == 0 {
+		utilities.Logger.Warn("[HyperBackup] 🤷 No backup services configured; nothing to do")
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,112 @@
+// Package cli implements the hyper-backup command line.
+package cli
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Version is set at build time with
+// -ldflags "-X github.com/fvoci/hyper-backup/cli.Version=1.2.3".
+var Version = "dev"
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	// Assigned here because the help command refers back to the list
+	commands = []command{
+		{"daemon", "run backups on BACKUP_SCHEDULE or BACKUP_INTERVAL_HOURS (default)", runDaemon},
+		{"run", "run one backup cycle, optionally only the named services, and exit", runOnce},
+		{"restore", "restore a database dump", runRestore},
+		{"list", "list backups recorded in the catalog", runList},
+		{"verify", "check recorded backups for corruption", runVerify},
+		{"prune", "apply the retention policies now, or print what they would delete", runPrune},
+		{"uploads", "list failed uploads waiting for a retry, or retry them now", runUploads},
+		{"check-config", "validate the configuration without running backups", runCheckConfig},
+		{"version", "print the version", runVersion},
+		{"help", "show this help", runHelp},
+	}
+}
+
+// Main runs the command named by args[0]. Without a command, or when args
+// start with a flag, it runs the daemon as the container always has.
+func Main(args []string) error {
+	name := "daemon"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+
+	for _, c := range commands {
+		if c.name == name {
+			err := c.run(args)
+			if errors.Is(err, flag.ErrHelp) {
+				return nil
+			}
+			return err
+		}
+	}
+	printHelp()
+	return fmt.Errorf("unknown command %q", name)
+}
+
+func runHelp(args []string) error {
+	printHelp()
+	return nil
+}
+
+func printHelp() {
+	out := os.Stderr
+	fmt.Fprintln(out, "Usage: hyper-backup [command] [flags]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-13s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(out, "\nEvery environment variable has a flag that overrides it, e.g. --mysql-host for MYSQL_HOST.")
+	fmt.Fprintln(out, "Run 'hyper-backup <command> -h' to list them.")
+}
+
+func runVersion(args []string) error {
+	fs := newFlagSet("version", "hyper-backup version")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fmt.Printf("hyper-backup %s (%s %s/%s)\n", Version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// parseInterspersed parses flags that may appear before, between or after positional arguments.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
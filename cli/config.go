@@ -0,0 +1,79 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/config"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// configFile is the file loaded by loadConfig, nil without CONFIG_FILE.
+var (
+	configFile   *config.File
+	configLoaded bool
+)
+
+// loadConfig reads CONFIG_FILE once, after the flags were parsed: its
+// settings fill in variables that are still unset and its instances are
+// registered as services.
+func loadConfig() (*config.File, error) {
+	if configLoaded {
+		return configFile, nil
+	}
+	configLoaded = true
+
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	f, err := config.Load(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Apply(); err != nil {
+		return nil, err
+	}
+	if level, ok := f.Settings["LOG_LEVEL"]; ok && os.Getenv("LOG_LEVEL") == level {
+		utilities.SetLogLevel(level)
+	}
+	if err := backup.RegisterInstances(f.Instances); err != nil {
+		return nil, err
+	}
+
+	utilities.Logger.Infof("[HyperBackup] 📄 Loaded %s: %d instance(s)", path, len(f.Instances))
+	configFile = f
+	return f, nil
+}
+
+// kindAliases maps the service names accepted on the command line to the
+// sections of the config file.
+var kindAliases = map[string]string{
+	"mysql":      "mysql",
+	"postgres":   "postgres",
+	"postgresql": "postgres",
+	"mongo":      "mongo",
+	"mongodb":    "mongo",
+}
+
+// findInstance resolves "<service>:<instance>", e.g. "mysql:reporting", to an
+// instance from the config file.
+func findInstance(ref string) (config.Instance, error) {
+	service, name, _ := strings.Cut(ref, ":")
+	kind := kindAliases[strings.ToLower(service)]
+
+	f, err := loadConfig()
+	if err != nil {
+		return config.Instance{}, err
+	}
+	if f != nil {
+		for _, inst := range f.Instances {
+			if inst.Kind == kind && strings.EqualFold(inst.Name, name) {
+				return inst, nil
+			}
+		}
+	}
+	return config.Instance{}, fmt.Errorf("no %s instance named %q in CONFIG_FILE", service, name)
+}
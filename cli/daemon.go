@@ -0,0 +1,131 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fvoci/hyper-backup/api"
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/metrics"
+	"github.com/fvoci/hyper-backup/scheduler"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// runDaemon implements `hyper-backup daemon`, the default command.
+func runDaemon(args []string) error {
+	fs := newFlagSet("daemon", "hyper-backup [daemon] [flags]")
+	once := fs.Bool("once", os.Getenv("BACKUP_RUN_ONCE") == "true", "run one backup cycle and exit, same as 'run' (or BACKUP_RUN_ONCE=true)")
+	services, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if *once {
+		return runCycle(services)
+	}
+	if len(services) > 0 {
+		return fmt.Errorf("services can only be selected with 'run'")
+	}
+
+	ctx, stop, err := start(true)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	apiAddr := os.Getenv("API_ADDR")
+	if apiAddr != "" {
+		go func() {
+			if err := api.Serve(ctx, apiAddr); err != nil {
+				utilities.Logger.Errorf("[API] ❌ Listener failed: %v", err)
+			}
+		}()
+	}
+	// The API serves /metrics too, so only start a second listener for a different address
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" && addr != apiAddr {
+		go func() {
+			if err := metrics.Serve(ctx, addr); err != nil {
+				utilities.Logger.Errorf("[Metrics] ❌ Listener failed: %v", err)
+			}
+		}()
+	}
+
+	schedule := os.Getenv("BACKUP_SCHEDULE")
+	interval := os.Getenv("BACKUP_INTERVAL_HOURS")
+
+	if schedule != "" && interval != "" {
+		utilities.Logger.Warn("[HyperBackup] ⚠️ Both BACKUP_SCHEDULE and BACKUP_INTERVAL_HOURS are set. Using BACKUP_SCHEDULE.")
+	}
+
+	scheduler.StartWithContext(ctx, schedule, interval)
+	return nil
+}
+
+// runOnce implements `hyper-backup run [flags] [service...]`.
+func runOnce(args []string) error {
+	fs := newFlagSet("run", "hyper-backup run [flags] [service...]")
+	services, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	return runCycle(services)
+}
+
+// runCycle runs one cycle limited to services, or BACKUP_RUN_SERVICES when
+// none are named, and returns the joined service errors.
+func runCycle(services []string) error {
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	if len(services) == 0 {
+		services = splitList(os.Getenv("BACKUP_RUN_SERVICES"))
+	}
+	if err := backup.ValidateSelection(services); err != nil {
+		return err
+	}
+
+	ctx, stop, err := start(false)
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	if len(services) > 0 {
+		ctx = backup.WithServices(ctx, services...)
+	}
+	return scheduler.RunOnce(ctx).Err()
+}
+
+// start checks the configuration, removes leftovers of an interrupted run
+// and returns a context cancelled by SIGINT/SIGTERM. A configuration error
+// stops here, so a broken container fails at start rather than at the first
+// scheduled cycle. daemon also checks the schedule.
+func start(daemon bool) (context.Context, context.CancelFunc, error) {
+	utilities.Logger.Info("[HyperBackup] ⏱️ Backup process starting")
+
+	if _, err := loadConfig(); err != nil {
+		return nil, nil, err
+	}
+	utilities.Logger.Info("[HyperBackup] 🔍 Checking configuration")
+	err := checkConfig(daemon, func(name string, configured bool, err error) {
+		switch {
+		case !configured:
+			utilities.Logger.Debugf("[HyperBackup] ⏭️ %s not configured", name)
+		case err != nil:
+			utilities.Logger.Errorf("[HyperBackup] ❌ %s: %v", name, err)
+		default:
+			utilities.Logger.Infof("[HyperBackup] ✅ %s configured", name)
+		}
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	utilities.Logger.Info("[HyperBackup] ✅ Configuration check complete")
+	utilities.LogDivider()
+	backup.CleanPartials()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	return ctx, stop, nil
+}
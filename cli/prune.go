@@ -0,0 +1,28 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fvoci/hyper-backup/backup"
+)
+
+// runPrune implements `hyper-backup prune [--dry-run] [flags]`: it applies the
+// local and remote retention policies outside a backup cycle.
+func runPrune(args []string) error {
+	fs := newFlagSet("prune", "hyper-backup prune [--dry-run] [flags]")
+	dryRun := fs.Bool("dry-run", false, "only print what would be deleted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return backup.Prune(ctx, *dryRun || os.Getenv("RETENTION_DRY_RUN") == "true")
+}
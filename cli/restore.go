@@ -0,0 +1,78 @@
+package cli
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	db "github.com/fvoci/hyper-backup/backup/database"
+	"github.com/mattn/go-isatty"
+)
+
+// runRestore implements `hyper-backup restore [flags] <service> <archive>`.
+// The service may name an instance from the config file, e.g. mysql:reporting.
+func runRestore(args []string) error {
+	fs := newFlagSet("restore", "hyper-backup restore [flags] <mysql|postgres|mongo>[:instance] <archive>")
+	var opts db.RestoreOptions
+	fs.StringVar(&opts.TargetDB, "target-db", "", "restore into this database instead of the configured one")
+	fs.BoolVar(&opts.Drop, "drop", false, "drop existing collections before restoring (MongoDB only)")
+	yes := fs.Bool("yes", os.Getenv("RESTORE_CONFIRM") == "yes", "skip the confirmation prompt (or RESTORE_CONFIRM=yes)")
+
+	positional, err := parseInterspersed(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		fs.Usage()
+		return fmt.Errorf("restore needs exactly a service and an archive")
+	}
+	service, archive := positional[0], positional[1]
+
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	if strings.Contains(service, ":") {
+		inst, err := findInstance(service)
+		if err != nil {
+			return err
+		}
+		opts.Env = inst.Env
+		service, _, _ = strings.Cut(service, ":")
+	}
+
+	target, err := db.RestoreTarget(service, opts)
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		if err := confirmRestore(service, archive, target); err != nil {
+			return err
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	return db.Restore(ctx, service, archive, opts)
+}
+
+// confirmRestore asks the operator to type the target database name.
+// Without a terminal there is nobody to ask, so the restore is refused.
+func confirmRestore(service, archive, target string) error {
+	if !isatty.IsTerminal(os.Stdin.Fd()) {
+		return fmt.Errorf("refusing to restore without confirmation; pass --yes or set RESTORE_CONFIRM=yes")
+	}
+
+	fmt.Printf("⚠️  Restoring %s into %s database '%s' will overwrite existing data.\n", archive, service, target)
+	fmt.Printf("Type '%s' to continue: ", target)
+
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if strings.TrimSpace(answer) != target {
+		return fmt.Errorf("restore aborted")
+	}
+	return nil
+}
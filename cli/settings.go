@@ -0,0 +1,323 @@
+package cli
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// setting is an environment variable that can also be given as a flag. The
+// flag name is the variable in lower case with dashes, e.g. MYSQL_HOST is
+// --mysql-host. A flag overrides the variable by setting it for this process,
+// so every runner keeps reading its configuration from the environment.
+type setting struct {
+	env    string
+	usage  string
+	isBool bool
+}
+
+// settings lists every variable hyper-backup reads, grouped as in the README.
+var settings = []setting{
+	{env: "BACKUP_SCHEDULE", usage: "cron expression for the daemon, e.g. \"0 0 * * *\""},
+	{env: "BACKUP_INTERVAL_HOURS", usage: "run the daemon every N hours instead of a cron schedule"},
+	{env: "BACKUP_CONCURRENCY", usage: "services of one stage run in parallel (default 1)"},
+	{env: "BACKUP_RUN_SERVICES", usage: "comma-separated services for a one-shot run"},
+	{env: "TZ", usage: "time zone for schedules and file names"},
+	{env: "LOG_LEVEL", usage: "log level: debug, info, warn, error"},
+	{env: "CONFIG_FILE", usage: "YAML or TOML file defining service instances and settings"},
+
+	{env: "MYSQL_HOST", usage: "MySQL host"},
+	{env: "MYSQL_PORT", usage: "MySQL port"},
+	{env: "MYSQL_USER", usage: "MySQL user"},
+	{env: "MYSQL_PASSWORD", usage: "MySQL password"},
+	{env: "MYSQL_DATABASE", usage: "MySQL database"},
+	{env: "MYSQL_DSN", usage: "MySQL DSN instead of host/user/password/database"},
+	{env: "MYSQL_BACKUP_DIR", usage: "MySQL dump directory"},
+	{env: "MYSQL_TIMEOUT", usage: "MySQL backup time limit, e.g. 30m"},
+	{env: "MYSQL_LOCAL_KEEP_LAST", usage: "local copies kept per source (default: LOCAL_KEEP_LAST)"},
+	{env: "MYSQL_LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source (default: LOCAL_KEEP_HOURLY)"},
+	{env: "MYSQL_LOCAL_KEEP_DAILY", usage: "daily local copies kept per source (default: LOCAL_KEEP_DAILY)"},
+	{env: "MYSQL_LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source (default: LOCAL_KEEP_WEEKLY)"},
+	{env: "MYSQL_LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source (default: LOCAL_KEEP_MONTHLY)"},
+	{env: "MYSQL_LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source (default: LOCAL_KEEP_YEARLY)"},
+	{env: "MYSQL_LOCAL_MAX_AGE", usage: "delete local copies older than this (default: LOCAL_MAX_AGE)"},
+	{env: "MYSQL_LOCAL_MAX_SIZE", usage: "cap on the total size of local copies (default: LOCAL_MAX_SIZE)"},
+
+	{env: "POSTGRES_HOST", usage: "PostgreSQL host"},
+	{env: "POSTGRES_PORT", usage: "PostgreSQL port"},
+	{env: "POSTGRES_USER", usage: "PostgreSQL user"},
+	{env: "POSTGRES_PASSWORD", usage: "PostgreSQL password"},
+	{env: "POSTGRES_DB", usage: "PostgreSQL database"},
+	{env: "POSTGRES_DSN", usage: "PostgreSQL connection URI"},
+	{env: "POSTGRES_DUMP_ALL", usage: "dump every database with pg_dumpall", isBool: true},
+	{env: "POSTGRES_BACKUP_DIR", usage: "PostgreSQL dump directory"},
+	{env: "POSTGRES_TIMEOUT", usage: "PostgreSQL backup time limit"},
+	{env: "POSTGRES_LOCAL_KEEP_LAST", usage: "local copies kept per source (default: LOCAL_KEEP_LAST)"},
+	{env: "POSTGRES_LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source (default: LOCAL_KEEP_HOURLY)"},
+	{env: "POSTGRES_LOCAL_KEEP_DAILY", usage: "daily local copies kept per source (default: LOCAL_KEEP_DAILY)"},
+	{env: "POSTGRES_LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source (default: LOCAL_KEEP_WEEKLY)"},
+	{env: "POSTGRES_LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source (default: LOCAL_KEEP_MONTHLY)"},
+	{env: "POSTGRES_LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source (default: LOCAL_KEEP_YEARLY)"},
+	{env: "POSTGRES_LOCAL_MAX_AGE", usage: "delete local copies older than this (default: LOCAL_MAX_AGE)"},
+	{env: "POSTGRES_LOCAL_MAX_SIZE", usage: "cap on the total size of local copies (default: LOCAL_MAX_SIZE)"},
+
+	{env: "MONGO_HOST", usage: "MongoDB host"},
+	{env: "MONGO_PORT", usage: "MongoDB port"},
+	{env: "MONGO_URI", usage: "MongoDB connection URI"},
+	{env: "MONGO_DB", usage: "MongoDB database (default: all)"},
+	{env: "MONGO_BACKUP_DIR", usage: "MongoDB dump directory"},
+	{env: "MONGO_TIMEOUT", usage: "MongoDB backup time limit"},
+	{env: "MONGO_LOCAL_KEEP_LAST", usage: "local copies kept per source (default: LOCAL_KEEP_LAST)"},
+	{env: "MONGO_LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source (default: LOCAL_KEEP_HOURLY)"},
+	{env: "MONGO_LOCAL_KEEP_DAILY", usage: "daily local copies kept per source (default: LOCAL_KEEP_DAILY)"},
+	{env: "MONGO_LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source (default: LOCAL_KEEP_WEEKLY)"},
+	{env: "MONGO_LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source (default: LOCAL_KEEP_MONTHLY)"},
+	{env: "MONGO_LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source (default: LOCAL_KEEP_YEARLY)"},
+	{env: "MONGO_LOCAL_MAX_AGE", usage: "delete local copies older than this (default: LOCAL_MAX_AGE)"},
+	{env: "MONGO_LOCAL_MAX_SIZE", usage: "cap on the total size of local copies (default: LOCAL_MAX_SIZE)"},
+
+	{env: "TRAEFIK_LOG_FILE", usage: "Traefik access log to rotate"},
+	{env: "TRAEFIK_BACKUP_DIR", usage: "additional directory for rotated Traefik logs"},
+	{env: "TRAEFIK_TIMEOUT", usage: "Traefik log rotation time limit"},
+	{env: "TRAEFIK_LOCAL_KEEP_LAST", usage: "local copies kept per source (default: LOCAL_KEEP_LAST)"},
+	{env: "TRAEFIK_LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source (default: LOCAL_KEEP_HOURLY)"},
+	{env: "TRAEFIK_LOCAL_KEEP_DAILY", usage: "daily local copies kept per source (default: LOCAL_KEEP_DAILY)"},
+	{env: "TRAEFIK_LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source (default: LOCAL_KEEP_WEEKLY)"},
+	{env: "TRAEFIK_LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source (default: LOCAL_KEEP_MONTHLY)"},
+	{env: "TRAEFIK_LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source (default: LOCAL_KEEP_YEARLY)"},
+	{env: "TRAEFIK_LOCAL_MAX_AGE", usage: "delete local copies older than this (default: LOCAL_MAX_AGE)"},
+	{env: "TRAEFIK_LOCAL_MAX_SIZE", usage: "cap on the total size of local copies (default: LOCAL_MAX_SIZE)"},
+
+	{env: "FILE_BACKUP_COMPRESSION", usage: "folder archive format: gzip or zstd"},
+	{env: "FILE_BACKUP_DIR", usage: "folder archive directory"},
+	{env: "FILE_BACKUP_TIMEOUT", usage: "folder backup time limit"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_LAST", usage: "local copies kept per source (default: LOCAL_KEEP_LAST)"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source (default: LOCAL_KEEP_HOURLY)"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_DAILY", usage: "daily local copies kept per source (default: LOCAL_KEEP_DAILY)"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source (default: LOCAL_KEEP_WEEKLY)"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source (default: LOCAL_KEEP_MONTHLY)"},
+	{env: "FILE_BACKUP_LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source (default: LOCAL_KEEP_YEARLY)"},
+	{env: "FILE_BACKUP_LOCAL_MAX_AGE", usage: "delete local copies older than this (default: LOCAL_MAX_AGE)"},
+	{env: "FILE_BACKUP_LOCAL_MAX_SIZE", usage: "cap on the total size of local copies (default: LOCAL_MAX_SIZE)"},
+	{env: "CATALOG_DIR", usage: "backup catalog directory"},
+	{env: "LOCAL_KEEP_LAST", usage: "local copies kept per source of every service"},
+	{env: "LOCAL_KEEP_HOURLY", usage: "hourly local copies kept per source of every service"},
+	{env: "LOCAL_KEEP_DAILY", usage: "daily local copies kept per source of every service"},
+	{env: "LOCAL_KEEP_WEEKLY", usage: "weekly local copies kept per source of every service"},
+	{env: "LOCAL_KEEP_MONTHLY", usage: "monthly local copies kept per source of every service"},
+	{env: "LOCAL_KEEP_YEARLY", usage: "yearly local copies kept per source of every service"},
+	{env: "LOCAL_MAX_AGE", usage: "delete local copies older than this, e.g. 30d"},
+	{env: "LOCAL_MAX_SIZE", usage: "cap on the total size of each service's local copies, e.g. 50G"},
+	{env: "RETENTION_DRY_RUN", usage: "only log what the retention policies would delete", isBool: true},
+
+	{env: "ENCRYPT_AGE_RECIPIENTS", usage: "age public keys to encrypt artifacts to"},
+	{env: "ENCRYPT_PASSPHRASE", usage: "age passphrase to encrypt and decrypt artifacts with"},
+	{env: "ENCRYPT_PGP_PUBLIC_KEY", usage: "armored OpenPGP public key to encrypt artifacts to"},
+	{env: "ENCRYPT_AGE_IDENTITY", usage: "age private key for restoring encrypted artifacts"},
+	{env: "ENCRYPT_PGP_PRIVATE_KEY", usage: "armored OpenPGP private key for restoring encrypted artifacts"},
+	{env: "ENCRYPT_PGP_PASSPHRASE", usage: "passphrase of the OpenPGP private key"},
+
+	{env: "RCLONE_REMOTE", usage: "rclone remote name"},
+	{env: "RCLONE_PATH", usage: "rclone upload target, e.g. remote:bucket/path"},
+	{env: "RCLONE_CONFIG_FILE", usage: "rclone config file"},
+	{env: "RCLONE_RETENTION_DAYS", usage: "delete remote backups older than N days (default 14 without RCLONE_KEEP_*)"},
+	{env: "RCLONE_KEEP_LAST", usage: "remote backups kept per source"},
+	{env: "RCLONE_KEEP_HOURLY", usage: "hourly remote backups kept per source"},
+	{env: "RCLONE_KEEP_DAILY", usage: "daily remote backups kept per source"},
+	{env: "RCLONE_KEEP_WEEKLY", usage: "weekly remote backups kept per source"},
+	{env: "RCLONE_KEEP_MONTHLY", usage: "monthly remote backups kept per source"},
+	{env: "RCLONE_KEEP_YEARLY", usage: "yearly remote backups kept per source"},
+	{env: "RCLONE_TIMEOUT", usage: "rclone upload time limit"},
+	{env: "RCLONE_BEST_EFFORT", usage: "a failed rclone upload does not fail the cycle", isBool: true},
+	{env: "RCLONE_ENCRYPT_AGE_RECIPIENTS", usage: "age public keys to encrypt plaintext artifacts to on the rclone remote only"},
+	{env: "RCLONE_ENCRYPT_PASSPHRASE", usage: "age passphrase to encrypt plaintext artifacts with on the rclone remote only"},
+	{env: "RCLONE_ENCRYPT_PGP_PUBLIC_KEY", usage: "armored OpenPGP public key to encrypt plaintext artifacts to on the rclone remote only"},
+	{env: "S3_ENDPOINT", usage: "S3 endpoint URL"},
+	{env: "AWS_ACCESS_KEY_ID", usage: "S3 access key"},
+	{env: "AWS_SECRET_ACCESS_KEY", usage: "S3 secret key"},
+	{env: "AWS_REGION", usage: "S3 region"},
+	{env: "S3_BUCKET", usage: "bucket for the built-in S3 client (instead of rclone)"},
+	{env: "S3_PREFIX", usage: "key prefix inside S3_BUCKET"},
+	{env: "S3_URL_STYLE", usage: "S3 addressing: path or virtual (default: path with S3_ENDPOINT, virtual for AWS)"},
+	{env: "S3_CA_FILE", usage: "PEM bundle of additional CAs trusted for the S3 endpoint"},
+	{env: "S3_PART_SIZE", usage: "multipart upload part size (default 16M)"},
+	{env: "S3_RETENTION_DAYS", usage: "delete S3 backups older than N days"},
+	{env: "S3_KEEP_LAST", usage: "S3 backups kept per source"},
+	{env: "S3_KEEP_HOURLY", usage: "hourly S3 backups kept per source"},
+	{env: "S3_KEEP_DAILY", usage: "daily S3 backups kept per source"},
+	{env: "S3_KEEP_WEEKLY", usage: "weekly S3 backups kept per source"},
+	{env: "S3_KEEP_MONTHLY", usage: "monthly S3 backups kept per source"},
+	{env: "S3_KEEP_YEARLY", usage: "yearly S3 backups kept per source"},
+	{env: "S3_TIMEOUT", usage: "S3 upload time limit"},
+	{env: "AWS_SESSION_TOKEN", usage: "S3 session token for temporary credentials"},
+	{env: "S3_BEST_EFFORT", usage: "a failed S3 upload does not fail the cycle", isBool: true},
+	{env: "S3_ENCRYPT_AGE_RECIPIENTS", usage: "age public keys to encrypt plaintext artifacts to on S3 only"},
+	{env: "S3_ENCRYPT_PASSPHRASE", usage: "age passphrase to encrypt plaintext artifacts with on S3 only"},
+	{env: "S3_ENCRYPT_PGP_PUBLIC_KEY", usage: "armored OpenPGP public key to encrypt plaintext artifacts to on S3 only"},
+	{env: "LOCAL_DEST_PATH", usage: "directory to copy artifacts to, e.g. an NFS mount"},
+	{env: "LOCAL_DEST_RETENTION_DAYS", usage: "delete copies in LOCAL_DEST_PATH older than N days"},
+	{env: "LOCAL_DEST_KEEP_LAST", usage: "copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_KEEP_HOURLY", usage: "hourly copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_KEEP_DAILY", usage: "daily copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_KEEP_WEEKLY", usage: "weekly copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_KEEP_MONTHLY", usage: "monthly copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_KEEP_YEARLY", usage: "yearly copies in LOCAL_DEST_PATH kept per source"},
+	{env: "LOCAL_DEST_TIMEOUT", usage: "local copy time limit"},
+	{env: "LOCAL_DEST_BEST_EFFORT", usage: "a failed LOCAL_DEST_PATH upload does not fail the cycle", isBool: true},
+	{env: "LOCAL_DEST_ENCRYPT_AGE_RECIPIENTS", usage: "age public keys to encrypt plaintext artifacts to on LOCAL_DEST_PATH only"},
+	{env: "LOCAL_DEST_ENCRYPT_PASSPHRASE", usage: "age passphrase to encrypt plaintext artifacts with on LOCAL_DEST_PATH only"},
+	{env: "LOCAL_DEST_ENCRYPT_PGP_PUBLIC_KEY", usage: "armored OpenPGP public key to encrypt plaintext artifacts to on LOCAL_DEST_PATH only"},
+	{env: "SFTP_HOST", usage: "SSH server to upload artifacts to over SFTP"},
+	{env: "SFTP_PORT", usage: "SSH port (default 22)"},
+	{env: "SFTP_USER", usage: "SSH user"},
+	{env: "SFTP_PATH", usage: "directory on the server to upload to, relative to the login directory unless absolute"},
+	{env: "SFTP_PRIVATE_KEY", usage: "PEM private key to log in with"},
+	{env: "SFTP_KEY_PASSPHRASE", usage: "passphrase of SFTP_PRIVATE_KEY"},
+	{env: "SFTP_PASSWORD", usage: "password to log in with"},
+	{env: "SFTP_KNOWN_HOSTS", usage: "known_hosts file to check the server's key against (default ~/.ssh/known_hosts)"},
+	{env: "SFTP_HOST_KEY", usage: "the server's public key in authorized_keys format, instead of SFTP_KNOWN_HOSTS"},
+	{env: "SFTP_RETENTION_DAYS", usage: "delete uploads on the SFTP server older than N days"},
+	{env: "SFTP_KEEP_LAST", usage: "uploads on the SFTP server kept per source"},
+	{env: "SFTP_KEEP_HOURLY", usage: "hourly uploads on the SFTP server kept per source"},
+	{env: "SFTP_KEEP_DAILY", usage: "daily uploads on the SFTP server kept per source"},
+	{env: "SFTP_KEEP_WEEKLY", usage: "weekly uploads on the SFTP server kept per source"},
+	{env: "SFTP_KEEP_MONTHLY", usage: "monthly uploads on the SFTP server kept per source"},
+	{env: "SFTP_KEEP_YEARLY", usage: "yearly uploads on the SFTP server kept per source"},
+	{env: "SFTP_TIMEOUT", usage: "SFTP upload time limit"},
+	{env: "SFTP_BEST_EFFORT", usage: "a failed SFTP upload does not fail the cycle", isBool: true},
+	{env: "SFTP_ENCRYPT_AGE_RECIPIENTS", usage: "age public keys to encrypt plaintext artifacts to on the SFTP server only"},
+	{env: "SFTP_ENCRYPT_PASSPHRASE", usage: "age passphrase to encrypt plaintext artifacts with on the SFTP server only"},
+	{env: "SFTP_ENCRYPT_PGP_PUBLIC_KEY", usage: "armored OpenPGP public key to encrypt plaintext artifacts to on the SFTP server only"},
+	{env: "RSYNC_SRC", usage: "rsync source"},
+	{env: "RSYNC_DEST", usage: "rsync destination"},
+	{env: "RSYNC_TIMEOUT", usage: "rsync time limit"},
+	{env: "RSYNC_BEST_EFFORT", usage: "a failed rsync does not fail the cycle", isBool: true},
+	{env: "UPLOAD_SKIP_ON_FAILURE", usage: "skip uploads when a backup service failed", isBool: true},
+	{env: "UPLOAD_STREAMING", usage: "upload each artifact as soon as it is written", isBool: true},
+	{env: "UPLOAD_RETRY_MAX_ATTEMPTS", usage: "failed attempts before an upload is given up (default 10, 0 = never)"},
+	{env: "UPLOAD_RETRY_BACKOFF", usage: "wait before the first upload retry, doubled each time (default 5m)"},
+	{env: "UPLOAD_RETRY_MAX_BACKOFF", usage: "longest wait between upload retries (default 6h)"},
+	{env: "UPLOAD_STUCK_AFTER", usage: "notify about uploads failing for this long (default 24h, 0 = never)"},
+
+	{env: "NOTIFY_POLICY", usage: "notify on: failure, always or recovery"},
+	{env: "NOTIFY_WEBHOOK_URL", usage: "generic JSON webhook"},
+	{env: "NOTIFY_SLACK_URL", usage: "Slack/Mattermost incoming webhook"},
+	{env: "NOTIFY_DISCORD_URL", usage: "Discord webhook"},
+	{env: "NOTIFY_SMTP_HOST", usage: "SMTP server"},
+	{env: "NOTIFY_SMTP_PORT", usage: "SMTP port"},
+	{env: "NOTIFY_SMTP_USERNAME", usage: "SMTP user"},
+	{env: "NOTIFY_SMTP_PASSWORD", usage: "SMTP password"},
+	{env: "NOTIFY_SMTP_FROM", usage: "email sender"},
+	{env: "NOTIFY_SMTP_TO", usage: "comma-separated email recipients"},
+	{env: "NOTIFY_SMTP_TLS", usage: "SMTP TLS mode: starttls, tls or none"},
+	{env: "NOTIFY_TITLE_TEMPLATE", usage: "notification title template"},
+	{env: "NOTIFY_TEMPLATE", usage: "notification body template"},
+	{env: "NOTIFY_HOSTNAME", usage: "host name shown in notifications"},
+
+	{env: "API_ADDR", usage: "listen address of the HTTP API, e.g. :8080"},
+	{env: "API_TOKEN", usage: "bearer token for the API's POST endpoints"},
+	{env: "METRICS_ADDR", usage: "listen address for Prometheus metrics, e.g. :9100"},
+}
+
+func flagName(env string) string {
+	return strings.ToLower(strings.ReplaceAll(env, "_", "-"))
+}
+
+// envValue sets its environment variable when the flag is given.
+type envValue struct {
+	env    string
+	isBool bool
+}
+
+func (v *envValue) String() string { return "" }
+
+func (v *envValue) Set(s string) error {
+	if v.isBool {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		s = strconv.FormatBool(b)
+	}
+	if err := os.Setenv(v.env, s); err != nil {
+		return err
+	}
+	if key, ok := strings.CutSuffix(v.env, "_FILE"); ok && utilities.HasFileVariant(key) {
+		// The flag overrides the variable, which would otherwise win
+		os.Unsetenv(key)
+	}
+	if v.env == "LOG_LEVEL" {
+		utilities.SetLogLevel(s)
+	}
+	return nil
+}
+
+func (v *envValue) IsBoolFlag() bool { return v.isBool }
+
+// packUpValue numbers folders given with repeated --pack-up flags as
+// PACK_UP_HYPER_BACKUP_1, _2, ... replacing folders from the environment.
+type packUpValue struct {
+	n int
+}
+
+func (v *packUpValue) String() string { return "" }
+
+func (v *packUpValue) Set(s string) error {
+	if v.n == 0 {
+		for i := 1; os.Getenv(fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", i)) != ""; i++ {
+			os.Unsetenv(fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", i))
+		}
+	}
+	v.n++
+	return os.Setenv(fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", v.n), s)
+}
+
+// addSettings registers a flag for every setting on fs. Credentials only get
+// a --*-file flag, so the secret itself never shows up in the process list.
+func addSettings(fs *flag.FlagSet) {
+	for _, s := range settings {
+		if !utilities.IsSecret(s.env) {
+			fs.Var(&envValue{env: s.env, isBool: s.isBool}, flagName(s.env), s.usage+" ("+s.env+")")
+		}
+		if utilities.HasFileVariant(s.env) {
+			fileEnv := s.env + "_FILE"
+			fs.Var(&envValue{env: fileEnv}, flagName(fileEnv), "file containing the "+s.usage+" ("+fileEnv+")")
+		}
+	}
+	fs.Var(&packUpValue{}, "pack-up", "folder to archive, repeatable (PACK_UP_HYPER_BACKUP_N)")
+}
+
+// newFlagSet creates the flag set of a command. usage is printed first,
+// followed by the command's own flags and then the settings.
+func newFlagSet(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	addSettings(fs)
+	fs.Usage = func() {
+		out := fs.Output()
+		fmt.Fprintf(out, "Usage: %s\n", usage)
+		printFlags(out, fs, false)
+		fmt.Fprintln(out, "\nSettings (override the environment variable in parentheses):")
+		printFlags(out, fs, true)
+	}
+	return fs
+}
+
+func printFlags(out io.Writer, fs *flag.FlagSet, wantSettings bool) {
+	fs.VisitAll(func(f *flag.Flag) {
+		_, isEnv := f.Value.(*envValue)
+		_, isPackUp := f.Value.(*packUpValue)
+		if (isEnv || isPackUp) != wantSettings {
+			return
+		}
+		usage := f.Usage
+		if !wantSettings && f.DefValue != "" && f.DefValue != "false" {
+			usage += fmt.Sprintf(" (default %s)", f.DefValue)
+		}
+		fmt.Fprintf(out, "  --%s\n    \t%s\n", f.Name, usage)
+	})
+}
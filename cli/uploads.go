@@ -0,0 +1,66 @@
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// runUploads implements `hyper-backup uploads [--retry] [flags]`: it lists the
+// upload retry queue, or retries every upload the per-artifact destinations
+// (see storage.PerArtifact) are missing, including those the queue gave up on.
+func runUploads(args []string) error {
+	fs := newFlagSet("uploads", "hyper-backup uploads [--retry] [flags]")
+	retry := fs.Bool("retry", false, "retry every missing upload now instead of listing the queue")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if !*retry {
+		entries, err := storage.QueuedUploads()
+		if err != nil {
+			return err
+		}
+		printQueue(entries)
+		return nil
+	}
+
+	if _, err := loadConfig(); err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	report := backup.RetryUploads(ctx, true)
+	if report == nil {
+		utilities.Logger.Info("[HyperBackup] ✅ Every artifact has a verified copy on each destination")
+		return nil
+	}
+	return report.Err()
+}
+
+// printQueue prints the failed uploads with their next retry.
+func printQueue(entries []storage.QueuedUpload) {
+	if len(entries) == 0 {
+		fmt.Println("No failed uploads queued")
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET\tATTEMPTS\tFAILING SINCE\tNEXT RETRY\tPATH\tLAST ERROR")
+	for _, e := range entries {
+		next := e.NextAttempt.Format("2006-01-02 15:04:05")
+		if e.GaveUp {
+			next = "gave up"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n",
+			e.Target, e.Attempts, e.FirstFailed.Format("2006-01-02 15:04:05"), next, e.Path, e.LastError)
+	}
+	w.Flush()
+}
@@ -0,0 +1,387 @@
+// Package config reads the optional configuration file named by CONFIG_FILE.
+// The file lists service instances — several database servers, folder sets
+// and storage destinations, each with its own name, credentials, schedule and
+// retention — next to global settings. Every instance is translated to the
+// environment variables its runner reads, so the environment remains a
+// shorthand for a single instance of each service.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/robfig/cron/v3"
+	"gopkg.in/yaml.v3"
+
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// backupRoot is where instances keep their files unless backup_dir is set.
+const backupRoot = "/home/hyper-backup"
+
+// File is a parsed configuration file.
+type File struct {
+	// Settings are global environment variables, e.g. BACKUP_SCHEDULE.
+	Settings map[string]string
+	// Instances are the services defined in the file, in file order per kind.
+	Instances []Instance
+}
+
+// Instance is one named service instance.
+type Instance struct {
+	// Kind is the section it was defined in, e.g. "mysql" or "rclone".
+	Kind string
+	// Name is unique within its kind.
+	Name string
+	// Schedule is a cron expression; empty runs the instance in every cycle.
+	Schedule string
+	// Env holds the instance's settings under their environment variable names.
+	Env utilities.Env
+}
+
+// kind describes a section of the file. keys maps the keys accepted in an
+// instance to the variables the runner reads; dirKey defaults to a directory
+// of its own per instance so instances never overwrite each other's files.
+type kind struct {
+	name   string
+	keys   map[string]string
+	dirKey string
+	dir    string
+}
+
+var kinds = []kind{
+	{
+		name: "mysql",
+		keys: withLocalRetention("MYSQL", map[string]string{
+			"host": "MYSQL_HOST", "port": "MYSQL_PORT", "user": "MYSQL_USER", "password": "MYSQL_PASSWORD",
+			"database": "MYSQL_DATABASE", "dsn": "MYSQL_DSN", "backup_dir": "MYSQL_BACKUP_DIR", "timeout": "MYSQL_TIMEOUT",
+		}),
+		dirKey: "MYSQL_BACKUP_DIR",
+		dir:    "mysql",
+	},
+	{
+		name: "postgres",
+		keys: withLocalRetention("POSTGRES", map[string]string{
+			"host": "POSTGRES_HOST", "port": "POSTGRES_PORT", "user": "POSTGRES_USER", "password": "POSTGRES_PASSWORD",
+			"db": "POSTGRES_DB", "dsn": "POSTGRES_DSN", "dump_all": "POSTGRES_DUMP_ALL",
+			"backup_dir": "POSTGRES_BACKUP_DIR", "timeout": "POSTGRES_TIMEOUT",
+		}),
+		dirKey: "POSTGRES_BACKUP_DIR",
+		dir:    "postgres",
+	},
+	{
+		name: "mongo",
+		keys: withLocalRetention("MONGO", map[string]string{
+			"host": "MONGO_HOST", "port": "MONGO_PORT", "uri": "MONGO_URI", "db": "MONGO_DB",
+			"backup_dir": "MONGO_BACKUP_DIR", "timeout": "MONGO_TIMEOUT",
+		}),
+		dirKey: "MONGO_BACKUP_DIR",
+		dir:    "mongo",
+	},
+	{
+		name: "folders",
+		keys: withLocalRetention("FILE_BACKUP", map[string]string{
+			"compression": "FILE_BACKUP_COMPRESSION", "backup_dir": "FILE_BACKUP_DIR", "timeout": "FILE_BACKUP_TIMEOUT",
+		}),
+		dirKey: "FILE_BACKUP_DIR",
+		dir:    "files",
+	},
+	{
+		name: "rclone",
+		keys: withDestination("RCLONE", map[string]string{
+			"remote": "RCLONE_REMOTE", "path": "RCLONE_PATH", "config_file": "RCLONE_CONFIG_FILE",
+			"retention_days": "RCLONE_RETENTION_DAYS", "timeout": "RCLONE_TIMEOUT",
+			"keep_last": "RCLONE_KEEP_LAST", "keep_hourly": "RCLONE_KEEP_HOURLY", "keep_daily": "RCLONE_KEEP_DAILY",
+			"keep_weekly": "RCLONE_KEEP_WEEKLY", "keep_monthly": "RCLONE_KEEP_MONTHLY", "keep_yearly": "RCLONE_KEEP_YEARLY",
+			"endpoint": "S3_ENDPOINT", "access_key_id": "AWS_ACCESS_KEY_ID",
+			"secret_access_key": "AWS_SECRET_ACCESS_KEY", "region": "AWS_REGION",
+		}),
+	},
+	{
+		name: "s3",
+		keys: withDestination("S3", map[string]string{
+			"bucket": "S3_BUCKET", "prefix": "S3_PREFIX", "endpoint": "S3_ENDPOINT", "region": "AWS_REGION",
+			"access_key_id": "AWS_ACCESS_KEY_ID", "secret_access_key": "AWS_SECRET_ACCESS_KEY", "session_token": "AWS_SESSION_TOKEN",
+			"url_style": "S3_URL_STYLE", "ca_file": "S3_CA_FILE", "part_size": "S3_PART_SIZE",
+			"retention_days": "S3_RETENTION_DAYS", "timeout": "S3_TIMEOUT",
+			"keep_last": "S3_KEEP_LAST", "keep_hourly": "S3_KEEP_HOURLY", "keep_daily": "S3_KEEP_DAILY",
+			"keep_weekly": "S3_KEEP_WEEKLY", "keep_monthly": "S3_KEEP_MONTHLY", "keep_yearly": "S3_KEEP_YEARLY",
+		}),
+	},
+	{
+		name: "local",
+		keys: withDestination("LOCAL_DEST", map[string]string{
+			"path": "LOCAL_DEST_PATH", "retention_days": "LOCAL_DEST_RETENTION_DAYS", "timeout": "LOCAL_DEST_TIMEOUT",
+			"keep_last": "LOCAL_DEST_KEEP_LAST", "keep_hourly": "LOCAL_DEST_KEEP_HOURLY", "keep_daily": "LOCAL_DEST_KEEP_DAILY",
+			"keep_weekly": "LOCAL_DEST_KEEP_WEEKLY", "keep_monthly": "LOCAL_DEST_KEEP_MONTHLY", "keep_yearly": "LOCAL_DEST_KEEP_YEARLY",
+		}),
+	},
+	{
+		name: "sftp",
+		keys: withDestination("SFTP", map[string]string{
+			"host": "SFTP_HOST", "port": "SFTP_PORT", "user": "SFTP_USER", "path": "SFTP_PATH",
+			"password": "SFTP_PASSWORD", "private_key": "SFTP_PRIVATE_KEY", "key_passphrase": "SFTP_KEY_PASSPHRASE",
+			"known_hosts": "SFTP_KNOWN_HOSTS", "host_key": "SFTP_HOST_KEY",
+			"retention_days": "SFTP_RETENTION_DAYS", "timeout": "SFTP_TIMEOUT",
+			"keep_last": "SFTP_KEEP_LAST", "keep_hourly": "SFTP_KEEP_HOURLY", "keep_daily": "SFTP_KEEP_DAILY",
+			"keep_weekly": "SFTP_KEEP_WEEKLY", "keep_monthly": "SFTP_KEEP_MONTHLY", "keep_yearly": "SFTP_KEEP_YEARLY",
+		}),
+	},
+	{
+		name: "rsync",
+		keys: map[string]string{"src": "RSYNC_SRC", "dest": "RSYNC_DEST", "timeout": "RSYNC_TIMEOUT", "best_effort": "RSYNC_BEST_EFFORT"},
+	},
+}
+
+// withLocalRetention adds the local retention keys of a service, e.g.
+// local_keep_daily for MYSQL_LOCAL_KEEP_DAILY, to keys.
+func withLocalRetention(prefix string, keys map[string]string) map[string]string {
+	for _, k := range []string{"keep_last", "keep_hourly", "keep_daily", "keep_weekly", "keep_monthly", "keep_yearly", "max_age", "max_size"} {
+		keys["local_"+k] = prefix + "_LOCAL_" + strings.ToUpper(k)
+	}
+	return keys
+}
+
+// withDestination adds the keys every artifact destination accepts, e.g.
+// best_effort for S3_BEST_EFFORT and encrypt_passphrase for
+// S3_ENCRYPT_PASSPHRASE, to keys.
+func withDestination(prefix string, keys map[string]string) map[string]string {
+	for _, k := range []string{"best_effort", "encrypt_age_recipients", "encrypt_passphrase", "encrypt_pgp_public_key"} {
+		keys[k] = prefix + "_" + strings.ToUpper(k)
+	}
+	return keys
+}
+
+var (
+	validName    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+	validSetting = regexp.MustCompile(`^[A-Z][A-Z0-9_]*$`)
+	cronParser   = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+)
+
+// Load reads a YAML (.yaml, .yml) or TOML (.toml) configuration file.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		if err := dec.Decode(&doc); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("%s: unknown config format %q (expected .yaml, .yml or .toml)", path, ext)
+	}
+
+	f, err := parse(doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return f, nil
+}
+
+func parse(doc map[string]any) (*File, error) {
+	f := &File{Settings: map[string]string{}}
+	var errs []error
+
+	for _, key := range sortedKeys(doc) {
+		if key != "settings" && findKind(key) == nil {
+			errs = append(errs, fmt.Errorf("unknown section %q", key))
+		}
+	}
+
+	if raw, ok := doc["settings"]; ok {
+		settings, ok := raw.(map[string]any)
+		if !ok {
+			errs = append(errs, fmt.Errorf("settings: expected a map of environment variables"))
+		}
+		for _, key := range sortedKeys(settings) {
+			s, err := scalar(settings[key])
+			switch {
+			case !validSetting.MatchString(key):
+				errs = append(errs, fmt.Errorf("settings: %q is not an environment variable name", key))
+			case err != nil:
+				errs = append(errs, fmt.Errorf("settings.%s: %w", key, err))
+			default:
+				f.Settings[key] = s
+			}
+		}
+	}
+
+	for _, k := range kinds {
+		raw, ok := doc[k.name]
+		if !ok {
+			continue
+		}
+		list, ok := tables(raw)
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: expected a list of instances", k.name))
+			continue
+		}
+		seen := map[string]bool{}
+		for i, table := range list {
+			inst, instErrs := k.instance(table)
+			for _, err := range instErrs {
+				errs = append(errs, fmt.Errorf("%s[%d]: %w", k.name, i, err))
+			}
+			if len(instErrs) > 0 {
+				continue
+			}
+			if seen[strings.ToLower(inst.Name)] {
+				errs = append(errs, fmt.Errorf("%s[%d]: duplicate name %q", k.name, i, inst.Name))
+				continue
+			}
+			seen[strings.ToLower(inst.Name)] = true
+			f.Instances = append(f.Instances, inst)
+		}
+	}
+	return f, errors.Join(errs...)
+}
+
+// instance translates one entry of the section to an Instance.
+func (k *kind) instance(table map[string]any) (Instance, []error) {
+	inst := Instance{Kind: k.name}
+	values := map[string]string{}
+	var errs []error
+
+	for _, key := range sortedKeys(table) {
+		v := table[key]
+		switch {
+		case key == "name":
+			inst.Name, _ = v.(string)
+		case key == "schedule":
+			inst.Schedule, _ = v.(string)
+			if _, err := cronParser.Parse(inst.Schedule); err != nil {
+				errs = append(errs, fmt.Errorf("schedule: %v", err))
+			}
+		case key == "paths" && k.name == "folders":
+			paths, ok := v.([]any)
+			if !ok {
+				errs = append(errs, fmt.Errorf("paths: expected a list of folders"))
+				continue
+			}
+			for i, p := range paths {
+				s, ok := p.(string)
+				if !ok || s == "" {
+					errs = append(errs, fmt.Errorf("paths[%d]: expected a folder", i))
+					continue
+				}
+				values[fmt.Sprintf("PACK_UP_HYPER_BACKUP_%d", i+1)] = s
+			}
+		case k.keys[key] != "":
+			s, err := scalar(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			values[k.keys[key]] = s
+		case strings.HasSuffix(key, "_file") && utilities.HasFileVariant(k.keys[strings.TrimSuffix(key, "_file")]):
+			// e.g. password_file: /run/secrets/mysql
+			s, err := scalar(v)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", key, err))
+				continue
+			}
+			values[k.keys[strings.TrimSuffix(key, "_file")]+"_FILE"] = s
+		default:
+			errs = append(errs, fmt.Errorf("unknown key %q", key))
+		}
+	}
+
+	if !validName.MatchString(inst.Name) {
+		errs = append(errs, fmt.Errorf("name %q must be letters, digits, '.', '_' or '-'", inst.Name))
+	}
+	if k.dirKey != "" && values[k.dirKey] == "" {
+		values[k.dirKey] = filepath.Join(backupRoot, k.dir, inst.Name)
+	}
+	inst.Env = utilities.NewEnv(values)
+	return inst, errs
+}
+
+// Apply sets the file's global settings that are not already set in the
+// environment, so variables and flags take precedence over the file.
+func (f *File) Apply() error {
+	for key, v := range f.Settings {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func findKind(name string) *kind {
+	for i := range kinds {
+		if kinds[i].name == name {
+			return &kinds[i]
+		}
+	}
+	return nil
+}
+
+// tables accepts a YAML sequence of maps or a TOML array of tables.
+func tables(v any) ([]map[string]any, bool) {
+	switch list := v.(type) {
+	case []map[string]any:
+		return list, true
+	case []any:
+		out := make([]map[string]any, 0, len(list))
+		for _, item := range list {
+			m, ok := item.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			out = append(out, m)
+		}
+		return out, true
+	default:
+		return nil, false
+	}
+}
+
+// scalar formats a value the way it would be written in the environment.
+func scalar(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int:
+		return strconv.Itoa(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("expected a string, number or boolean, got %T", v)
+	}
+}
@@ -0,0 +1,157 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	type want struct {
+		kind, name, schedule string
+		env                  map[string]string
+	}
+	instances := []want{
+		{"mysql", "shop", "", map[string]string{
+			"MYSQL_HOST": "db1", "MYSQL_PORT": "3307", "MYSQL_PASSWORD": "s3cret", "MYSQL_BACKUP_DIR": "/home/hyper-backup/mysql/shop",
+		}},
+		{"mysql", "blog", "0 */6 * * *", map[string]string{
+			"MYSQL_HOST": "db2", "MYSQL_PORT": "", "MYSQL_BACKUP_DIR": "/data/blog",
+		}},
+		{"folders", "www", "", map[string]string{
+			"PACK_UP_HYPER_BACKUP_1": "/var/www", "PACK_UP_HYPER_BACKUP_2": "/etc/nginx", "FILE_BACKUP_DIR": "/home/hyper-backup/files/www",
+		}},
+	}
+
+	tests := []struct {
+		file    string
+		content string
+	}{
+		{"hyper-backup.yaml", `
+settings:
+  BACKUP_SCHEDULE: "0 3 * * *"
+  BACKUP_CONCURRENCY: 2
+mysql:
+  - name: shop
+    host: db1
+    port: 3307
+    password: s3cret
+  - name: blog
+    host: db2
+    schedule: "0 */6 * * *"
+    backup_dir: /data/blog
+folders:
+  - name: www
+    paths: [/var/www, /etc/nginx]
+`},
+		{"hyper-backup.toml", `
+[settings]
+BACKUP_SCHEDULE = "0 3 * * *"
+BACKUP_CONCURRENCY = 2
+
+[[mysql]]
+name = "shop"
+host = "db1"
+port = 3307
+password = "s3cret"
+
+[[mysql]]
+name = "blog"
+host = "db2"
+schedule = "0 */6 * * *"
+backup_dir = "/data/blog"
+
+[[folders]]
+name = "www"
+paths = ["/var/www", "/etc/nginx"]
+`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			f, err := Load(writeConfig(t, tt.file, tt.content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.Settings) != 2 || f.Settings["BACKUP_SCHEDULE"] != "0 3 * * *" || f.Settings["BACKUP_CONCURRENCY"] != "2" {
+				t.Errorf("Settings = %v", f.Settings)
+			}
+			if len(f.Instances) != len(instances) {
+				t.Fatalf("got %d instances, want %d", len(f.Instances), len(instances))
+			}
+			for i, w := range instances {
+				inst := f.Instances[i]
+				if inst.Kind != w.kind || inst.Name != w.name || inst.Schedule != w.schedule {
+					t.Errorf("instance %d = %s %q scheduled %q, want %s %q scheduled %q", i, inst.Kind, inst.Name, inst.Schedule, w.kind, w.name, w.schedule)
+				}
+				for key, v := range w.env {
+					if got := inst.Env.Getenv(key); got != v {
+						t.Errorf("%s %s: %s = %q, want %q", w.kind, w.name, key, got, v)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		wantErr []string
+	}{
+		{"unknown format", "config.json", `{}`, []string{`unknown config format ".json"`}},
+		{"invalid yaml", "c.yaml", "mysql: [", []string{"c.yaml: yaml:"}},
+		{"unknown section", "c.yaml", "mysqll: []", []string{`unknown section "mysqll"`}},
+		{"section is no list", "c.yaml", "mysql: {name: a}", []string{"mysql: expected a list of instances"}},
+		{"unknown key", "c.yaml", "mysql: [{name: a, hots: db}]", []string{`mysql[0]: unknown key "hots"`}},
+		{"invalid name", "c.yaml", "mysql: [{name: a/b}]", []string{`mysql[0]: name "a/b" must be`}},
+		{"missing name", "c.toml", "[[rsync]]\nsrc = \"/a\"", []string{`rsync[0]: name "" must be`}},
+		{"duplicate name", "c.yaml", "mongo: [{name: Main}, {name: main}]", []string{`mongo[1]: duplicate name "main"`}},
+		{"invalid schedule", "c.yaml", "mysql: [{name: a, schedule: every day}]", []string{"mysql[0]: schedule:"}},
+		{"nested value", "c.yaml", "mysql: [{name: a, host: {x: 1}}]", []string{"mysql[0]: host: expected a string, number or boolean"}},
+		{"paths is no list", "c.yaml", "folders: [{name: a, paths: /var/www}]", []string{"folders[0]: paths: expected a list of folders"}},
+		{"invalid setting", "c.yaml", "settings: {backup_schedule: x}", []string{`settings: "backup_schedule" is not an environment variable name`}},
+		{
+			"every problem is reported", "c.yaml", "settings: {lower: x}\nrsync: [{name: a, dst: b}]\nfoo: 1",
+			[]string{`unknown section "foo"`, `"lower" is not`, `rsync[0]: unknown key "dst"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Load(writeConfig(t, tt.file, tt.content))
+			for _, want := range tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("Load error = %v, want %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	t.Setenv("BACKUP_SCHEDULE", "@hourly")
+	t.Setenv("BACKUP_CONCURRENCY", "")
+	os.Unsetenv("BACKUP_CONCURRENCY")
+	t.Setenv("UPLOAD_STREAMING", "")
+
+	f := &File{Settings: map[string]string{"BACKUP_SCHEDULE": "0 3 * * *", "BACKUP_CONCURRENCY": "4", "UPLOAD_STREAMING": "true"}}
+	if err := f.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{"BACKUP_SCHEDULE": "@hourly", "BACKUP_CONCURRENCY": "4", "UPLOAD_STREAMING": ""} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// Package metrics exposes backup health in the Prometheus text format.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+type serviceStats struct {
+	stage        string
+	lastRun      time.Time
+	lastSuccess  time.Time
+	lastDuration time.Duration
+	lastBytes    int64
+	runs         map[string]uint64
+	failures     uint64
+	uploadBytes  uint64
+}
+
+var (
+	mu          sync.Mutex
+	services    = map[string]*serviceStats{}
+	cycles      = map[string]uint64{}
+	lastCycle   time.Time
+	cycleLength time.Duration
+	nextRun     time.Time
+)
+
+func stats(service string) *serviceStats {
+	s, ok := services[service]
+	if !ok {
+		s = &serviceStats{runs: map[string]uint64{}}
+		services[service] = s
+	}
+	return s
+}
+
+// ObserveService records one run of a service. bytes is the size of what it
+// wrote; status is "success", "failed" or "skipped".
+func ObserveService(service, stage, status string, finished time.Time, duration time.Duration, bytes int64) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	s := stats(service)
+	s.stage = stage
+	s.runs[status]++
+	if status == "skipped" {
+		return
+	}
+	s.lastRun = finished
+	s.lastDuration = duration
+	switch status {
+	case "success":
+		s.lastSuccess = finished
+		s.lastBytes = bytes
+	case "failed":
+		s.failures++
+	}
+}
+
+// ObserveUpload adds bytes sent by an upload service.
+func ObserveUpload(service string, bytes int64) {
+	mu.Lock()
+	defer mu.Unlock()
+	stats(service).uploadBytes += uint64(bytes)
+}
+
+// ObserveCycle records the end of a backup cycle.
+func ObserveCycle(status string, finished time.Time, duration time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	cycles[status]++
+	lastCycle = finished
+	cycleLength = duration
+}
+
+// SetNextRun records when the scheduler starts the next cycle.
+func SetNextRun(t time.Time) {
+	mu.Lock()
+	defer mu.Unlock()
+	nextRun = t
+}
+
+// Serve exposes /metrics on addr until ctx is cancelled.
+func Serve(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	utilities.Logger.Infof("[Metrics] 📈 Serving Prometheus metrics on %s/metrics", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Handler writes the current metrics in the Prometheus text exposition format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Write(w)
+	})
+}
+
+// Write renders all metrics to w.
+func Write(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(services))
+	for name := range services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	family(w, "hyper_backup_service_last_success_timestamp_seconds", "gauge",
+		"Unix time of the last successful run of a service.")
+	for _, name := range names {
+		if s := services[name]; !s.lastSuccess.IsZero() {
+			sample(w, "hyper_backup_service_last_success_timestamp_seconds", serviceLabels(name, s), unix(s.lastSuccess))
+		}
+	}
+
+	family(w, "hyper_backup_service_last_run_timestamp_seconds", "gauge",
+		"Unix time of the last run of a service, successful or not.")
+	for _, name := range names {
+		if s := services[name]; !s.lastRun.IsZero() {
+			sample(w, "hyper_backup_service_last_run_timestamp_seconds", serviceLabels(name, s), unix(s.lastRun))
+		}
+	}
+
+	family(w, "hyper_backup_service_last_duration_seconds", "gauge",
+		"Duration of the last run of a service.")
+	for _, name := range names {
+		if s := services[name]; !s.lastRun.IsZero() {
+			sample(w, "hyper_backup_service_last_duration_seconds", serviceLabels(name, s), s.lastDuration.Seconds())
+		}
+	}
+
+	family(w, "hyper_backup_service_last_artifact_bytes", "gauge",
+		"Total size of the artifacts written by the last successful run of a service.")
+	for _, name := range names {
+		if s := services[name]; !s.lastSuccess.IsZero() {
+			sample(w, "hyper_backup_service_last_artifact_bytes", serviceLabels(name, s), float64(s.lastBytes))
+		}
+	}
+
+	family(w, "hyper_backup_service_runs_total", "counter",
+		"Runs of a service by outcome.")
+	for _, name := range names {
+		s := services[name]
+		for _, status := range sortedKeys(s.runs) {
+			labels := serviceLabels(name, s) + `,status="` + escape(status) + `"`
+			sample(w, "hyper_backup_service_runs_total", labels, float64(s.runs[status]))
+		}
+	}
+
+	family(w, "hyper_backup_service_failures_total", "counter",
+		"Failed runs of a service.")
+	for _, name := range names {
+		s := services[name]
+		sample(w, "hyper_backup_service_failures_total", serviceLabels(name, s), float64(s.failures))
+	}
+
+	family(w, "hyper_backup_upload_bytes_total", "counter",
+		"Bytes of artifacts sent by an upload service.")
+	for _, name := range names {
+		if s := services[name]; s.uploadBytes > 0 {
+			sample(w, "hyper_backup_upload_bytes_total", serviceLabels(name, s), float64(s.uploadBytes))
+		}
+	}
+
+	family(w, "hyper_backup_cycles_total", "counter", "Backup cycles by outcome.")
+	for _, status := range sortedKeys(cycles) {
+		sample(w, "hyper_backup_cycles_total", `status="`+escape(status)+`"`, float64(cycles[status]))
+	}
+
+	family(w, "hyper_backup_last_cycle_timestamp_seconds", "gauge", "Unix time the last backup cycle finished.")
+	if !lastCycle.IsZero() {
+		sample(w, "hyper_backup_last_cycle_timestamp_seconds", "", unix(lastCycle))
+	}
+	family(w, "hyper_backup_last_cycle_duration_seconds", "gauge", "Duration of the last backup cycle.")
+	if !lastCycle.IsZero() {
+		sample(w, "hyper_backup_last_cycle_duration_seconds", "", cycleLength.Seconds())
+	}
+	family(w, "hyper_backup_next_run_timestamp_seconds", "gauge", "Unix time of the next scheduled backup cycle.")
+	if !nextRun.IsZero() {
+		sample(w, "hyper_backup_next_run_timestamp_seconds", "", unix(nextRun))
+	}
+}
+
+func family(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func sample(w io.Writer, name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %g\n", name, value)
+}
+
+func serviceLabels(name string, s *serviceStats) string {
+	return `service="` + escape(name) + `",stage="` + escape(s.stage) + `"`
+}
+
+func unix(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escape(v string) string {
+	return escaper.Replace(v)
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,252 @@
+// Package notifier reports the outcome of backup cycles to webhooks, chat
+// services and email.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// sendTimeout bounds each delivery so a dead endpoint can't stall the scheduler.
+const sendTimeout = 30 * time.Second
+
+// Policy decides which cycles are worth a notification.
+type Policy string
+
+const (
+	// PolicyFailure notifies only about failed cycles.
+	PolicyFailure Policy = "failure"
+	// PolicyAlways notifies about every cycle.
+	PolicyAlways Policy = "always"
+	// PolicyRecovery notifies about failed cycles and the first successful
+	// cycle after a failure.
+	PolicyRecovery Policy = "recovery"
+)
+
+// statusStuck is the status of a message about uploads that keep failing.
+const statusStuck = "stuck"
+
+// Message is what senders deliver for one cycle, or for the uploads that
+// keep failing; then Report is nil and Stuck lists them.
+type Message struct {
+	Title     string
+	Body      string
+	Status    string
+	Recovered bool
+	Host      string
+	Report    *backup.CycleReport
+	Stuck     []storage.QueuedUpload
+}
+
+// Sender delivers a message to one destination.
+type Sender interface {
+	Name() string
+	Send(ctx context.Context, msg Message) error
+}
+
+// lastFailed remembers whether the previous cycle failed, for PolicyRecovery.
+// It starts unknown after a restart, so the first success is not a recovery.
+var (
+	stateMu    sync.Mutex
+	lastFailed *bool
+)
+
+// Notify sends the cycle report to every configured sender if the policy
+// asks for it. Delivery errors are logged and returned joined; they never
+// affect the backups themselves.
+func Notify(ctx context.Context, report *backup.CycleReport) error {
+	failed := report.Status() == backup.StatusFailed
+
+	stateMu.Lock()
+	recovered := !failed && lastFailed != nil && *lastFailed
+	lastFailed = &failed
+	stateMu.Unlock()
+
+	senders := loadSenders()
+	if len(senders) == 0 || !shouldNotify(loadPolicy(), failed, recovered) {
+		return nil
+	}
+
+	msg, err := render(report, recovered)
+	if err != nil {
+		utilities.Logger.Errorf("[Notify] ❌ %v", err)
+		return err
+	}
+
+	// Still report a cycle that was cut short by shutdown
+	return send(context.WithoutCancel(ctx), senders, msg)
+}
+
+// NotifyStuck tells every configured sender about uploads that keep failing,
+// whatever NOTIFY_POLICY says: the backups look fine locally but have no
+// off-site copy.
+func NotifyStuck(ctx context.Context, stuck []storage.QueuedUpload) error {
+	senders := loadSenders()
+	if len(senders) == 0 || len(stuck) == 0 {
+		return nil
+	}
+	msg := Message{Status: statusStuck, Host: hostname(), Stuck: stuck}
+	msg.Title = fmt.Sprintf("[hyper-backup] %s: %d upload(s) stuck", msg.Host, len(stuck))
+	var body strings.Builder
+	for _, u := range stuck {
+		fmt.Fprintf(&body, "- %s to %s: %d failed attempt(s) since %s", u.Path, u.Target, u.Attempts, u.FirstFailed.Format("2006-01-02 15:04:05"))
+		if u.GaveUp {
+			body.WriteString(", gave up")
+		}
+		fmt.Fprintf(&body, ": %s\n", u.LastError)
+	}
+	msg.Body = utilities.Redact(body.String())
+	return send(context.WithoutCancel(ctx), senders, msg)
+}
+
+func send(ctx context.Context, senders []Sender, msg Message) error {
+	var errs []error
+	for _, s := range senders {
+		sendCtx, cancel := context.WithTimeout(ctx, sendTimeout)
+		err := s.Send(sendCtx, msg)
+		cancel()
+		if err != nil {
+			utilities.Logger.Errorf("[Notify] ❌ %s delivery failed: %v", s.Name(), err)
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+			continue
+		}
+		utilities.Logger.Infof("[Notify] 📣 Sent %s notification via %s", msg.Status, s.Name())
+	}
+	return errors.Join(errs...)
+}
+
+func shouldNotify(policy Policy, failed, recovered bool) bool {
+	switch policy {
+	case PolicyAlways:
+		return true
+	case PolicyRecovery:
+		return failed || recovered
+	default:
+		return failed
+	}
+}
+
+// loadPolicy reads NOTIFY_POLICY; unknown values fall back to failure-only.
+func loadPolicy() Policy {
+	str := strings.ToLower(os.Getenv("NOTIFY_POLICY"))
+	switch Policy(str) {
+	case "":
+		return PolicyFailure
+	case PolicyFailure, PolicyAlways, PolicyRecovery:
+		return Policy(str)
+	default:
+		utilities.Logger.Warnf("[Notify] ⚠️ Invalid NOTIFY_POLICY '%s'. Notifying on failure only", str)
+		return PolicyFailure
+	}
+}
+
+// loadSenders returns a sender for every destination configured in the environment.
+func loadSenders() []Sender {
+	var senders []Sender
+	if url := utilities.Getenv("NOTIFY_WEBHOOK_URL"); url != "" {
+		senders = append(senders, &webhookSender{url: url})
+	}
+	if url := utilities.Getenv("NOTIFY_SLACK_URL"); url != "" {
+		senders = append(senders, &chatSender{name: "Slack", url: url, field: "text"})
+	}
+	if url := utilities.Getenv("NOTIFY_DISCORD_URL"); url != "" {
+		senders = append(senders, &chatSender{name: "Discord", url: url, field: "content"})
+	}
+	if s, err := loadSMTPSender(); err != nil {
+		utilities.Logger.Warnf("[Notify] ⚠️ SMTP disabled: %v", err)
+	} else if s != nil {
+		senders = append(senders, s)
+	}
+	return senders
+}
+
+// ValidateNotify reports incomplete sender settings and invalid templates.
+func ValidateNotify() error {
+	var errs []error
+	if _, err := loadSMTPSender(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, key := range []string{"NOTIFY_TITLE_TEMPLATE", "NOTIFY_TEMPLATE"} {
+		if text := os.Getenv(key); text != "" {
+			if _, err := parseTemplate(key, text); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+const (
+	defaultTitle = `[hyper-backup] {{.Host}}: backup {{if .Recovered}}recovered{{else}}{{.Status}}{{end}}`
+	defaultBody  = `Cycle started {{.Report.StartedAt.Format "2006-01-02 15:04:05"}}, took {{duration .Report.Duration}}, wrote {{bytes .Report.Bytes}}.{{range .Report.Services}}
+- {{.Name}}{{if .BestEffort}} (best effort){{end}}: {{.Status}}{{if .Uploaded}}, {{.Uploaded}} uploaded ({{bytes .UploadedBytes}}){{end}}{{if .Queued}}, {{.Queued}} queued for retry{{end}}{{if .Err}}: {{.Err}}{{end}}{{if .SkipReason}} ({{.SkipReason}}){{end}}{{end}}
+`
+)
+
+// render builds the message from NOTIFY_TITLE_TEMPLATE and NOTIFY_TEMPLATE
+// (Go text/template), falling back to the built-in templates.
+func render(report *backup.CycleReport, recovered bool) (Message, error) {
+	msg := Message{
+		Status:    report.Status(),
+		Recovered: recovered,
+		Host:      hostname(),
+		Report:    report,
+	}
+
+	var err error
+	if msg.Title, err = execTemplate("NOTIFY_TITLE_TEMPLATE", defaultTitle, msg); err != nil {
+		return msg, err
+	}
+	if msg.Body, err = execTemplate("NOTIFY_TEMPLATE", defaultBody, msg); err != nil {
+		return msg, err
+	}
+	msg.Title = strings.TrimSpace(msg.Title)
+	return msg, nil
+}
+
+// hostname names this machine in messages; NOTIFY_HOSTNAME overrides it.
+func hostname() string {
+	if h := os.Getenv("NOTIFY_HOSTNAME"); h != "" {
+		return h
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+func execTemplate(key, fallback string, msg Message) (string, error) {
+	text := os.Getenv(key)
+	if text == "" {
+		text = fallback
+	}
+	t, err := parseTemplate(key, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, msg); err != nil {
+		return "", fmt.Errorf("render %s: %w", key, err)
+	}
+	return utilities.Redact(buf.String()), nil
+}
+
+func parseTemplate(key, text string) (*template.Template, error) {
+	t, err := template.New(key).Funcs(template.FuncMap{
+		"bytes":    utilities.HumanBytes,
+		"duration": func(d time.Duration) string { return d.Round(time.Second).String() },
+	}).Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,167 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+)
+
+// testReport returns a one-service cycle report with the given status.
+func testReport(status string) *backup.CycleReport {
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	svc := backup.ServiceReport{
+		Name:       "MySQL",
+		Stage:      backup.StageCore,
+		Status:     status,
+		StartedAt:  start,
+		FinishedAt: start.Add(90 * time.Second),
+		Bytes:      2048,
+	}
+	if status == backup.StatusFailed {
+		svc.Err = errors.New("mysqldump exited with status 2")
+	}
+	return &backup.CycleReport{StartedAt: start, FinishedAt: svc.FinishedAt, Services: []backup.ServiceReport{svc}}
+}
+
+// webhookSink records the JSON bodies posted to it.
+type webhookSink struct {
+	mu     sync.Mutex
+	bodies []map[string]any
+}
+
+func newWebhookSink(t *testing.T) (*webhookSink, string) {
+	t.Helper()
+	sink := &webhookSink{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("got %s with Content-Type %q, want a JSON POST", r.Method, r.Header.Get("Content-Type"))
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decode body: %v", err)
+		}
+		sink.mu.Lock()
+		sink.bodies = append(sink.bodies, body)
+		sink.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return sink, srv.URL
+}
+
+func (s *webhookSink) titles() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var titles []string
+	for _, b := range s.bodies {
+		titles = append(titles, b["title"].(string))
+	}
+	return titles
+}
+
+// setNotifyEnv clears the sender settings and configures only url as a
+// generic webhook.
+func setNotifyEnv(t *testing.T, url string) {
+	t.Helper()
+	for _, key := range []string{"NOTIFY_SLACK_URL", "NOTIFY_DISCORD_URL", "NOTIFY_SMTP_HOST", "NOTIFY_TITLE_TEMPLATE", "NOTIFY_TEMPLATE"} {
+		t.Setenv(key, "")
+	}
+	t.Setenv("NOTIFY_WEBHOOK_URL", url)
+	t.Setenv("NOTIFY_HOSTNAME", "host1")
+}
+
+func TestShouldNotify(t *testing.T) {
+	tests := []struct {
+		policy            Policy
+		failed, recovered bool
+		want              bool
+	}{
+		{PolicyFailure, false, false, false},
+		{PolicyFailure, true, false, true},
+		{PolicyFailure, false, true, false},
+		{PolicyAlways, false, false, true},
+		{PolicyAlways, true, false, true},
+		{PolicyRecovery, false, false, false},
+		{PolicyRecovery, true, false, true},
+		{PolicyRecovery, false, true, true},
+		{"", true, false, true},
+		{"", false, false, false},
+	}
+	for _, tt := range tests {
+		if got := shouldNotify(tt.policy, tt.failed, tt.recovered); got != tt.want {
+			t.Errorf("shouldNotify(%q, failed=%v, recovered=%v) = %v, want %v", tt.policy, tt.failed, tt.recovered, got, tt.want)
+		}
+	}
+}
+
+func TestNotifyPolicies(t *testing.T) {
+	// The first success follows a restart, so it is no recovery
+	cycles := []string{backup.StatusSuccess, backup.StatusFailed, backup.StatusFailed, backup.StatusSuccess, backup.StatusSuccess}
+	const (
+		ok        = "[hyper-backup] host1: backup success"
+		failed    = "[hyper-backup] host1: backup failed"
+		recovered = "[hyper-backup] host1: backup recovered"
+	)
+
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{"", []string{failed, failed}},
+		{"failure", []string{failed, failed}},
+		{"always", []string{ok, failed, failed, recovered, ok}},
+		{"recovery", []string{failed, failed, recovered}},
+		{"bogus", []string{failed, failed}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			sink, url := newWebhookSink(t)
+			setNotifyEnv(t, url)
+			t.Setenv("NOTIFY_POLICY", tt.policy)
+			stateMu.Lock()
+			lastFailed = nil
+			stateMu.Unlock()
+
+			for _, status := range cycles {
+				if err := Notify(t.Context(), testReport(status)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := sink.titles(); !slices.Equal(got, tt.want) {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRenderTemplates(t *testing.T) {
+	setNotifyEnv(t, "")
+	t.Setenv("NOTIFY_TITLE_TEMPLATE", "{{.Host}} {{.Status}} {{len .Report.Services}}")
+	t.Setenv("NOTIFY_TEMPLATE", "{{range .Report.Services}}{{.Name}}: {{.Err}}{{end}}")
+
+	msg, err := render(testReport(backup.StatusFailed), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Title != "host1 failed 1" {
+		t.Errorf("Title = %q", msg.Title)
+	}
+	if msg.Body != "MySQL: mysqldump exited with status 2" {
+		t.Errorf("Body = %q", msg.Body)
+	}
+
+	t.Setenv("NOTIFY_TEMPLATE", "{{.Missing")
+	if _, err := render(testReport(backup.StatusFailed), false); err == nil || !strings.Contains(err.Error(), "NOTIFY_TEMPLATE") {
+		t.Errorf("render error = %v, want the invalid template named", err)
+	}
+	if err := ValidateNotify(); err == nil {
+		t.Error("ValidateNotify accepted an invalid template")
+	}
+}
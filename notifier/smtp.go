@@ -0,0 +1,142 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// smtpSender emails the message. TLS modes: "starttls" (default, upgrades when
+// the server offers it), "tls" (implicit TLS, usually port 465) and "none".
+type smtpSender struct {
+	host     string
+	port     string
+	username string
+	password string
+	from     string
+	to       []string
+	tlsMode  string
+}
+
+// loadSMTPSender returns nil without error when NOTIFY_SMTP_HOST is unset.
+func loadSMTPSender() (*smtpSender, error) {
+	host := os.Getenv("NOTIFY_SMTP_HOST")
+	if host == "" {
+		return nil, nil
+	}
+
+	s := &smtpSender{
+		host:     host,
+		port:     os.Getenv("NOTIFY_SMTP_PORT"),
+		username: os.Getenv("NOTIFY_SMTP_USERNAME"),
+		password: utilities.Getenv("NOTIFY_SMTP_PASSWORD"),
+		from:     os.Getenv("NOTIFY_SMTP_FROM"),
+		tlsMode:  strings.ToLower(os.Getenv("NOTIFY_SMTP_TLS")),
+	}
+	for _, addr := range strings.Split(os.Getenv("NOTIFY_SMTP_TO"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			s.to = append(s.to, addr)
+		}
+	}
+	if s.from == "" || len(s.to) == 0 {
+		return nil, fmt.Errorf("NOTIFY_SMTP_FROM and NOTIFY_SMTP_TO must be set with NOTIFY_SMTP_HOST")
+	}
+
+	switch s.tlsMode {
+	case "":
+		s.tlsMode = "starttls"
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("invalid NOTIFY_SMTP_TLS '%s' (expected starttls, tls or none)", s.tlsMode)
+	}
+	if s.port == "" {
+		s.port = "587"
+		if s.tlsMode == "tls" {
+			s.port = "465"
+		}
+	}
+	return s, nil
+}
+
+func (s *smtpSender) Name() string { return "SMTP" }
+
+func (s *smtpSender) Send(ctx context.Context, msg Message) error {
+	addr := net.JoinHostPort(s.host, s.port)
+	dialer := &net.Dialer{}
+	var conn net.Conn
+	var err error
+	if s.tlsMode == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: s.host}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, s.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if s.tlsMode == "starttls" {
+		if ok, _ := c.Extension("STARTTLS"); ok {
+			if err := c.StartTLS(&tls.Config{ServerName: s.host}); err != nil {
+				return err
+			}
+		}
+	}
+	if s.username != "" {
+		// PlainAuth refuses to send credentials over plain connections except to localhost
+		if err := c.Auth(smtp.PlainAuth("", s.username, s.password, s.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(s.from); err != nil {
+		return err
+	}
+	for _, rcpt := range s.to {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(s.compose(msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (s *smtpSender) compose(msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.from)
+	fmt.Fprintf(&buf, "To: %s\r\n", strings.Join(s.to, ", "))
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Title))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return buf.Bytes()
+}
@@ -0,0 +1,180 @@
+package notifier
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// smtpSink accepts one plain-text SMTP session with AUTH PLAIN and records it.
+type smtpSink struct {
+	addr string
+	done chan struct{}
+
+	auth string
+	from string
+	rcpt []string
+	data string
+}
+
+func startSMTPSink(t *testing.T) *smtpSink {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s := &smtpSink{addr: l.Addr().String(), done: make(chan struct{})}
+
+	go func() {
+		defer close(s.done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tp := textproto.NewConn(conn)
+		reply := func(format string, args ...any) { tp.PrintfLine(format, args...) }
+
+		reply("220 sink ready")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				reply("250-sink")
+				reply("250 AUTH PLAIN")
+			case "AUTH":
+				creds, _ := strings.CutPrefix(arg, "PLAIN ")
+				decoded, _ := base64.StdEncoding.DecodeString(creds)
+				s.auth = string(decoded)
+				reply("235 authenticated")
+			case "MAIL":
+				s.from = arg
+				reply("250 ok")
+			case "RCPT":
+				s.rcpt = append(s.rcpt, arg)
+				reply("250 ok")
+			case "DATA":
+				reply("354 go ahead")
+				data, err := tp.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				s.data = string(data)
+				reply("250 queued")
+			case "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("502 %s not implemented", verb)
+			}
+		}
+	}()
+	return s
+}
+
+func TestSMTPSend(t *testing.T) {
+	sink := startSMTPSink(t)
+	host, port, _ := net.SplitHostPort(sink.addr)
+	t.Setenv("NOTIFY_SMTP_HOST", host)
+	t.Setenv("NOTIFY_SMTP_PORT", port)
+	t.Setenv("NOTIFY_SMTP_TLS", "none")
+	t.Setenv("NOTIFY_SMTP_USERNAME", "backup")
+	t.Setenv("NOTIFY_SMTP_PASSWORD", "secret")
+	t.Setenv("NOTIFY_SMTP_FROM", "backup@example.com")
+	t.Setenv("NOTIFY_SMTP_TO", "ops@example.com, admin@example.com")
+
+	s, err := loadSMTPSender()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := Message{Title: "[hyper-backup] host1: backup failed ❌", Body: "line 1\nline 2\n.dotted"}
+	if err := s.Send(t.Context(), msg); err != nil {
+		t.Fatal(err)
+	}
+	<-sink.done
+
+	if sink.auth != "\x00backup\x00secret" {
+		t.Errorf("AUTH PLAIN = %q", sink.auth)
+	}
+	if sink.from != "FROM:<backup@example.com>" {
+		t.Errorf("MAIL %s", sink.from)
+	}
+	if want := []string{"TO:<ops@example.com>", "TO:<admin@example.com>"}; fmt.Sprint(sink.rcpt) != fmt.Sprint(want) {
+		t.Errorf("RCPT %v, want %v", sink.rcpt, want)
+	}
+
+	header, body, ok := strings.Cut(sink.data, "\n\n")
+	if !ok {
+		t.Fatalf("no header in %q", sink.data)
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(header + "\n\n")))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("To") != "ops@example.com, admin@example.com" || h.Get("From") != "backup@example.com" {
+		t.Errorf("From %q, To %q", h.Get("From"), h.Get("To"))
+	}
+	if subject := h.Get("Subject"); !strings.HasPrefix(subject, "=?utf-8?q?") || !strings.Contains(subject, "=E2=9D=8C") {
+		t.Errorf("Subject = %q, want it Q-encoded", subject)
+	}
+	if h.Get("Content-Type") != "text/plain; charset=utf-8" {
+		t.Errorf("Content-Type = %q", h.Get("Content-Type"))
+	}
+	if body != "line 1\nline 2\n.dotted\n" {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestLoadSMTPSender(t *testing.T) {
+	tests := []struct {
+		name     string
+		env      map[string]string
+		wantPort string
+		wantErr  string
+	}{
+		{name: "not configured", env: map[string]string{"NOTIFY_SMTP_HOST": ""}},
+		{name: "starttls default", env: map[string]string{}, wantPort: "587"},
+		{name: "implicit tls", env: map[string]string{"NOTIFY_SMTP_TLS": "TLS"}, wantPort: "465"},
+		{name: "explicit port", env: map[string]string{"NOTIFY_SMTP_PORT": "2525"}, wantPort: "2525"},
+		{name: "no recipient", env: map[string]string{"NOTIFY_SMTP_TO": " , "}, wantErr: "NOTIFY_SMTP_TO"},
+		{name: "unknown tls mode", env: map[string]string{"NOTIFY_SMTP_TLS": "ssl"}, wantErr: "invalid NOTIFY_SMTP_TLS"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("NOTIFY_SMTP_HOST", "mail.example.com")
+			t.Setenv("NOTIFY_SMTP_PORT", "")
+			t.Setenv("NOTIFY_SMTP_TLS", "")
+			t.Setenv("NOTIFY_SMTP_FROM", "backup@example.com")
+			t.Setenv("NOTIFY_SMTP_TO", "ops@example.com")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+
+			s, err := loadSMTPSender()
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want %q", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case tt.wantPort == "":
+				if s != nil {
+					t.Fatalf("got a sender without NOTIFY_SMTP_HOST")
+				}
+			case s.port != tt.wantPort:
+				t.Errorf("port = %s, want %s", s.port, tt.wantPort)
+			}
+		})
+	}
+}
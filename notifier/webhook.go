@@ -0,0 +1,110 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/storage"
+)
+
+// webhookSender posts the full cycle report as JSON to a generic endpoint.
+type webhookSender struct {
+	url string
+}
+
+func (s *webhookSender) Name() string { return "Webhook" }
+
+type webhookPayload struct {
+	Title      string                 `json:"title"`
+	Message    string                 `json:"message"`
+	Status     string                 `json:"status"`
+	Recovered  bool                   `json:"recovered"`
+	Host       string                 `json:"host"`
+	StartedAt  time.Time              `json:"started_at"`
+	FinishedAt time.Time              `json:"finished_at"`
+	Duration   float64                `json:"duration_seconds"`
+	Bytes      int64                  `json:"bytes"`
+	Services   []backup.ServiceReport `json:"services"`
+}
+
+// stuckPayload reports the uploads that keep failing.
+type stuckPayload struct {
+	Title   string                 `json:"title"`
+	Message string                 `json:"message"`
+	Status  string                 `json:"status"`
+	Host    string                 `json:"host"`
+	Uploads []storage.QueuedUpload `json:"uploads"`
+}
+
+func (s *webhookSender) Send(ctx context.Context, msg Message) error {
+	r := msg.Report
+	if r == nil {
+		return postJSON(ctx, s.url, stuckPayload{
+			Title:   msg.Title,
+			Message: msg.Body,
+			Status:  msg.Status,
+			Host:    msg.Host,
+			Uploads: msg.Stuck,
+		})
+	}
+	return postJSON(ctx, s.url, webhookPayload{
+		Title:      msg.Title,
+		Message:    msg.Body,
+		Status:     msg.Status,
+		Recovered:  msg.Recovered,
+		Host:       msg.Host,
+		StartedAt:  r.StartedAt,
+		FinishedAt: r.FinishedAt,
+		Duration:   r.Duration().Seconds(),
+		Bytes:      r.Bytes(),
+		Services:   append([]backup.ServiceReport{}, r.Services...),
+	})
+}
+
+// chatSender posts to Slack-style incoming webhooks. Slack and Mattermost read
+// the message from "text", Discord from "content".
+type chatSender struct {
+	name  string
+	url   string
+	field string
+}
+
+func (s *chatSender) Name() string { return s.name }
+
+func (s *chatSender) Send(ctx context.Context, msg Message) error {
+	text := msg.Title
+	if msg.Body != "" {
+		text += "\n" + msg.Body
+	}
+	return postJSON(ctx, s.url, map[string]string{s.field: text})
+}
+
+func postJSON(ctx context.Context, url string, v any) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(detail))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package notifier
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/storage"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	sink, url := newWebhookSink(t)
+	report := testReport(backup.StatusFailed)
+	msg := Message{Title: "title", Body: "body", Status: report.Status(), Recovered: false, Host: "host1", Report: report}
+
+	if err := (&webhookSender{url: url}).Send(t.Context(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.bodies) != 1 {
+		t.Fatalf("got %d posts, want 1", len(sink.bodies))
+	}
+	body := sink.bodies[0]
+	for key, want := range map[string]any{
+		"title":            "title",
+		"message":          "body",
+		"status":           "failed",
+		"recovered":        false,
+		"host":             "host1",
+		"started_at":       "2026-01-02T03:04:05Z",
+		"duration_seconds": 90.0,
+		"bytes":            2048.0,
+	} {
+		if body[key] != want {
+			t.Errorf("%s = %v, want %v", key, body[key], want)
+		}
+	}
+	services, _ := body["services"].([]any)
+	if len(services) != 1 {
+		t.Fatalf("services = %v, want one", body["services"])
+	}
+	svc := services[0].(map[string]any)
+	if svc["name"] != "MySQL" || svc["stage"] != "core" || svc["error"] != "mysqldump exited with status 2" {
+		t.Errorf("service = %v", svc)
+	}
+}
+
+func TestWebhookStuckPayload(t *testing.T) {
+	sink, url := newWebhookSink(t)
+	setNotifyEnv(t, url)
+	stuck := []storage.QueuedUpload{{
+		Path:        "/home/hyper-backup/mysql/db_20260101_000000.sql.zst",
+		Target:      "s3://bucket",
+		Attempts:    7,
+		FirstFailed: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		LastError:   "connection refused",
+	}}
+
+	if err := NotifyStuck(t.Context(), stuck); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.bodies) != 1 {
+		t.Fatalf("got %d posts, want 1", len(sink.bodies))
+	}
+	body := sink.bodies[0]
+	if body["status"] != statusStuck || body["title"] != "[hyper-backup] host1: 1 upload(s) stuck" {
+		t.Errorf("status %v, title %v", body["status"], body["title"])
+	}
+	if msg, _ := body["message"].(string); !strings.Contains(msg, "to s3://bucket: 7 failed attempt(s) since 2026-01-01 00:00:00: connection refused") {
+		t.Errorf("message = %q", msg)
+	}
+	if uploads, _ := body["uploads"].([]any); len(uploads) != 1 {
+		t.Errorf("uploads = %v, want one", body["uploads"])
+	}
+}
+
+func TestChatPayloads(t *testing.T) {
+	tests := []struct {
+		key, sender, field string
+	}{
+		{"NOTIFY_SLACK_URL", "Slack", "text"},
+		{"NOTIFY_DISCORD_URL", "Discord", "content"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sender, func(t *testing.T) {
+			sink, url := newWebhookSink(t)
+			setNotifyEnv(t, "")
+			t.Setenv(tt.key, url)
+
+			senders := loadSenders()
+			if len(senders) != 1 || senders[0].Name() != tt.sender {
+				t.Fatalf("loadSenders = %v, want only %s", senders, tt.sender)
+			}
+			if err := senders[0].Send(t.Context(), Message{Title: "title", Body: "line 1\nline 2"}); err != nil {
+				t.Fatal(err)
+			}
+			if len(sink.bodies) != 1 {
+				t.Fatalf("got %d posts, want 1", len(sink.bodies))
+			}
+			body := sink.bodies[0]
+			if len(body) != 1 || body[tt.field] != "title\nline 1\nline 2" {
+				t.Errorf("payload = %v, want only %q with title and body", body, tt.field)
+			}
+		})
+	}
+}
+
+func TestPostJSONRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	err := send(t.Context(), []Sender{&chatSender{name: "Slack", url: srv.URL, field: "text"}}, Message{Title: "title"})
+	if err == nil || !strings.Contains(err.Error(), "Slack: unexpected status 403 Forbidden: invalid_token") {
+		t.Errorf("send error = %v", err)
+	}
+
+	stopped := httptest.NewServer(http.NotFoundHandler())
+	stopped.Close()
+	err = (&webhookSender{url: stopped.URL}).Send(t.Context(), Message{Report: testReport(backup.StatusSuccess)})
+	if err == nil {
+		t.Error("Send to a closed server succeeded")
+	}
+}
@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/metrics"
+	"github.com/fvoci/hyper-backup/notifier"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// ErrBusy is returned when a run is requested while another one is in progress.
+var ErrBusy = errors.New("a backup is already running")
+
+var (
+	// running guards against overlapping cycles, scheduled or manual.
+	running int32
+	// alive is set while StartWithContext is scheduling cycles.
+	alive int32
+	// manual tracks runs triggered through RunNow and RunService.
+	manual sync.WaitGroup
+
+	stateMu    sync.Mutex
+	nextRun    time.Time
+	lastReport *backup.CycleReport
+)
+
+// Status is a snapshot of the scheduler.
+type Status struct {
+	// Alive reports whether the scheduler loop is running.
+	Alive bool
+	// Running reports whether a cycle or manual run is in progress.
+	Running bool
+	// Active lists the services running right now, sorted by name.
+	Active []string
+	// NextRun is when the next scheduled cycle starts.
+	NextRun time.Time
+	// Last is the report of the last full cycle, nil before the first one ends.
+	Last *backup.CycleReport
+}
+
+// CurrentStatus returns a snapshot of the scheduler state.
+func CurrentStatus() Status {
+	stateMu.Lock()
+	st := Status{NextRun: nextRun, Last: lastReport}
+	stateMu.Unlock()
+
+	st.Alive = atomic.LoadInt32(&alive) == 1
+	st.Running = atomic.LoadInt32(&running) == 1
+	for name := range backup.Active() {
+		st.Active = append(st.Active, name)
+	}
+	sort.Strings(st.Active)
+	return st
+}
+
+func setNext(t time.Time) {
+	stateMu.Lock()
+	nextRun = t
+	stateMu.Unlock()
+	metrics.SetNextRun(t)
+}
+
+func setLast(r *backup.CycleReport) {
+	stateMu.Lock()
+	lastReport = r
+	stateMu.Unlock()
+}
+
+// runGuarded runs a scheduled cycle unless another one is still in progress.
+func runGuarded(ctx context.Context, next time.Time) {
+	if !acquire() {
+		utilities.Logger.Warn("[HyperBackup] ⚠️ Previous backup still running. Skipping this cycle.")
+		return
+	}
+	defer atomic.StoreInt32(&running, 0)
+	runBackupCycle(backup.ExcludeScheduled(ctx), next)
+}
+
+// RunNow starts a full backup cycle in the background. It returns ErrBusy
+// while another cycle or service run is in progress.
+func RunNow(ctx context.Context) error {
+	if !acquire() {
+		return ErrBusy
+	}
+	manual.Add(1)
+	go func() {
+		defer manual.Done()
+		defer atomic.StoreInt32(&running, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				utilities.Logger.Errorf("[HyperBackup] ❌ Panic during backup: %v", r)
+			}
+		}()
+		utilities.Logger.Info("[HyperBackup] 👆 Manual backup cycle requested")
+		stateMu.Lock()
+		next := nextRun
+		stateMu.Unlock()
+		runBackupCycle(ctx, next)
+	}()
+	return nil
+}
+
+// RunService runs one configured service in the background, recorded in the
+// catalog as a cycle of its own. It returns ErrBusy while another run is in
+// progress, and an error for unknown or unconfigured services.
+func RunService(ctx context.Context, name string) error {
+	svc, _, ok := backup.Lookup(name)
+	if !ok {
+		return fmt.Errorf("unknown service %q", name)
+	}
+	if !svc.Configured() {
+		return fmt.Errorf("service %s is not configured", svc.Name())
+	}
+	if !acquire() {
+		return ErrBusy
+	}
+
+	manual.Add(1)
+	go func() {
+		defer manual.Done()
+		defer atomic.StoreInt32(&running, 0)
+		defer func() {
+			if r := recover(); r != nil {
+				utilities.Logger.Errorf("[HyperBackup] ❌ Panic during %s run: %v", svc.Name(), r)
+			}
+		}()
+		runSingle(ctx, svc.Name())
+	}()
+	return nil
+}
+
+func runSingle(ctx context.Context, name string) {
+	start := time.Now()
+	utilities.Logger.Infof("🚀 [HyperBackup] Manual run of %s started", name)
+	catalog.Begin(start)
+	// Close the manifest on every path, so it never leaks into the next cycle
+	defer func() {
+		if err := catalog.End(time.Now()); err != nil {
+			utilities.Logger.Warnf("[Catalog] ⚠️ Failed to write manifest: %v", err)
+		}
+	}()
+
+	report, err := backup.RunService(ctx, name)
+	if err != nil {
+		utilities.Logger.Errorf("[HyperBackup] ❌ %v", err)
+		return
+	}
+	utilities.Logger.Infof("✅ [HyperBackup] Manual run of %s finished: %s (Duration: %s)",
+		name, report.Status(), report.Duration().Round(time.Second))
+	utilities.LogDivider()
+	notifier.Notify(ctx, report)
+}
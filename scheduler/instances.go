@@ -0,0 +1,82 @@
+package scheduler
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/utilities"
+	"github.com/robfig/cron/v3"
+)
+
+// startInstanceSchedules runs services that have a schedule of their own (see
+// backup.ScheduledService) in cycles of their own, together with the storage
+// services that run in every cycle so their artifacts get uploaded. It
+// returns a function that stops the schedules and waits for a running cycle.
+func startInstanceSchedules(ctx context.Context) func() {
+	groups := map[string][]string{}
+	var uploads []string
+	for _, stage := range []backup.Stage{backup.StageCore, backup.StageFiles, backup.StageStorage} {
+		for _, svc := range backup.Services(stage) {
+			if !svc.Configured() {
+				continue
+			}
+			spec := ""
+			if s, ok := svc.(backup.ScheduledService); ok {
+				spec = s.Schedule()
+			}
+			switch {
+			case spec != "":
+				groups[spec] = append(groups[spec], svc.Name())
+			case stage == backup.StageStorage:
+				uploads = append(uploads, svc.Name())
+			}
+		}
+	}
+	if len(groups) == 0 {
+		return func() {}
+	}
+
+	c := cron.New(
+		cron.WithParser(cronParser),
+		cron.WithLocation(time.Local),
+		cron.WithChain(
+			cron.Recover(cron.PrintfLogger(utilities.Logger)),
+		),
+	)
+
+	specs := make([]string, 0, len(groups))
+	for spec := range groups {
+		specs = append(specs, spec)
+	}
+	sort.Strings(specs)
+	for _, spec := range specs {
+		names := groups[spec]
+		if _, err := c.AddFunc(spec, func() {
+			runInstances(ctx, names, uploads)
+		}); err != nil {
+			utilities.Logger.Errorf("[HyperBackup] ❌ Invalid schedule '%s' for %s: %v", spec, strings.Join(names, ", "), err)
+			continue
+		}
+		utilities.Logger.Infof("[HyperBackup] 🔁 %s on cron: \"%s\"", strings.Join(names, ", "), spec)
+	}
+
+	c.Start()
+	return func() { <-c.Stop().Done() }
+}
+
+// runInstances runs one cycle limited to names and the upload services,
+// unless another cycle is still in progress.
+func runInstances(ctx context.Context, names, uploads []string) {
+	if !acquire() {
+		utilities.Logger.Warnf("[HyperBackup] ⚠️ Backup still running. Skipping scheduled run of %s.", strings.Join(names, ", "))
+		return
+	}
+	defer atomic.StoreInt32(&running, 0)
+
+	selected := append(append([]string(nil), names...), uploads...)
+	runBackupCycle(backup.WithServices(ctx, selected...), time.Time{})
+}
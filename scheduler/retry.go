@@ -0,0 +1,121 @@
+package scheduler
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/storage"
+	"github.com/fvoci/hyper-backup/notifier"
+	"github.com/fvoci/hyper-backup/utilities"
+)
+
+// retryInterval is how often queued uploads are checked for a due retry.
+const retryInterval = time.Minute
+
+var (
+	// retryMu guards the pass in progress, set while it holds running.
+	retryMu     sync.Mutex
+	retryCancel context.CancelFunc
+	retryDone   chan struct{}
+)
+
+// acquire takes the running guard for a cycle or manual run. A retry pass
+// holding it is cancelled and waited for, since it only repeats uploads the
+// run would do anyway. It returns false while another run is in progress.
+func acquire() bool {
+	for {
+		if atomic.CompareAndSwapInt32(&running, 0, 1) {
+			return true
+		}
+		retryMu.Lock()
+		cancel, done := retryCancel, retryDone
+		retryMu.Unlock()
+		if done == nil {
+			return false
+		}
+		cancel()
+		<-done
+	}
+}
+
+// startRetries retries queued uploads between cycles until ctx is cancelled,
+// and reports the ones that are stuck. It returns a function that stops the
+// loop and waits for a pass in progress.
+func startRetries(ctx context.Context) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(retryInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				retryPass(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+// retryPass retries the uploads whose backoff has expired, unless a run is
+// in progress; that run retries them itself.
+func retryPass(ctx context.Context) {
+	passCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan struct{})
+
+	retryMu.Lock()
+	if !atomic.CompareAndSwapInt32(&running, 0, 1) {
+		retryMu.Unlock()
+		return
+	}
+	retryCancel, retryDone = cancel, done
+	retryMu.Unlock()
+	defer func() {
+		// Release the guard first: acquire takes a held guard without a
+		// pass for another run
+		atomic.StoreInt32(&running, 0)
+		retryMu.Lock()
+		retryCancel, retryDone = nil, nil
+		retryMu.Unlock()
+		close(done)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			utilities.Logger.Errorf("[HyperBackup] ❌ Panic during upload retry: %v", r)
+		}
+	}()
+
+	if report := backup.RetryUploads(passCtx, false); report != nil {
+		observeUploads(report)
+		if err := report.Err(); err != nil && passCtx.Err() == nil {
+			utilities.Logger.Warnf("[HyperBackup] ⚠️ Upload retry failed: %v", err)
+		}
+		utilities.LogDivider()
+	}
+	notifyStuck(ctx)
+}
+
+// notifyStuck reports the uploads that have been failing for longer than
+// UPLOAD_STUCK_AFTER, once each.
+func notifyStuck(ctx context.Context) {
+	stuck, err := storage.StuckUploads()
+	if err != nil {
+		utilities.Logger.Warnf("[HyperBackup] ⚠️ %v", err)
+	}
+	if len(stuck) == 0 {
+		return
+	}
+	utilities.Logger.Warnf("[HyperBackup] ⚠️ %d upload(s) failing for too long", len(stuck))
+	notifier.NotifyStuck(ctx, stuck)
+}
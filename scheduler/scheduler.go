@@ -2,12 +2,17 @@ package scheduler
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"sync/atomic"
 	"time"
 
 	"github.com/fvoci/hyper-backup/backup"
+	"github.com/fvoci/hyper-backup/backup/catalog"
+	"github.com/fvoci/hyper-backup/metrics"
+	"github.com/fvoci/hyper-backup/notifier"
 	"github.com/fvoci/hyper-backup/utilities"
 	"github.com/robfig/cron/v3"
 )
@@ -18,14 +23,17 @@ import (
 // interval: hour-based string (e.g., "24") if cron is not used.
 // If neither is set, defaults to "0 0 * * *" (midnight).
 func StartWithContext(ctx context.Context, schedule, interval string) {
-	if tzName := os.Getenv("TZ"); tzName != "" {
-		if loc, err := time.LoadLocation(tzName); err == nil {
-			time.Local = loc
-		} else {
-			utilities.Logger.Warnf("[HyperBackup] ⚠️ Invalid TZ '%s', using system default: %v", tzName, err)
-		}
-	}
-	utilities.Logger.Infof("[HyperBackup] 🌐 Timezone: %s", time.Local.String())
+	atomic.StoreInt32(&alive, 1)
+	defer atomic.StoreInt32(&alive, 0)
+	// manual runs triggered through the API finish before we return
+	defer manual.Wait()
+
+	loadTimezone()
+
+	stopInstances := startInstanceSchedules(ctx)
+	defer stopInstances()
+	stopRetries := startRetries(ctx)
+	defer stopRetries()
 
 	switch {
 	case schedule != "":
@@ -38,44 +46,127 @@ func StartWithContext(ctx context.Context, schedule, interval string) {
 	}
 }
 
-func runBackupCycle(next time.Time) {
+// ValidateSchedule checks the settings StartWithContext is given and TZ, so a
+// bad expression fails at start instead of when the first cycle is due.
+func ValidateSchedule(schedule, interval string) error {
+	var errs []error
+	if schedule != "" {
+		if _, err := cronParser.Parse(schedule); err != nil {
+			errs = append(errs, fmt.Errorf("invalid BACKUP_SCHEDULE '%s': %v", schedule, err))
+		}
+	} else if interval != "" {
+		if hours, err := strconv.Atoi(interval); err != nil || hours < 1 {
+			errs = append(errs, fmt.Errorf("invalid BACKUP_INTERVAL_HOURS '%s': expected a whole number of hours", interval))
+		}
+	}
+	if tz := os.Getenv("TZ"); tz != "" {
+		if _, err := time.LoadLocation(tz); err != nil {
+			errs = append(errs, fmt.Errorf("invalid TZ '%s': %v", tz, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// RunOnce runs a single backup cycle and returns its report, for one-shot
+// jobs such as a Kubernetes CronJob. Wrap ctx with backup.WithServices to run
+// only some services.
+func RunOnce(ctx context.Context) *backup.CycleReport {
+	loadTimezone()
+	atomic.StoreInt32(&running, 1)
+	defer atomic.StoreInt32(&running, 0)
+	return runBackupCycle(ctx, time.Time{})
+}
+
+func loadTimezone() {
+	if tzName := os.Getenv("TZ"); tzName != "" {
+		if loc, err := time.LoadLocation(tzName); err == nil {
+			time.Local = loc
+		} else {
+			utilities.Logger.Warnf("[HyperBackup] ⚠️ Invalid TZ '%s', using system default: %v", tzName, err)
+		}
+	}
+	utilities.Logger.Infof("[HyperBackup] 🌐 Timezone: %s", time.Local.String())
+}
+
+// runBackupCycle runs every stage once and reports the outcome of each service.
+func runBackupCycle(ctx context.Context, next time.Time) *backup.CycleReport {
 	start := time.Now()
+	report := &backup.CycleReport{StartedAt: start}
 
 	utilities.Logger.Info("🚀 [HyperBackup] Backup cycle started")
 	utilities.Logger.Infof("🕒 %s", start.Format("2006-01-02 15:04:05"))
+	catalog.Begin(start)
 
-	if err := backup.RunCoreServices(); err != nil {
+	core := backup.RunCoreServices(ctx)
+	if err := core.Err(); err != nil {
 		utilities.Logger.Errorf("[HyperBackup] ❌ Core services failed: %v", err)
 	}
-	if err := backup.RunExternalBackups(); err != nil {
+	report.Merge(core)
+
+	external := backup.RunExternalBackups(ctx)
+	if err := external.Err(); err != nil {
 		utilities.Logger.Errorf("[HyperBackup] ❌ External backups failed: %v", err)
 	}
+	report.Merge(external)
 
 	end := time.Now()
+	report.FinishedAt = end
+	if err := catalog.End(end); err != nil {
+		utilities.Logger.Warnf("[Catalog] ⚠️ Failed to write manifest: %v", err)
+	}
 	utilities.Logger.Info("✅ [HyperBackup] Backup cycle completed")
-	utilities.Logger.Infof("🕒 %s (Duration: %s)", end.Format("2006-01-02 15:04:05"), end.Sub(start).Round(time.Second))
+	utilities.Logger.Infof("🕒 %s (Duration: %s)", end.Format("2006-01-02 15:04:05"), report.Duration().Round(time.Second))
+	utilities.Logger.Infof("📊 %d succeeded, %d failed, %d skipped, %s written",
+		report.Count(backup.StatusSuccess), report.Count(backup.StatusFailed), report.Count(backup.StatusSkipped),
+		utilities.HumanBytes(report.Bytes()))
+	observe(report, next)
+	notifier.Notify(ctx, report)
+	notifyStuck(ctx)
 
 	if !next.IsZero() {
 		utilities.Logger.Infof("📅 Next backup at: %s (%s)", next.Format("2006-01-02 15:04:05"), next.Location())
 	}
 	utilities.LogDivider()
+	setLast(report)
+	return report
 }
 
+// observe feeds the cycle outcome to the metrics endpoint.
+func observe(report *backup.CycleReport, next time.Time) {
+	metrics.ObserveCycle(report.Status(), report.FinishedAt, report.Duration())
+	observeUploads(report)
+	if !next.IsZero() {
+		setNext(next)
+	}
+}
+
+// observeUploads adds the bytes each upload service sent to the metrics
+// endpoint, for cycles and retry passes alike.
+func observeUploads(report *backup.CycleReport) {
+	for _, svc := range report.Services {
+		if svc.Stage == backup.StageStorage && svc.UploadedBytes > 0 {
+			metrics.ObserveUpload(svc.Name, svc.UploadedBytes)
+		}
+	}
+}
+
+// cronParser accepts the standard five-field cron expressions.
+var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
+
 func startWithCron(ctx context.Context, schedule string) {
-	parser := cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
-	spec, err := parser.Parse(schedule)
+	spec, err := cronParser.Parse(schedule)
 	if err != nil {
 		utilities.Logger.Fatalf("[HyperBackup] ❌ Invalid BACKUP_SCHEDULE '%s': %v", schedule, err)
 	}
 
-	var running int32
 	next := spec.Next(time.Now().In(time.Local))
 	utilities.Logger.Infof("[HyperBackup] 🔁 Using cron: \"%s\"", schedule)
 	utilities.Logger.Infof("[HyperBackup] ⏳ Next backup at: %s (%s)", next.Format("2006-01-02 15:04:05"), next.Location())
 	utilities.LogDivider()
+	setNext(next)
 
 	c := cron.New(
-		cron.WithParser(parser),
+		cron.WithParser(cronParser),
 		cron.WithLocation(time.Local),
 		cron.WithChain(
 			cron.Recover(cron.PrintfLogger(utilities.Logger)),
@@ -83,22 +174,18 @@ func startWithCron(ctx context.Context, schedule string) {
 	)
 
 	if _, err := c.AddFunc(schedule, func() {
-		if !atomic.CompareAndSwapInt32(&running, 0, 1) {
-			utilities.Logger.Warn("[HyperBackup] ⚠️ Previous backup still running. Skipping this cycle.")
-			return
-		}
-		defer atomic.StoreInt32(&running, 0)
-		runBackupCycle(spec.Next(time.Now().In(time.Local)))
+		runGuarded(ctx, spec.Next(time.Now().In(time.Local)))
 	}); err != nil {
 		utilities.Logger.Fatalf("[HyperBackup] ❌ Failed to schedule job: %v", err)
 	}
 
 	c.Start()
-	runBackupCycle(next)
+	runGuarded(ctx, next)
 
 	<-ctx.Done()
 	utilities.Logger.Info("[HyperBackup] 🛑 Stopping cron scheduler...")
-	c.Stop()
+	// wait for a cycle that is still winding down after cancellation
+	<-c.Stop().Done()
 	utilities.Logger.Info("[HyperBackup] ✅ Scheduler stopped")
 }
 
@@ -114,9 +201,9 @@ func startWithInterval(ctx context.Context, hoursStr string) {
 	utilities.Logger.Infof("[HyperBackup] 🔁 Using interval: every %d hour(s)", hours)
 	utilities.LogDivider()
 
-	var running int32
 	next := time.Now().Add(dur)
-	runBackupCycle(next)
+	setNext(next)
+	runGuarded(ctx, next)
 
 	ticker := time.NewTicker(dur)
 	defer ticker.Stop()
@@ -124,18 +211,13 @@ func startWithInterval(ctx context.Context, hoursStr string) {
 	for {
 		select {
 		case <-ticker.C:
-			if !atomic.CompareAndSwapInt32(&running, 0, 1) {
-				utilities.Logger.Warn("[HyperBackup] ⚠️ Previous backup still running. Skipping this cycle.")
-				continue
-			}
 			func() {
 				defer func() {
 					if r := recover(); r != nil {
 						utilities.Logger.Errorf("[HyperBackup] ❌ Panic during backup: %v", r)
 					}
-					atomic.StoreInt32(&running, 0)
 				}()
-				runBackupCycle(time.Now().Add(dur))
+				runGuarded(ctx, time.Now().Add(dur))
 			}()
 
 		case <-ctx.Done():
@@ -0,0 +1,102 @@
+package utilities
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// PartialSuffix marks artifacts that are still being written. Files with this
+// suffix are never uploaded and are removed at startup.
+const PartialSuffix = ".partial"
+
+// AtomicFile is written under <path>.partial and only appears under its final
+// name once Commit succeeds, so a failed backup never leaves a valid-looking
+// but truncated artifact behind.
+type AtomicFile struct {
+	*os.File
+	path string
+	done bool
+}
+
+// CreateAtomic creates the partial file for path.
+func CreateAtomic(path string) (*AtomicFile, error) {
+	f, err := os.Create(path + PartialSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return &AtomicFile{File: f, path: path}, nil
+}
+
+// Commit flushes the data to disk and renames the partial file into place.
+func (f *AtomicFile) Commit() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	syncDir(filepath.Dir(f.path))
+	return nil
+}
+
+// Abort discards the partial file. It does nothing after a successful Commit,
+// so it can be deferred right after CreateAtomic.
+func (f *AtomicFile) Abort() {
+	if f.done {
+		return
+	}
+	f.done = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// syncDir makes a rename durable; failures only cost durability, not correctness.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+}
+
+// CleanPartials removes leftover partial files below root and returns how many were deleted.
+func CleanPartials(root string) (int, error) {
+	removed := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), PartialSuffix) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		Logger.Warnf("[HyperBackup] 🧹 Removed leftover partial file %s", path)
+		removed++
+		return nil
+	})
+	return removed, err
+}
+
+// IsWithin reports whether path is root or one of its descendants.
+func IsWithin(path, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
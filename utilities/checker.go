@@ -3,72 +3,51 @@
 package utilities
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
 )
 
-func CheckConfig() error {
-	Logger.Info("[HyperBackup] 🔍 Checking environment variables")
-
-	var configured int
-	var useRseries int
-
-	// rsync
-	src := os.Getenv("RSYNC_SRC")
-	dest := os.Getenv("RSYNC_DEST")
-	switch {
-	case src != "" && dest != "":
-		Logger.Info("[HyperBackup] ✅ Rsync backup configured")
-		configured++
-		useRseries++
-	case src != "" || dest != "":
-		Logger.Warn("[HyperBackup] ⚠️ Rsync: RSYNC_SRC or RSYNC_DEST is missing")
-	}
-
-	// rclone
-	remote := os.Getenv("RCLONE_REMOTE")
-	path := os.Getenv("RCLONE_PATH")
-	switch {
-	case remote != "" && path != "":
-		Logger.Info("[HyperBackup] ✅ Rclone backup configured")
-		configured++
-		useRseries++
-	case remote != "" || path != "":
-		Logger.Warn("[HyperBackup] ⚠️ Rclone: RCLONE_REMOTE or RCLONE_PATH is missing")
-	}
-
-	// MySQL
-	if os.Getenv("MYSQL_HOST") != "" {
-		Logger.Info("[HyperBackup] ✅ MySQL backup configured")
-		configured++
-	}
-
-	// PostgreSQL
-	if os.Getenv("POSTGRES_HOST") != "" {
-		Logger.Info("[HyperBackup] ✅ PostgreSQL backup configured")
-		configured++
-	}
-
-	// MongoDB
-	if os.Getenv("MONGO_HOST") != "" {
-		Logger.Info("[HyperBackup] ✅ MongoDB backup configured")
-		configured++
-	}
-
-	// Traefik
-	if os.Getenv("TRAEFIK_LOG_FILE") != "" {
-		Logger.Info("[HyperBackup] ✅ Traefik logrotate enabled")
-		configured++
-	}
-
-	if useRseries == 0 {
-		Logger.Warn("[HyperBackup] ⚠️ Warn: BACKUP WILL BE STORED LOCALLY ONLY")
-	}
-
-	if configured == 0 {
-		Logger.Warn("[HyperBackup] 🤷 No backup services configured; nothing to do")
+// RequireBinaries reports every named program that cannot be found on PATH.
+func RequireBinaries(names ...string) error {
+	var errs []error
+	for _, name := range names {
+		if _, err := exec.LookPath(name); err != nil {
+			errs = append(errs, fmt.Errorf("%s not found on PATH", name))
+		}
 	}
+	return errors.Join(errs...)
+}
 
-	Logger.Info("[HyperBackup] ✅ Configuration check complete")
-	LogDivider()
-	return nil
+// CheckWritable reports whether files can be created in dir. A directory that
+// does not exist yet is checked at its nearest existing parent, where it would
+// be created. The check writes and removes a temporary file.
+func CheckWritable(dir string) error {
+	path := filepath.Clean(dir)
+	for {
+		fi, err := os.Stat(path)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%s is not a directory", path)
+			}
+			break
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return err
+		}
+		path = parent
+	}
+
+	f, err := os.CreateTemp(path, ".hyper-backup-check-*")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %w", dir, errors.Unwrap(err))
+	}
+	f.Close()
+	return os.Remove(f.Name())
 }
@@ -0,0 +1,24 @@
+package utilities
+
+import (
+	"context"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// commandWaitDelay is how long a cancelled command may take to exit after
+// SIGTERM before it is killed.
+const commandWaitDelay = 10 * time.Second
+
+// Command is exec.CommandContext with a graceful stop: when ctx is cancelled
+// the process receives SIGTERM and is only killed if it outlives
+// commandWaitDelay.
+func Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(syscall.SIGTERM)
+	}
+	cmd.WaitDelay = commandWaitDelay
+	return cmd
+}
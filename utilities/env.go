@@ -0,0 +1,44 @@
+package utilities
+
+import "os"
+
+// Env supplies the settings of one service instance under their environment
+// variable names. The zero value reads the process environment; instances
+// defined in a config file carry their own values and ignore the environment.
+type Env struct {
+	values map[string]string
+}
+
+// NewEnv returns an Env holding exactly values.
+func NewEnv(values map[string]string) Env {
+	if values == nil {
+		values = map[string]string{}
+	}
+	return Env{values: values}
+}
+
+// Getenv returns the setting named key, or "" when it is unset. Credentials
+// and keys (see HasFileVariant) fall back to the file named by key+"_FILE";
+// credentials are registered for redaction.
+func (e Env) Getenv(key string) string {
+	v := e.lookup(key)
+	if !HasFileVariant(key) {
+		return v
+	}
+	if v == "" {
+		if path := e.lookup(key + "_FILE"); path != "" {
+			v = readSecretFile(key, path)
+		}
+	}
+	if v != "" && secretKeys[key] {
+		RegisterSecret(v)
+	}
+	return v
+}
+
+func (e Env) lookup(key string) string {
+	if e.values == nil {
+		return os.Getenv(key)
+	}
+	return e.values[key]
+}
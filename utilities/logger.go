@@ -26,21 +26,33 @@ func newLogger() *logrus.Logger {
 		PadLevelText:    true,
 	})
 
+	log.AddHook(redactHook{})
+
 	// Set log level from LOG_LEVEL env (default: info)
-	levelStr := strings.ToLower(strings.TrimSpace(os.Getenv("LOG_LEVEL")))
+	setLevel(log, os.Getenv("LOG_LEVEL"))
+
+	return log
+}
+
+// SetLogLevel changes the level of Logger, e.g. after LOG_LEVEL was
+// overridden on the command line. Invalid levels fall back to info.
+func SetLogLevel(level string) {
+	setLevel(Logger, level)
+}
+
+func setLevel(log *logrus.Logger, levelStr string) {
+	levelStr = strings.ToLower(strings.TrimSpace(levelStr))
 	if levelStr == "" {
 		log.SetLevel(logrus.InfoLevel)
-	} else {
-		level, err := logrus.ParseLevel(levelStr)
-		if err != nil {
-			log.Warnf("⚠️ Invalid LOG_LEVEL: %s. Falling back to info", levelStr)
-			log.SetLevel(logrus.InfoLevel)
-		} else {
-			log.SetLevel(level)
-		}
+		return
 	}
-
-	return log
+	level, err := logrus.ParseLevel(levelStr)
+	if err != nil {
+		log.Warnf("⚠️ Invalid LOG_LEVEL: %s. Falling back to info", levelStr)
+		log.SetLevel(logrus.InfoLevel)
+		return
+	}
+	log.SetLevel(level)
 }
 
 // LogDivider prints a visual divider line in the logs to separate log entries
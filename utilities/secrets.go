@@ -0,0 +1,149 @@
+package utilities
+
+import (
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// secretKeys are the settings holding credentials. Each can also be read from
+// the file named by the same variable with a _FILE suffix, e.g.
+// MYSQL_PASSWORD_FILE=/run/secrets/mysql, and its values are redacted from
+// the logs once read.
+var secretKeys = map[string]bool{
+	"MYSQL_PASSWORD":          true,
+	"MYSQL_DSN":               true,
+	"POSTGRES_PASSWORD":       true,
+	"POSTGRES_DSN":            true,
+	"MONGO_URI":               true,
+	"AWS_ACCESS_KEY_ID":       true,
+	"AWS_SECRET_ACCESS_KEY":   true,
+	"AWS_SESSION_TOKEN":       true,
+	"NOTIFY_WEBHOOK_URL":      true,
+	"NOTIFY_SLACK_URL":        true,
+	"NOTIFY_DISCORD_URL":      true,
+	"NOTIFY_SMTP_PASSWORD":    true,
+	"API_TOKEN":               true,
+	"SFTP_PASSWORD":           true,
+	"SFTP_PRIVATE_KEY":        true,
+	"SFTP_KEY_PASSPHRASE":     true,
+	"ENCRYPT_PASSPHRASE":      true,
+	"ENCRYPT_AGE_IDENTITY":    true,
+	"ENCRYPT_PGP_PRIVATE_KEY": true,
+	"ENCRYPT_PGP_PASSPHRASE":  true,
+	// encryption of single destinations
+	"RCLONE_ENCRYPT_PASSPHRASE":     true,
+	"S3_ENCRYPT_PASSPHRASE":         true,
+	"LOCAL_DEST_ENCRYPT_PASSPHRASE": true,
+	"SFTP_ENCRYPT_PASSPHRASE":       true,
+}
+
+// fileKeys accept the _FILE variant too but are not secret, e.g. public keys.
+var fileKeys = map[string]bool{
+	"ENCRYPT_AGE_RECIPIENTS": true,
+	"ENCRYPT_PGP_PUBLIC_KEY": true,
+
+	"RCLONE_ENCRYPT_AGE_RECIPIENTS":     true,
+	"RCLONE_ENCRYPT_PGP_PUBLIC_KEY":     true,
+	"S3_ENCRYPT_AGE_RECIPIENTS":         true,
+	"S3_ENCRYPT_PGP_PUBLIC_KEY":         true,
+	"LOCAL_DEST_ENCRYPT_AGE_RECIPIENTS": true,
+	"LOCAL_DEST_ENCRYPT_PGP_PUBLIC_KEY": true,
+	"SFTP_ENCRYPT_AGE_RECIPIENTS":       true,
+	"SFTP_ENCRYPT_PGP_PUBLIC_KEY":       true,
+}
+
+// IsSecret reports whether key holds a credential.
+func IsSecret(key string) bool {
+	return secretKeys[key]
+}
+
+// HasFileVariant reports whether key can also be read from the file named by
+// key+"_FILE".
+func HasFileVariant(key string) bool {
+	return secretKeys[key] || fileKeys[key]
+}
+
+// Getenv reads a setting from the process environment, honouring the _FILE
+// variant of credentials. It is Env{}.Getenv.
+func Getenv(key string) string {
+	return Env{}.Getenv(key)
+}
+
+// readSecretFile returns the content of a _FILE secret without the trailing
+// newline most editors and `echo` add.
+func readSecretFile(key, path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		Logger.Errorf("[HyperBackup] ❌ Cannot read %s_FILE: %v", key, err)
+		return ""
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// minSecretLen keeps very short values from turning the logs into asterisks.
+const minSecretLen = 4
+
+var (
+	secretsMu sync.RWMutex
+	secrets   []string
+
+	dsnPassword = regexp.MustCompile(`(?:^|\s)password\s*=\s*('(?:[^'\\]|\\.)*'|\S+)`)
+)
+
+// RegisterSecret makes Redact hide value. For connection strings, the
+// password inside is registered as well, so it is hidden wherever it appears.
+func RegisterSecret(value string) {
+	parts := []string{value}
+	if u, err := url.Parse(value); err == nil && u.User != nil {
+		if pwd, ok := u.User.Password(); ok {
+			parts = append(parts, pwd, url.QueryEscape(pwd), url.PathEscape(pwd))
+		}
+	}
+	if m := dsnPassword.FindStringSubmatch(value); m != nil {
+		parts = append(parts, strings.Trim(m[1], "'"))
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, p := range parts {
+		if len(p) < minSecretLen || slices.Contains(secrets, p) {
+			continue
+		}
+		secrets = append(secrets, p)
+	}
+	// Longest first, so a DSN is hidden as a whole before its password
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// Redact replaces every registered secret in s with "****".
+func Redact(s string) string {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.ReplaceAll(s, secret, "****")
+	}
+	return s
+}
+
+// redactHook hides registered secrets in every log entry, including the
+// command output logged after a failed dump or upload.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = Redact(entry.Message)
+	for k, v := range entry.Data {
+		if s, ok := v.(string); ok {
+			entry.Data[k] = Redact(s)
+		}
+	}
+	return nil
+}